@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	_ "expvar" // metrics at /debug/vars
 	"flag"
+	"net"
+	nethttp "net/http"
 	"os"
 	"os/signal"
 	"sync"
@@ -10,14 +13,18 @@ import (
 
 	"github.com/gaukas/passthru/config"
 	"github.com/gaukas/passthru/handler"
+	"github.com/gaukas/passthru/internal/activation"
 	"github.com/gaukas/passthru/internal/logger"
+	"github.com/gaukas/passthru/internal/upgrade"
 	"github.com/gaukas/passthru/protocol"
+	"github.com/gaukas/passthru/protocol/http"
 	"github.com/gaukas/passthru/protocol/tls"
 )
 
 var (
 	supportedProtocols = []protocol.Protocol{
 		&tls.Protocol{},
+		&http.Protocol{},
 	}
 	serverVersion *config.Version = &config.Version{
 		Major: 0,
@@ -34,6 +41,9 @@ func main() {
 	configFile := flag.String("c", "", "path to config file")
 	workerCountPerServer := flag.Int("w", 10, "number of workers (default 10, 0 for unlimited) assigned for each server")
 	workerTimeout := flag.Duration("t", 5*time.Second, "worker timeout in seconds (default 5)")
+	drainTimeout := flag.Duration("d", 30*time.Second, "time to drain the connections after an upgrade (default 30s)")
+	accessLogFile := flag.String("a", "", "path to access log file (default none)")
+	metricsAddr := flag.String("m", "", "address to serve metrics on at /debug/vars (default none)")
 	flag.Parse()
 
 	// Disable worker-based concurrency for now
@@ -69,7 +79,39 @@ func main() {
 		logger.Infof("config version is better patched than the server. There could be unintended behaviors.")
 	}
 
-	bufServer := make(chan *handler.Server, len(conf.Servers))
+	// Access log shared by all servers
+	var accessLog *os.File
+	if *accessLogFile != "" {
+		accessLog, err = os.OpenFile(*accessLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Metrics like the rate limits hit, shared by all servers
+	if *metricsAddr != "" {
+		go func() {
+			if err := nethttp.ListenAndServe(*metricsAddr, nil); err != nil {
+				logger.Errorf("Failed to serve metrics on %s: %v", *metricsAddr, err)
+			}
+		}()
+	}
+
+	// Sockets passed by systemd, if socket-activated
+	activated, err := activation.Listeners()
+	if err != nil {
+		panic(err)
+	}
+	// Listeners handed over by the old process, if upgrading
+	handedOver, upgradeConn, err := upgrade.Inherited()
+	if err != nil {
+		panic(err)
+	}
+	activated = append(activated, handedOver...)
+	inherited := map[net.Listener]bool{}
+	allStarted := true
+
+	servers := []*handler.Server{}
 	workerWg := &sync.WaitGroup{}
 
 	for serverAddr, protoGroup := range conf.Servers {
@@ -91,11 +133,21 @@ func main() {
 		if *workerCountPerServer <= 0 {
 			// Create unlimited server
 			server = handler.NewServer(serverAddr, protoMgr, handler.SERVER_MODE_UNLIMITED)
-			server.Start()
+			inheritListeners(server, serverAddr, activated, inherited)
+			server.SetSocketOptions(conf.SocketOptions)
+			if accessLog != nil {
+				server.SetAccessLog(accessLog)
+			}
+			allStarted = server.Start() == nil && allStarted
 		} else {
 			// Create worker-based server
 			server = handler.NewServer(serverAddr, protoMgr, handler.SERVER_MODE_WORKER)
-			server.Start()
+			inheritListeners(server, serverAddr, activated, inherited)
+			server.SetSocketOptions(conf.SocketOptions)
+			if accessLog != nil {
+				server.SetAccessLog(accessLog)
+			}
+			allStarted = server.Start() == nil && allStarted
 			// spawn workers
 			for i := 0; i < *workerCountPerServer; i++ {
 				workerWg.Add(1)
@@ -126,21 +178,52 @@ func main() {
 
 		//fmt.Printf("[INFO] server %s started\n", serverAddr)
 		logger.Infof("server %s started\n", serverAddr)
-		bufServer <- server
+		servers = append(servers, server)
+	}
+
+	for _, l := range activated {
+		if !inherited[l.Listener] {
+			logger.Warnf("Inherited listener %s on %s matches no server, closing it", l.Name, l.Addr())
+			l.Close()
+		}
 	}
-	close(bufServer)
 
-	// Capture Ctrl+C
+	// Let the old process stop accepting and drain, or kill us if not all servers started
+	if upgradeConn != nil {
+		if allStarted {
+			upgrade.Ready(upgradeConn)
+		}
+		upgradeConn.Close()
+	}
+
+	// Capture Ctrl+C, and SIGUSR2 for an upgrade on unix
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, append([]os.Signal{os.Interrupt}, upgradeSignals...)...)
 	go func() {
-		<-c
-		for {
-			// stop all servers
-			server := <-bufServer
-			if server == nil {
-				break
+		for sig := range c {
+			if isUpgradeSignal(sig) {
+				err := upgrade.Upgrade(handOverListeners(servers))
+				if err != nil {
+					logger.Errorf("Upgrade failed: %v", err)
+					continue
+				}
+
+				// stop accepting on all servers before draining any
+				for _, server := range servers {
+					server.Stop()
+				}
+				logger.Warnf("Upgraded. Draining connections...")
+				ctxDrain, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+				for _, server := range servers {
+					server.Shutdown(ctxDrain)
+				}
+				cancel()
 			}
+			break
+		}
+
+		// stop all servers
+		for _, server := range servers {
 			server.Stop()
 		}
 		logger.Warnf("All servers stopped. Waiting for workers to finish...")
@@ -153,3 +236,32 @@ func main() {
 
 	select {}
 }
+
+// handOverListeners names the listeners of all servers to be handed over in an upgrade.
+func handOverListeners(servers []*handler.Server) []activation.Listener {
+	listeners := []activation.Listener{}
+	for _, server := range servers {
+		for listenAddr, group := range server.Listeners() {
+			for _, listener := range group {
+				listeners = append(listeners, activation.Listener{Name: activation.Name(listenAddr), Listener: listener})
+			}
+		}
+	}
+	return listeners
+}
+
+// inheritListeners hands the sockets passed by systemd or the old process to the server they belong to.
+func inheritListeners(server *handler.Server, serverAddr config.ServerAddr, activated []activation.Listener, inherited map[net.Listener]bool) {
+	listenAddrs, err := config.ParseServerAddr(serverAddr)
+	if err != nil {
+		return // reported by server.Start()
+	}
+	for _, listenAddr := range listenAddrs {
+		for _, listener := range activation.FindAll(activated, listenAddr) {
+			if !inherited[listener] {
+				server.Inherit(listenAddr, listener)
+				inherited[listener] = true
+			}
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !aix && !android && !darwin && !dragonfly && !freebsd && !hurd && !illumos && !ios && !linux && !netbsd && !openbsd && !solaris
+
+package main
+
+import "os"
+
+// No upgrade without unix, see upgrade.ErrUnsupported.
+var upgradeSignals = []os.Signal{}
+
+func isUpgradeSignal(sig os.Signal) bool {
+	return false
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Example addresses:
+// "127.0.0.1:443"        -> ("tcp", "127.0.0.1:443")
+// "tcp4:0.0.0.0:443"     -> ("tcp4", "0.0.0.0:443"), IPv4 only
+// "tcp6:[::]:443"        -> ("tcp6", "[::]:443"), IPv6 only
+// "tcp:[::]:443"         -> ("tcp", "[::]:443"), dual-stack when listening
+// "unix:/run/app.sock"   -> ("unix", "/run/app.sock")
+// "unix:@app"            -> ("unix", "@app"), an abstract socket on Linux
+//
+// In a ServerAddr, "fd:<name>" refers to a listener inherited from the service manager
+// by its FileDescriptorName rather than an address to listen on.
+
+// ParseNetAddr splits an address in the config into the network and the address to be used
+// with net.Dial or net.Listen.
+func ParseNetAddr(addr string) (network string, address string) {
+	for _, network := range []string{"unix", "tcp", "tcp4", "tcp6"} {
+		if strings.HasPrefix(addr, network+":") {
+			address = strings.TrimPrefix(addr, network+":")
+			// "tcp:443" is the host "tcp" rather than the network
+			if network == "unix" || strings.Contains(address, ":") {
+				return network, address
+			}
+		}
+	}
+	return "tcp", addr
+}
+
+// ListenAddr is one of the addresses a server listens on.
+type ListenAddr struct {
+	Network string
+	Address string
+}
+
+func (la ListenAddr) String() string {
+	return la.Network + ":" + la.Address
+}
+
+// ParseServerAddr parses a ServerAddr, which is a comma-separated list of addresses
+// sharing the same ProtocolGroup, like "tcp4:0.0.0.0:443,tcp6:[::]:443".
+func ParseServerAddr(serverAddr ServerAddr) ([]ListenAddr, error) {
+	listenAddrs := []ListenAddr{}
+	for _, addr := range strings.Split(serverAddr, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if strings.HasPrefix(addr, "fd:") {
+			listenAddrs = append(listenAddrs, ListenAddr{Network: "fd", Address: strings.TrimPrefix(addr, "fd:")})
+			continue
+		}
+		network, address := ParseNetAddr(addr)
+		listenAddrs = append(listenAddrs, ListenAddr{Network: network, Address: address})
+	}
+	if len(listenAddrs) == 0 {
+		return nil, fmt.Errorf("no address to listen on: %q", serverAddr)
+	}
+	return listenAddrs, nil
+}
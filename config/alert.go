@@ -0,0 +1,39 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+// Example REJECT_TLS_ALERT Action, answering a ClientHello with a fatal alert before closing:
+// {
+// 		"action": "REJECT_TLS_ALERT",
+// 		"alert": "unrecognized_name"
+// }
+
+var ErrInvalidAlert = errors.New("invalid TLS alert")
+
+// Alert is the description of the TLS alert sent by REJECT_TLS_ALERT.
+type Alert = string
+
+const (
+	ALERT_HANDSHAKE_FAILURE Alert = "handshake_failure" // the default
+	ALERT_ACCESS_DENIED     Alert = "access_denied"
+	ALERT_UNRECOGNIZED_NAME Alert = "unrecognized_name"
+)
+
+func (a *Action) validateAlert() error {
+	switch a.Alert {
+	case "", ALERT_HANDSHAKE_FAILURE, ALERT_ACCESS_DENIED, ALERT_UNRECOGNIZED_NAME:
+	default:
+		logger.Errorf("%v: %s", ErrInvalidAlert, a.Alert)
+		return fmt.Errorf("%w: %s", ErrInvalidAlert, a.Alert)
+	}
+	if a.Alert != "" && a.Action != ACTION_REJECT_TLS_ALERT {
+		logger.Errorf("alert is set for %s", a.Action)
+		return fmt.Errorf("alert is set for %s", a.Action)
+	}
+	return nil
+}
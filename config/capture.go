@@ -0,0 +1,48 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+// Example FORWARD Action capturing every connection of the rule:
+// {
+// 		"action": "FORWARD",
+// 		"to_addr": "127.0.0.1:8443",
+// 		"capture": "/var/lib/passthru/caps/",
+// 		"capture_max_bytes": 1048576,
+// 		"capture_max_files": 100
+// }
+//
+// Each connection is written to its own pcapng file in the directory, as a synthetic TCP stream
+// with both directions and the protocol, rule and attributes of the connection in a comment.
+// The stream after the TLS termination is captured in plaintext. A file stops growing at
+// capture_max_bytes, and no more files are written while the directory has capture_max_files.
+
+var ErrInvalidCapture = errors.New("invalid capture")
+
+const (
+	DEFAULT_CAPTURE_MAX_BYTES = 10 << 20 // bytes per file
+	DEFAULT_CAPTURE_MAX_FILES = 1000     // files per directory
+)
+
+func (a *Action) validateCapture() error {
+	if a.Capture == "" {
+		if a.CaptureMaxBytes != 0 || a.CaptureMaxFiles != 0 {
+			logger.Errorf("%v: capture limits without capture", ErrInvalidCapture)
+			return fmt.Errorf("%w: capture limits without capture", ErrInvalidCapture)
+		}
+		return nil
+	}
+	if a.Action != ACTION_FORWARD && a.Action != ACTION_TERMINATE {
+		logger.Errorf("%v: capture is set for %s", ErrInvalidCapture, a.Action)
+		return fmt.Errorf("%w: capture is set for %s", ErrInvalidCapture, a.Action)
+	}
+	if a.CaptureMaxBytes < 0 || a.CaptureMaxFiles < 0 {
+		logger.Errorf("%v: negative capture limits", ErrInvalidCapture)
+		return fmt.Errorf("%w: negative capture limits", ErrInvalidCapture)
+	}
+	return nil
+}
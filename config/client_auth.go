@@ -0,0 +1,128 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+// Example TERMINATE Action requiring client certificates:
+// {
+// 		"action": "TERMINATE",
+// 		"certificates": [{"cert": "/etc/passthru/internal.crt", "key": "/etc/passthru/internal.key"}],
+// 		"client_auth": {
+// 			"ca": "/etc/passthru/clients-ca.pem",
+// 			"proxy_protocol": true,
+// 			"routes": [
+// 				{"match": "CN alice OR SAN alice@example.com", "action": "FORWARD", "to_addr": "127.0.0.1:8081"},
+// 				{"match": "ISSUER Partner CA AND NOT SPKI 5c0d...", "action": "FORWARD", "to_addr": "127.0.0.1:8082"},
+// 				{"match": "CATCHALL", "action": "REJECT"}
+// 			]
+// 		}
+// }
+//
+// Routes are tried in order and the first match decides where the connection goes.
+// Without a match, the connection is forwarded to ToAddr of the TERMINATE action, if set.
+//
+// Terms of a route:
+// "CN <name>"       the common name of the subject
+// "SAN <name>"      any DNS name, email address, IP address or URI in the subject alternative names
+// "ISSUER <name>"   the common name of the issuer, or the full issuer like "CN=Partner CA,O=Example"
+// "SPKI <hash>"     SHA-256 of the subject public key info, in hex or base64
+// "CATCHALL"        any certificate
+//
+// A value may be double-quoted, like a JSON string, to keep spaces, parentheses
+// or AND/OR/NOT in it: "CN \"R&D (AND Ops)\"".
+
+var ErrInvalidClientRoute = errors.New("invalid client route")
+
+const (
+	CLIENT_RULE_CN       = "CN"
+	CLIENT_RULE_SAN      = "SAN"
+	CLIENT_RULE_ISSUER   = "ISSUER"
+	CLIENT_RULE_SPKI     = "SPKI"
+	CLIENT_RULE_CATCHALL = "CATCHALL"
+)
+
+// ClientAuth requires and verifies client certificates when terminating TLS.
+type ClientAuth struct {
+	CAFile        string        `json:"ca"`                       // PEM bundle of the CAs issuing client certificates
+	Routes        []ClientRoute `json:"routes,omitempty"`         // Where to forward to, by the client certificate
+	ProxyProtocol bool          `json:"proxy_protocol,omitempty"` // Send a PROXY v2 header with the verified identity to the upstream
+}
+
+// ClientRoute is the action taken for the client certificates matching the rule expression.
+// The action is either FORWARD or REJECT.
+type ClientRoute struct {
+	Match Rule `json:"match"`
+	Action
+}
+
+// ParseClientRule splits a term of a client route into its type and value, unquoting the value if quoted.
+func ParseClientRule(term Rule) (ruleType string, value string, err error) {
+	parts := strings.SplitN(term, " ", 2)
+	if len(parts) == 2 && strings.HasPrefix(parts[1], `"`) {
+		unquoted, err := strconv.Unquote(parts[1])
+		if err != nil {
+			return "", "", fmt.Errorf("%w: %q: %v", ErrInvalidClientRoute, term, err)
+		}
+		parts[1] = unquoted
+	}
+	switch parts[0] {
+	case CLIENT_RULE_CATCHALL:
+		if len(parts) == 1 {
+			return parts[0], "", nil
+		}
+	case CLIENT_RULE_CN, CLIENT_RULE_SAN, CLIENT_RULE_ISSUER:
+		if len(parts) == 2 && parts[1] != "" {
+			return parts[0], parts[1], nil
+		}
+	case CLIENT_RULE_SPKI:
+		if len(parts) == 2 && parts[1] != "" && !strings.Contains(parts[1], " ") {
+			return parts[0], parts[1], nil
+		}
+	}
+	return "", "", fmt.Errorf("%w: %q", ErrInvalidClientRoute, term)
+}
+
+func (a *Action) validateClientAuth() error {
+	if a.ClientAuth == nil {
+		return nil
+	}
+	if a.Action != ACTION_TERMINATE {
+		logger.Errorf("client_auth is only supported by TERMINATE")
+		return fmt.Errorf("%w: client_auth is only supported by TERMINATE", ErrInvalidClientRoute)
+	}
+	if a.ClientAuth.CAFile == "" {
+		logger.Errorf("client_auth requires a CA")
+		return fmt.Errorf("%w: client_auth requires a CA", ErrInvalidClientRoute)
+	}
+	if err := loadCAFile(a.ClientAuth.CAFile); err != nil {
+		logger.Errorf("client_auth: %v", err)
+		return fmt.Errorf("client_auth: %w", err)
+	}
+
+	for _, route := range a.ClientAuth.Routes {
+		expr, err := ParseRuleExpr(route.Match)
+		if err != nil {
+			return err
+		}
+		for _, term := range expr.Terms() {
+			if _, _, err := ParseClientRule(term); err != nil {
+				logger.Errorf("%v", err)
+				return err
+			}
+		}
+		if route.Action.Action != ACTION_FORWARD && route.Action.Action != ACTION_REJECT {
+			logger.Errorf("%v: %q must FORWARD or REJECT", ErrInvalidClientRoute, route.Match)
+			return fmt.Errorf("%w: %q must FORWARD or REJECT", ErrInvalidClientRoute, route.Match)
+		}
+		if err := route.Action.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -12,6 +12,8 @@ import (
 type Config struct {
 	Version Version     `json:"version"`
 	Servers ServerGroup `json:"servers"` // A list of servers to listen on
+
+	SocketOptions SocketOptions `json:"socket_options,omitempty"` // Options of the sockets of all servers
 }
 
 func LoadConfig(filename string) (*Config, error) {
@@ -75,4 +77,7 @@ func (c *Config) Write(filename string) error {
 
 // ServerGroup is a map of server address to protocol filters
 type ServerGroup = map[ServerAddr]ProtocolGroup
+
+// ServerAddr is one or more comma-separated addresses to listen on, see ParseServerAddr.
+// E.g.: "0.0.0.0:443", "tcp4:0.0.0.0:443,tcp6:[::]:443", "unix:/run/passthru.sock"
 type ServerAddr = string
@@ -0,0 +1,268 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+// Example rule expressions:
+// "SNI api.example.com AND ALPN h2"
+// "SNI foo.com AND NOT SRC 10.0.0.0/8"
+// "(SNI a.example.com OR SNI b.example.com) AND NOT ALPN http/1.1"
+//
+// Operators are NOT, AND, OR (from the highest precedence to the lowest),
+// and parentheses can be used for grouping. Everything else is a term,
+// which is a plain rule like "SNI example.com" evaluated by the protocol.
+// Double quotes keep a value with spaces, parentheses or operators in a single term.
+
+var (
+	ErrInvalidRuleExpr = errors.New("invalid rule expression")
+)
+
+type ExprOp uint8
+
+const (
+	EXPR_TERM ExprOp = iota // a plain rule, like "SNI example.com"
+	EXPR_AND
+	EXPR_OR
+	EXPR_NOT
+)
+
+// RuleExpr is a node in the tree parsed from a rule expression.
+type RuleExpr struct {
+	Op       ExprOp
+	Term     Rule        // set only when Op is EXPR_TERM
+	Children []*RuleExpr // operands of AND/OR, or the single operand of NOT
+}
+
+// IsRuleExpr returns true if the rule uses any of the boolean operators or parentheses.
+func IsRuleExpr(rule Rule) bool {
+	for _, token := range tokenizeRuleExpr(rule) {
+		switch token {
+		case "AND", "OR", "NOT", "(", ")":
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRuleExpr parses a rule expression into a tree.
+func ParseRuleExpr(rule Rule) (*RuleExpr, error) {
+	p := &exprParser{
+		rule:   rule,
+		tokens: tokenizeRuleExpr(rule),
+	}
+	if len(p.tokens) == 0 {
+		logger.Errorf("Invalid rule expression %q: empty expression", rule)
+		return nil, fmt.Errorf("%w %q: empty expression", ErrInvalidRuleExpr, rule)
+	}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		logger.Errorf("%v", err)
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		err = p.errorf("unexpected %q", p.tokens[p.pos])
+		logger.Errorf("%v", err)
+		return nil, err
+	}
+	return expr, nil
+}
+
+// Eval evaluates the expression, calling match for each term that needs to be checked.
+func (e *RuleExpr) Eval(match func(term Rule) bool) bool {
+	switch e.Op {
+	case EXPR_TERM:
+		return match(e.Term)
+	case EXPR_AND:
+		for _, child := range e.Children {
+			if !child.Eval(match) {
+				return false
+			}
+		}
+		return true
+	case EXPR_OR:
+		for _, child := range e.Children {
+			if child.Eval(match) {
+				return true
+			}
+		}
+		return false
+	case EXPR_NOT:
+		return !e.Children[0].Eval(match)
+	default:
+		return false
+	}
+}
+
+// Terms returns all terms in the expression, so they can be validated before use.
+func (e *RuleExpr) Terms() []Rule {
+	if e.Op == EXPR_TERM {
+		return []Rule{e.Term}
+	}
+	terms := []Rule{}
+	for _, child := range e.Children {
+		terms = append(terms, child.Terms()...)
+	}
+	return terms
+}
+
+func (e *RuleExpr) String() string {
+	switch e.Op {
+	case EXPR_TERM:
+		return e.Term
+	case EXPR_NOT:
+		return "NOT " + e.Children[0].String()
+	case EXPR_AND, EXPR_OR:
+		sep := " AND "
+		if e.Op == EXPR_OR {
+			sep = " OR "
+		}
+		parts := make([]string, 0, len(e.Children))
+		for _, child := range e.Children {
+			parts = append(parts, child.String())
+		}
+		return "(" + strings.Join(parts, sep) + ")"
+	default:
+		return ""
+	}
+}
+
+// tokenizeRuleExpr splits on spaces, with parentheses as tokens of their own.
+// A double-quoted string is a single token, quotes included, so that a value
+// may have spaces, parentheses or operators in it, e.g. CN "R&D (AND Ops)".
+func tokenizeRuleExpr(rule Rule) []string {
+	tokens := []string{}
+	var token strings.Builder
+	flush := func() {
+		if token.Len() > 0 {
+			tokens = append(tokens, token.String())
+			token.Reset()
+		}
+	}
+	quoted, escaped := false, false
+	for _, r := range rule {
+		switch {
+		case quoted:
+			token.WriteRune(r)
+			if escaped {
+				escaped = false
+			} else if r == '\\' {
+				escaped = true
+			} else if r == '"' {
+				quoted = false
+			}
+		case r == '"':
+			token.WriteRune(r)
+			quoted = true
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			token.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+type exprParser struct {
+	rule   Rule
+	tokens []string
+	pos    int
+}
+
+func (p *exprParser) errorf(format string, v ...interface{}) error {
+	return fmt.Errorf("%w %q: %s", ErrInvalidRuleExpr, p.rule, fmt.Sprintf(format, v...))
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) parseOr() (*RuleExpr, error) {
+	return p.parseBinary("OR", EXPR_OR, p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (*RuleExpr, error) {
+	return p.parseBinary("AND", EXPR_AND, p.parseNot)
+}
+
+func (p *exprParser) parseBinary(keyword string, op ExprOp, operand func() (*RuleExpr, error)) (*RuleExpr, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []*RuleExpr{first}
+	for p.peek() == keyword {
+		p.pos++
+		next, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, next)
+	}
+
+	if len(children) == 1 {
+		return first, nil
+	}
+	return &RuleExpr{Op: op, Children: children}, nil
+}
+
+func (p *exprParser) parseNot() (*RuleExpr, error) {
+	if p.peek() == "NOT" {
+		p.pos++
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &RuleExpr{Op: EXPR_NOT, Children: []*RuleExpr{operand}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (*RuleExpr, error) {
+	switch p.peek() {
+	case "":
+		return nil, p.errorf("unexpected end of expression")
+	case "(":
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, p.errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return expr, nil
+	case ")", "AND", "OR":
+		return nil, p.errorf("unexpected %q", p.peek())
+	}
+
+	// a term is everything up to the next operator or parenthesis
+	termParts := []string{}
+	for p.pos < len(p.tokens) {
+		token := p.tokens[p.pos]
+		if token == "AND" || token == "OR" || token == "NOT" || token == "(" || token == ")" {
+			break
+		}
+		termParts = append(termParts, token)
+		p.pos++
+	}
+	if p.peek() == "NOT" || p.peek() == "(" {
+		return nil, p.errorf("unexpected %q after %q", p.peek(), strings.Join(termParts, " "))
+	}
+	return &RuleExpr{Op: EXPR_TERM, Term: strings.Join(termParts, " ")}, nil
+}
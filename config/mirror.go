@@ -0,0 +1,67 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+// Example FORWARD Action mirroring the first 4 KiB of each direction to a TCP listener:
+// {
+// 		"action": "FORWARD",
+// 		"to_addr": "127.0.0.1:8443",
+// 		"mirror": {"sink": "tcp", "to": "127.0.0.1:9000", "max_bytes": 4096}
+// }
+//
+// Sinks:
+// "tcp"    a new connection to the address in "to" for each connection, receiving both directions as they come
+// "file"   a new file in the directory "to" for each connection, with both directions as they come
+// "pcap"   the pcapng file "to" shared by all connections, each one a TCP stream with both directions apart
+//
+// Mirroring never slows the connection down: once more than queue_size bytes are waiting for
+// a slow sink, the rest is dropped from the mirror, leaving a gap in a pcap stream.
+
+var ErrInvalidMirror = errors.New("invalid mirror")
+
+// MirrorSink is where a mirror copies the connection to.
+type MirrorSink = string
+
+const (
+	MIRROR_SINK_TCP  MirrorSink = "tcp"
+	MIRROR_SINK_FILE MirrorSink = "file"
+	MIRROR_SINK_PCAP MirrorSink = "pcap"
+
+	DEFAULT_MIRROR_QUEUE_SIZE = 1 << 20 // bytes
+)
+
+// Mirror copies a FORWARD or TERMINATE connection to a sink, in addition to forwarding it.
+// The stream after the TLS termination is copied in plaintext.
+type Mirror struct {
+	Sink      MirrorSink `json:"sink"`                 // "tcp", "file" or "pcap"
+	To        string     `json:"to"`                   // Address, directory or file of the sink
+	MaxBytes  int64      `json:"max_bytes,omitempty"`  // Bytes to mirror of each direction, all by default
+	QueueSize int        `json:"queue_size,omitempty"` // Bytes waiting for the sink before dropping, DEFAULT_MIRROR_QUEUE_SIZE by default
+}
+
+func (a *Action) validateMirror() error {
+	m := a.Mirror
+	if m == nil {
+		return nil
+	}
+	if a.Action != ACTION_FORWARD && a.Action != ACTION_TERMINATE {
+		logger.Errorf("%v: mirror is set for %s", ErrInvalidMirror, a.Action)
+		return fmt.Errorf("%w: mirror is set for %s", ErrInvalidMirror, a.Action)
+	}
+	switch m.Sink {
+	case MIRROR_SINK_TCP, MIRROR_SINK_FILE, MIRROR_SINK_PCAP:
+	default:
+		logger.Errorf("%v: unknown sink %q", ErrInvalidMirror, m.Sink)
+		return fmt.Errorf("%w: unknown sink %q", ErrInvalidMirror, m.Sink)
+	}
+	if m.To == "" || m.MaxBytes < 0 || m.QueueSize < 0 {
+		logger.Errorf("%v: %+v", ErrInvalidMirror, *m)
+		return fmt.Errorf("%w: %+v", ErrInvalidMirror, *m)
+	}
+	return nil
+}
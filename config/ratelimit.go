@@ -0,0 +1,63 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+// Example FORWARD Action limiting each connection to 1 MiB/s, with a 4 MiB burst,
+// and all connections of the rule from a client IP to 2 MiB/s:
+// {
+// 		"action": "FORWARD",
+// 		"to_addr": "127.0.0.1:8443",
+// 		"rate_limit": {
+// 			"conn": {"rate": 1048576, "burst": 4194304},
+// 			"client": {"rate": 2097152}
+// 		}
+// }
+//
+// Scopes:
+// "conn"     each connection of the rule
+// "rule"     all connections of the rule together
+// "client"   all connections of the rule from the same client IP together
+//
+// Each direction is limited apart, so a rate of 1 MiB/s allows 1 MiB/s up and 1 MiB/s down.
+// A connection is held to the lowest of the limits set.
+
+var ErrInvalidRateLimit = errors.New("invalid rate limit")
+
+// RateLimits are the token buckets shaping the forwarded traffic of an action, by scope.
+type RateLimits struct {
+	Conn   *RateLimit `json:"conn,omitempty"`
+	Rule   *RateLimit `json:"rule,omitempty"`
+	Client *RateLimit `json:"client,omitempty"`
+}
+
+// RateLimit is a token bucket of Burst bytes, refilled at Rate bytes per second.
+type RateLimit struct {
+	Rate  int64 `json:"rate"`            // Bytes per second
+	Burst int64 `json:"burst,omitempty"` // Bytes allowed at once, Rate by default
+}
+
+func (a *Action) validateRateLimit() error {
+	if a.RateLimit == nil {
+		return nil
+	}
+	if a.Action != ACTION_FORWARD && a.Action != ACTION_TERMINATE {
+		logger.Errorf("%v: rate_limit is set for %s", ErrInvalidRateLimit, a.Action)
+		return fmt.Errorf("%w: rate_limit is set for %s", ErrInvalidRateLimit, a.Action)
+	}
+	scopes := []string{"conn", "rule", "client"}
+	for i, limit := range []*RateLimit{a.RateLimit.Conn, a.RateLimit.Rule, a.RateLimit.Client} {
+		if limit == nil {
+			continue
+		}
+		if scope := scopes[i]; limit.Rate <= 0 || limit.Burst < 0 {
+			logger.Errorf("%v: %s rate must be positive", ErrInvalidRateLimit, scope)
+			return fmt.Errorf("%w: %s rate must be positive", ErrInvalidRateLimit, scope)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+// Example REJECT Action, holding scanners until they give up:
+// {
+// 		"action": "REJECT",
+// 		"reject_mode": "tarpit",
+// 		"reject_timeout": 600,
+// 		"reject_max_held": 5000
+// }
+
+var ErrInvalidRejectMode = errors.New("invalid reject mode")
+
+// RejectMode is how a REJECT action closes the connection.
+type RejectMode = string
+
+const (
+	REJECT_MODE_CLOSE  RejectMode = ""       // close right away, the default
+	REJECT_MODE_FIN    RejectMode = "fin"    // close gracefully, waiting for the client to close too
+	REJECT_MODE_RST    RejectMode = "rst"    // reset the connection, with SO_LINGER 0
+	REJECT_MODE_DROP   RejectMode = "drop"   // say nothing and discard what the client sends, until it gives up
+	REJECT_MODE_TARPIT RejectMode = "tarpit" // trickle a byte at a time to the client, until it gives up
+)
+
+const (
+	DEFAULT_REJECT_TIMEOUT  = 300  // seconds to hold a dropped or tarpitted connection
+	DEFAULT_REJECT_MAX_HELD = 1000 // connections of a rule dropped or tarpitted at once, others are closed
+)
+
+func (a *Action) validateReject() error {
+	switch a.RejectMode {
+	case REJECT_MODE_CLOSE, REJECT_MODE_FIN, REJECT_MODE_RST, REJECT_MODE_DROP, REJECT_MODE_TARPIT:
+	default:
+		logger.Errorf("%v: %s", ErrInvalidRejectMode, a.RejectMode)
+		return fmt.Errorf("%w: %s", ErrInvalidRejectMode, a.RejectMode)
+	}
+	if a.RejectMode != REJECT_MODE_CLOSE && a.Action != ACTION_REJECT {
+		logger.Errorf("reject_mode is set for %s", a.Action)
+		return fmt.Errorf("reject_mode is set for %s", a.Action)
+	}
+	if a.RejectTimeout < 0 || a.RejectTimeout > 0 && a.RejectMode != REJECT_MODE_DROP && a.RejectMode != REJECT_MODE_TARPIT {
+		logger.Errorf("reject_timeout %d requires reject_mode drop or tarpit", a.RejectTimeout)
+		return fmt.Errorf("%w: reject_timeout %d requires reject_mode drop or tarpit", ErrInvalidRejectMode, a.RejectTimeout)
+	}
+	if a.RejectMaxHeld < 0 || a.RejectMaxHeld > 0 && a.RejectMode != REJECT_MODE_DROP && a.RejectMode != REJECT_MODE_TARPIT {
+		logger.Errorf("reject_max_held %d requires reject_mode drop or tarpit", a.RejectMaxHeld)
+		return fmt.Errorf("%w: reject_max_held %d requires reject_mode drop or tarpit", ErrInvalidRejectMode, a.RejectMaxHeld)
+	}
+	return nil
+}
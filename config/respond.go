@@ -0,0 +1,59 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+// Example RESPOND Action, answering with a static payload before closing:
+// {
+// 		"action": "RESPOND",
+// 		"payload": "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+// }
+//
+// or with the content of a file, read for each connection:
+// {
+// 		"action": "RESPOND",
+// 		"payload_file": "/etc/passthru/maintenance.http"
+// }
+//
+// Example HTTP_REDIRECT Action, for the HTTP protocol only, redirecting
+// "http://example.com/path?q" to "https://example.com/path?q":
+// {
+// 		"action": "HTTP_REDIRECT",
+// 		"redirect_code": 308
+// }
+
+var (
+	ErrInvalidPayload      = errors.New("RESPOND requires exactly one of payload and payload_file")
+	ErrInvalidRedirectCode = errors.New("redirect_code must be 301 or 308")
+)
+
+const (
+	DEFAULT_REDIRECT_CODE = 301
+)
+
+func (a *Action) validateRespond() error {
+	if a.Action == ACTION_RESPOND && (a.Payload == "") == (a.PayloadFile == "") {
+		logger.Errorf("%v", ErrInvalidPayload)
+		return ErrInvalidPayload
+	}
+	if a.Action != ACTION_RESPOND && (a.Payload != "" || a.PayloadFile != "") {
+		logger.Errorf("payload is set for %s", a.Action)
+		return fmt.Errorf("payload is set for %s", a.Action)
+	}
+
+	switch a.RedirectCode {
+	case 0, 301, 308:
+	default:
+		logger.Errorf("%v: %d", ErrInvalidRedirectCode, a.RedirectCode)
+		return fmt.Errorf("%w: %d", ErrInvalidRedirectCode, a.RedirectCode)
+	}
+	if a.Action != ACTION_HTTP_REDIRECT && a.RedirectCode != 0 {
+		logger.Errorf("redirect_code is set for %s", a.Action)
+		return fmt.Errorf("redirect_code is set for %s", a.Action)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package config
+
+// Example SocketOptions:
+// "socket_options": {
+// 		"reuse_port": 4,
+// 		"keepalive": 30,
+// 		"no_delay": true,
+// 		"fast_open": true,
+// 		"backlog": 4096,
+// 		"receive_buffer": 262144,
+// 		"send_buffer": 262144
+// }
+
+// SocketOptions are applied to the listeners of all servers, the connections they accept,
+// and the connections dialed to forward to. A zero value keeps the default of the system.
+type SocketOptions struct {
+	ReusePort     int   `json:"reuse_port,omitempty"`     // Number of listeners with SO_REUSEPORT per TCP address, each with its own accept loop
+	KeepAlive     int   `json:"keepalive,omitempty"`      // TCP keepalive interval in seconds, negative to disable
+	NoDelay       *bool `json:"no_delay,omitempty"`       // TCP_NODELAY, enabled by default
+	FastOpen      bool  `json:"fast_open,omitempty"`      // TCP_FASTOPEN when listening, TCP_FASTOPEN_CONNECT when dialing
+	Backlog       int   `json:"backlog,omitempty"`        // Length of the accept queue
+	ReceiveBuffer int   `json:"receive_buffer,omitempty"` // SO_RCVBUF in bytes
+	SendBuffer    int   `json:"send_buffer,omitempty"`    // SO_SNDBUF in bytes
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+// Example templated Action:
+// {
+// 		"action": "FORWARD",
+// 		"to_addr": "{sni_label0}.internal:8443",
+// 		"allowed_hosts": ["*.internal"]
+// }
+//
+// Placeholders are filled from the attributes the protocol extracted from the connection,
+// e.g. {sni} or {alpn} for TLS. {<attribute>_label<N>} is the N-th dot-separated label
+// of the attribute, counting from 0 on the left.
+
+var (
+	ErrTemplateNotAllowed = errors.New("templated to_addr requires allowed_hosts")
+	ErrHostNotAllowed     = errors.New("host not allowed")
+	ErrMissingAttribute   = errors.New("missing attribute")
+	ErrUnixTemplate       = errors.New("templated to_addr can't be a unix socket")
+)
+
+var placeholderRegexp = regexp.MustCompile(`\{([a-z0-9_]+)\}`)
+var labelRegexp = regexp.MustCompile(`^(.+)_label([0-9]+)$`)
+
+// IsTemplate returns true if ToAddr contains any placeholder.
+func (a *Action) IsTemplate() bool {
+	return placeholderRegexp.MatchString(a.ToAddr)
+}
+
+func (a *Action) validateTemplate() error {
+	if !a.IsTemplate() {
+		return nil
+	}
+	if network, _ := ParseNetAddr(a.ToAddr); network == "unix" {
+		logger.Errorf("to_addr %s: %v", a.ToAddr, ErrUnixTemplate)
+		return fmt.Errorf("to_addr %s: %w", a.ToAddr, ErrUnixTemplate)
+	}
+	if len(a.AllowedHosts) == 0 {
+		logger.Errorf("to_addr %s: %v", a.ToAddr, ErrTemplateNotAllowed)
+		return fmt.Errorf("to_addr %s: %w", a.ToAddr, ErrTemplateNotAllowed)
+	}
+	return nil
+}
+
+// ResolveToAddr fills the placeholders in ToAddr with the attributes of the connection,
+// and checks the resulting host against AllowedHosts.
+func (a *Action) ResolveToAddr(attributes map[string]string) (string, error) {
+	if !a.IsTemplate() {
+		return a.ToAddr, nil
+	}
+	if err := a.validateTemplate(); err != nil {
+		return "", err
+	}
+
+	var errResolve error
+	toAddr := placeholderRegexp.ReplaceAllStringFunc(a.ToAddr, func(placeholder string) string {
+		value, err := resolvePlaceholder(placeholder[1:len(placeholder)-1], attributes)
+		if err != nil && errResolve == nil {
+			errResolve = err
+		}
+		return value
+	})
+	if errResolve != nil {
+		return "", errResolve
+	}
+
+	host, _, err := net.SplitHostPort(toAddr)
+	if err != nil {
+		return "", fmt.Errorf("invalid to_addr %s: %w", toAddr, err)
+	}
+	for _, allowed := range a.AllowedHosts {
+		if matchHost(allowed, host) {
+			return toAddr, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrHostNotAllowed, host)
+}
+
+func resolvePlaceholder(name string, attributes map[string]string) (string, error) {
+	if value, ok := attributes[name]; ok && value != "" {
+		return value, nil
+	}
+
+	if m := labelRegexp.FindStringSubmatch(name); m != nil {
+		value, ok := attributes[m[1]]
+		index, err := strconv.Atoi(m[2])
+		if ok && err == nil {
+			labels := strings.Split(value, ".")
+			if index < len(labels) && labels[index] != "" {
+				return labels[index], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrMissingAttribute, name)
+}
+
+// matchHost matches a host against a pattern, which is either an exact host
+// or "*.example.com" for any subdomain of example.com.
+func matchHost(pattern, host string) bool {
+	pattern, host = strings.ToLower(pattern), strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	}
+	return pattern == host
+}
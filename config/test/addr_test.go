@@ -0,0 +1,60 @@
+package config_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+)
+
+func TestParseNetAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr    string
+		network string
+		address string
+	}{
+		{"127.0.0.1:443", "tcp", "127.0.0.1:443"},
+		{"[::1]:443", "tcp", "[::1]:443"},
+		{"unix:/run/app.sock", "unix", "/run/app.sock"},
+		{"unix:@app", "unix", "@app"},
+	} {
+		network, address := config.ParseNetAddr(tc.addr)
+		if network != tc.network || address != tc.address {
+			t.Errorf("%s: expected (%s, %s), got (%s, %s)", tc.addr, tc.network, tc.address, network, address)
+		}
+	}
+}
+
+func TestValidateUnixTemplate(t *testing.T) {
+	action := config.Action{Action: config.ACTION_FORWARD, ToAddr: "unix:/run/{sni}.sock", AllowedHosts: []string{"*"}}
+	if !errors.Is(action.Validate(), config.ErrUnixTemplate) {
+		t.Errorf("templated unix to_addr should be rejected")
+	}
+}
+
+func TestParseServerAddr(t *testing.T) {
+	listenAddrs, err := config.ParseServerAddr("0.0.0.0:443, tcp6:[::]:443,unix:/run/passthru.sock,fd:https,")
+	if err != nil {
+		t.Fatalf("failed to parse server address: %v", err)
+	}
+
+	expected := []config.ListenAddr{
+		{Network: "tcp", Address: "0.0.0.0:443"},
+		{Network: "tcp6", Address: "[::]:443"},
+		{Network: "unix", Address: "/run/passthru.sock"},
+		{Network: "fd", Address: "https"},
+	}
+	if len(listenAddrs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, listenAddrs)
+	}
+	for i := range expected {
+		if listenAddrs[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], listenAddrs[i])
+		}
+	}
+
+	_, err = config.ParseServerAddr(" , ")
+	if err == nil {
+		t.Errorf("empty server address should be rejected")
+	}
+}
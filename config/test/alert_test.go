@@ -0,0 +1,33 @@
+package config_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+)
+
+func TestRejectTLSAlertAction(t *testing.T) {
+	action := config.Action{}
+	err := json.Unmarshal([]byte(`{"action": "REJECT_TLS_ALERT", "alert": "unrecognized_name"}`), &action)
+	if err != nil {
+		t.Fatalf("failed to unmarshal action: %v", err)
+	}
+	if action.Action != config.ACTION_REJECT_TLS_ALERT || action.Alert != config.ALERT_UNRECOGNIZED_NAME {
+		t.Errorf("unexpected action: %+v", action)
+	}
+	if err := action.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	action.Alert = "bad_certificate"
+	if !errors.Is(action.Validate(), config.ErrInvalidAlert) {
+		t.Errorf("unsupported alert should be rejected")
+	}
+
+	reject := config.Action{Action: config.ACTION_REJECT, Alert: config.ALERT_ACCESS_DENIED}
+	if reject.Validate() == nil {
+		t.Errorf("alert of REJECT should be rejected")
+	}
+}
@@ -0,0 +1,43 @@
+package config_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+)
+
+func TestCapture(t *testing.T) {
+	action := config.Action{}
+	err := json.Unmarshal([]byte(`{
+		"action": "FORWARD",
+		"to_addr": "127.0.0.1:8443",
+		"capture": "/var/lib/passthru/caps/",
+		"capture_max_bytes": 1048576,
+		"capture_max_files": 100
+	}`), &action)
+	if err != nil {
+		t.Fatalf("failed to unmarshal action: %v", err)
+	}
+	if action.Capture != "/var/lib/passthru/caps/" || action.CaptureMaxBytes != 1048576 || action.CaptureMaxFiles != 100 {
+		t.Errorf("unexpected capture: %+v", action)
+	}
+	if err := action.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	action.CaptureMaxFiles = -1
+	if !errors.Is(action.Validate(), config.ErrInvalidCapture) {
+		t.Errorf("negative limit should be rejected")
+	}
+	action.Capture, action.CaptureMaxFiles = "", 0
+	if !errors.Is(action.Validate(), config.ErrInvalidCapture) {
+		t.Errorf("limits without capture should be rejected")
+	}
+
+	respond := config.Action{Action: config.ACTION_RESPOND, Payload: "hello", Capture: "/tmp"}
+	if !errors.Is(respond.Validate(), config.ErrInvalidCapture) {
+		t.Errorf("capture of RESPOND should be rejected")
+	}
+}
@@ -0,0 +1,98 @@
+package config_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+)
+
+func TestClientAuth(t *testing.T) {
+	action := config.Action{}
+	err := json.Unmarshal([]byte(`{
+		"action": "TERMINATE",
+		"certificates": [{"cert": "internal.crt", "key": "internal.key"}],
+		"client_auth": {
+			"ca": "clients-ca.pem",
+			"proxy_protocol": true,
+			"routes": [
+				{"match": "CN alice OR SAN alice@example.com", "action": "FORWARD", "to_addr": "127.0.0.1:8081"},
+				{"match": "ISSUER CN=Partner CA,O=Example AND NOT SPKI 5c0d", "action": "FORWARD", "to_addr": "127.0.0.1:8082"},
+				{"match": "CATCHALL", "action": "REJECT"}
+			]
+		}
+	}`), &action)
+	if err != nil {
+		t.Fatalf("failed to unmarshal action: %v", err)
+	}
+	routes := action.ClientAuth.Routes
+	if len(routes) != 3 || routes[0].Action.Action != config.ACTION_FORWARD || routes[0].ToAddr != "127.0.0.1:8081" || routes[2].Action.Action != config.ACTION_REJECT {
+		t.Fatalf("unexpected routes: %+v", routes)
+	}
+	action.Certificates = []config.Certificate{generateCert(t)}
+	if !errors.Is(action.Validate(), config.ErrInvalidCA) {
+		t.Errorf("missing CA file should be rejected")
+	}
+	action.ClientAuth.CAFile = generateCert(t).CertFile
+	if err := action.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateClientAuth(t *testing.T) {
+	cert := generateCert(t)
+	valid := func() config.Action {
+		return config.Action{
+			Action:       config.ACTION_TERMINATE,
+			Certificates: []config.Certificate{cert},
+			ClientAuth:   &config.ClientAuth{CAFile: cert.CertFile},
+		}
+	}
+
+	for name, route := range map[string]config.ClientRoute{
+		"unknown term":   {Match: "SNI example.com", Action: config.Action{Action: config.ACTION_FORWARD, ToAddr: "127.0.0.1:8081"}},
+		"missing value":  {Match: "CN", Action: config.Action{Action: config.ACTION_FORWARD, ToAddr: "127.0.0.1:8081"}},
+		"spaces in SPKI": {Match: "SPKI 5c 0d", Action: config.Action{Action: config.ACTION_FORWARD, ToAddr: "127.0.0.1:8081"}},
+		"terminate":      {Match: "CN alice", Action: config.Action{Action: config.ACTION_TERMINATE, ToAddr: "127.0.0.1:8081"}},
+	} {
+		action := valid()
+		action.ClientAuth.Routes = []config.ClientRoute{route}
+		if !errors.Is(action.Validate(), config.ErrInvalidClientRoute) {
+			t.Errorf("%s: should be rejected", name)
+		}
+	}
+
+	action := valid()
+	action.ClientAuth.CAFile = ""
+	if !errors.Is(action.Validate(), config.ErrInvalidClientRoute) {
+		t.Errorf("client_auth without a CA should be rejected")
+	}
+
+	action = valid()
+	action.Action = config.ACTION_FORWARD
+	if !errors.Is(action.Validate(), config.ErrInvalidClientRoute) {
+		t.Errorf("client_auth should be rejected for FORWARD")
+	}
+}
+
+func TestParseClientRule(t *testing.T) {
+	for term, want := range map[config.Rule][2]string{
+		"CN alice":                       {"CN", "alice"},
+		"ISSUER CN=Partner CA,O=Example": {"ISSUER", "CN=Partner CA,O=Example"},
+		`CN "R&D (AND Ops)"`:             {"CN", "R&D (AND Ops)"},
+		`SAN "a \"quoted\" name"`:        {"SAN", `a "quoted" name`},
+		"CATCHALL":                       {"CATCHALL", ""},
+	} {
+		ruleType, value, err := config.ParseClientRule(term)
+		if err != nil || ruleType != want[0] || value != want[1] {
+			t.Errorf("%s: expected %v, got %s %q %v", term, want, ruleType, value, err)
+		}
+	}
+
+	for _, term := range []config.Rule{`CN "unterminated`, `CN ""`, `SPKI "5c 0d"`} {
+		if _, _, err := config.ParseClientRule(term); !errors.Is(err, config.ErrInvalidClientRoute) {
+			t.Errorf("%s: should be rejected, got %v", term, err)
+		}
+	}
+}
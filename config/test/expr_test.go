@@ -0,0 +1,74 @@
+package config_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+)
+
+func TestParseRuleExpr(t *testing.T) {
+	for _, tc := range []struct {
+		rule config.Rule
+		tree string
+	}{
+		{"SNI api.example.com AND ALPN h2", "(SNI api.example.com AND ALPN h2)"},
+		{"SNI foo.com AND NOT SRC 10.0.0.0/8", "(SNI foo.com AND NOT SRC 10.0.0.0/8)"},
+		{"SNI a.com OR SNI b.com AND ALPN h2", "(SNI a.com OR (SNI b.com AND ALPN h2))"},
+		{"(SNI a.com OR SNI b.com) AND ALPN h2", "((SNI a.com OR SNI b.com) AND ALPN h2)"},
+		{"NOT NOT (ALPN h2)", "NOT NOT ALPN h2"},
+		{`CN "R&D (AND Ops)" OR CN "a \" OR b"`, `(CN "R&D (AND Ops)" OR CN "a \" OR b")`},
+	} {
+		expr, err := config.ParseRuleExpr(tc.rule)
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", tc.rule, err)
+			continue
+		}
+		if expr.String() != tc.tree {
+			t.Errorf("wrong tree for %q: %s", tc.rule, expr.String())
+		}
+	}
+}
+
+func TestParseRuleExprMalformed(t *testing.T) {
+	for _, rule := range []config.Rule{
+		"",
+		"AND SNI a.com",
+		"SNI a.com AND",
+		"SNI a.com OR OR SNI b.com",
+		"(SNI a.com OR SNI b.com",
+		"SNI a.com)",
+		"SNI a.com NOT ALPN h2",
+		"()",
+	} {
+		_, err := config.ParseRuleExpr(rule)
+		if !errors.Is(err, config.ErrInvalidRuleExpr) {
+			t.Errorf("expected ErrInvalidRuleExpr for %q, got %v", rule, err)
+		}
+	}
+}
+
+func TestEvalRuleExpr(t *testing.T) {
+	expr, err := config.ParseRuleExpr("(SNI a.com OR SNI b.com) AND NOT ALPN h2")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	for _, tc := range []struct {
+		terms  map[config.Rule]bool
+		result bool
+	}{
+		{map[config.Rule]bool{"SNI a.com": true}, true},
+		{map[config.Rule]bool{"SNI b.com": true}, true},
+		{map[config.Rule]bool{"SNI b.com": true, "ALPN h2": true}, false},
+		{map[config.Rule]bool{"ALPN h2": true}, false},
+		{map[config.Rule]bool{}, false},
+	} {
+		result := expr.Eval(func(term config.Rule) bool {
+			return tc.terms[term]
+		})
+		if result != tc.result {
+			t.Errorf("wrong result for %v: %v", tc.terms, result)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package config_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+)
+
+func TestMirror(t *testing.T) {
+	action := config.Action{}
+	err := json.Unmarshal([]byte(`{
+		"action": "FORWARD",
+		"to_addr": "127.0.0.1:8443",
+		"mirror": {"sink": "tcp", "to": "127.0.0.1:9000", "max_bytes": 4096}
+	}`), &action)
+	if err != nil {
+		t.Fatalf("failed to unmarshal action: %v", err)
+	}
+	if action.Mirror == nil || action.Mirror.Sink != config.MIRROR_SINK_TCP || action.Mirror.MaxBytes != 4096 {
+		t.Errorf("unexpected mirror: %+v", action.Mirror)
+	}
+	if err := action.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	action.Mirror.Sink = "syslog"
+	if !errors.Is(action.Validate(), config.ErrInvalidMirror) {
+		t.Errorf("unknown sink should be rejected")
+	}
+	action.Mirror.Sink, action.Mirror.To = config.MIRROR_SINK_PCAP, ""
+	if !errors.Is(action.Validate(), config.ErrInvalidMirror) {
+		t.Errorf("sink without destination should be rejected")
+	}
+
+	reject := config.Action{Action: config.ACTION_REJECT, Mirror: &config.Mirror{Sink: config.MIRROR_SINK_FILE, To: "/tmp"}}
+	if !errors.Is(reject.Validate(), config.ErrInvalidMirror) {
+		t.Errorf("mirror of REJECT should be rejected")
+	}
+}
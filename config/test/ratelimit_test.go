@@ -0,0 +1,44 @@
+package config_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+)
+
+func TestRateLimit(t *testing.T) {
+	action := config.Action{}
+	err := json.Unmarshal([]byte(`{
+		"action": "FORWARD",
+		"to_addr": "127.0.0.1:8443",
+		"rate_limit": {
+			"conn": {"rate": 1048576, "burst": 4194304},
+			"client": {"rate": 2097152}
+		}
+	}`), &action)
+	if err != nil {
+		t.Fatalf("failed to unmarshal action: %v", err)
+	}
+	if action.RateLimit == nil || action.RateLimit.Conn.Burst != 4194304 || action.RateLimit.Client.Rate != 2097152 || action.RateLimit.Rule != nil {
+		t.Errorf("unexpected rate limit: %+v", action.RateLimit)
+	}
+	if err := action.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	action.RateLimit.Rule = &config.RateLimit{Burst: 1024}
+	if !errors.Is(action.Validate(), config.ErrInvalidRateLimit) {
+		t.Errorf("rule limit without rate should be rejected")
+	}
+	action.RateLimit.Rule = &config.RateLimit{Rate: 1024, Burst: -1}
+	if !errors.Is(action.Validate(), config.ErrInvalidRateLimit) {
+		t.Errorf("negative burst should be rejected")
+	}
+
+	reject := config.Action{Action: config.ACTION_REJECT, RateLimit: &config.RateLimits{Conn: &config.RateLimit{Rate: 1024}}}
+	if !errors.Is(reject.Validate(), config.ErrInvalidRateLimit) {
+		t.Errorf("rate limit of REJECT should be rejected")
+	}
+}
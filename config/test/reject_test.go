@@ -0,0 +1,41 @@
+package config_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+)
+
+func TestRejectMode(t *testing.T) {
+	action := config.Action{}
+	err := json.Unmarshal([]byte(`{"action": "REJECT", "reject_mode": "tarpit", "reject_timeout": 600}`), &action)
+	if err != nil {
+		t.Fatalf("failed to unmarshal action: %v", err)
+	}
+	if action.RejectMode != config.REJECT_MODE_TARPIT || action.RejectTimeout != 600 {
+		t.Errorf("unexpected action: %+v", action)
+	}
+	if err := action.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	action.RejectMode = config.REJECT_MODE_RST
+	if !errors.Is(action.Validate(), config.ErrInvalidRejectMode) {
+		t.Errorf("reject_timeout of rst should be rejected")
+	}
+	action.RejectMode, action.RejectTimeout, action.RejectMaxHeld = config.REJECT_MODE_FIN, 0, 10
+	if !errors.Is(action.Validate(), config.ErrInvalidRejectMode) {
+		t.Errorf("reject_max_held of fin should be rejected")
+	}
+	action.RejectMode, action.RejectMaxHeld = "slam", 0
+	if !errors.Is(action.Validate(), config.ErrInvalidRejectMode) {
+		t.Errorf("unknown reject mode should be rejected")
+	}
+
+	forward := config.Action{Action: config.ACTION_FORWARD, ToAddr: "127.0.0.1:80", RejectMode: config.REJECT_MODE_RST}
+	if forward.Validate() == nil {
+		t.Errorf("reject_mode of FORWARD should be rejected")
+	}
+}
@@ -0,0 +1,59 @@
+package config_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+)
+
+func TestRespondAction(t *testing.T) {
+	action := config.Action{}
+	err := json.Unmarshal([]byte(`{"action": "RESPOND", "payload": "HTTP/1.1 503 Service Unavailable\r\n\r\n"}`), &action)
+	if err != nil {
+		t.Fatalf("failed to unmarshal action: %v", err)
+	}
+	if action.Action != config.ACTION_RESPOND || action.Payload == "" {
+		t.Errorf("unexpected action: %+v", action)
+	}
+	if err := action.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	action.PayloadFile = "maintenance.http"
+	if !errors.Is(action.Validate(), config.ErrInvalidPayload) {
+		t.Errorf("both payload and payload_file should be rejected")
+	}
+	action.Payload, action.PayloadFile = "", ""
+	if !errors.Is(action.Validate(), config.ErrInvalidPayload) {
+		t.Errorf("RESPOND without payload should be rejected")
+	}
+
+	forward := config.Action{Action: config.ACTION_FORWARD, ToAddr: "127.0.0.1:80", Payload: "hello"}
+	if forward.Validate() == nil {
+		t.Errorf("payload of FORWARD should be rejected")
+	}
+}
+
+func TestRedirectAction(t *testing.T) {
+	action := config.Action{}
+	err := json.Unmarshal([]byte(`{"action": "HTTP_REDIRECT", "redirect_code": 308}`), &action)
+	if err != nil {
+		t.Fatalf("failed to unmarshal action: %v", err)
+	}
+	if action.Action != config.ACTION_HTTP_REDIRECT || action.RedirectCode != 308 {
+		t.Errorf("unexpected action: %+v", action)
+	}
+	if err := action.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if action.Action.String() != "HTTP_REDIRECT" {
+		t.Errorf("unexpected name: %s", action.Action)
+	}
+
+	action.RedirectCode = 302
+	if !errors.Is(action.Validate(), config.ErrInvalidRedirectCode) {
+		t.Errorf("redirect code 302 should be rejected")
+	}
+}
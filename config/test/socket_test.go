@@ -0,0 +1,28 @@
+package config_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+)
+
+func TestSocketOptions(t *testing.T) {
+	conf := config.Config{}
+	err := json.Unmarshal([]byte(`{
+		"version": "v0.2.0",
+		"servers": {},
+		"socket_options": {"reuse_port": 4, "keepalive": -1, "no_delay": false, "fast_open": true, "backlog": 1024}
+	}`), &conf)
+	if err != nil {
+		t.Fatalf("failed to unmarshal config: %v", err)
+	}
+
+	opts := conf.SocketOptions
+	if opts.ReusePort != 4 || opts.KeepAlive != -1 || opts.NoDelay == nil || *opts.NoDelay || !opts.FastOpen || opts.Backlog != 1024 {
+		t.Errorf("unexpected socket options: %+v", opts)
+	}
+	if opts.ReceiveBuffer != 0 || opts.SendBuffer != 0 {
+		t.Errorf("unset options should be zero: %+v", opts)
+	}
+}
@@ -0,0 +1,51 @@
+package config_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+)
+
+func TestResolveToAddr(t *testing.T) {
+	attributes := map[string]string{
+		"sni":  "api.example.com",
+		"alpn": "h2",
+	}
+
+	for _, tc := range []struct {
+		action config.Action
+		toAddr string
+		err    error
+	}{
+		{config.Action{ToAddr: "127.0.0.1:443"}, "127.0.0.1:443", nil},
+		{config.Action{ToAddr: "{sni}:443", AllowedHosts: []string{"*.example.com"}}, "api.example.com:443", nil},
+		{config.Action{ToAddr: "{sni_label0}.internal:8443", AllowedHosts: []string{"*.internal"}}, "api.internal:8443", nil},
+		{config.Action{ToAddr: "{alpn}-backend:443", AllowedHosts: []string{"h2-backend", "http11-backend"}}, "h2-backend:443", nil},
+		{config.Action{ToAddr: "{sni}:443"}, "", config.ErrTemplateNotAllowed},
+		{config.Action{ToAddr: "{sni}:443", AllowedHosts: []string{"*.internal"}}, "", config.ErrHostNotAllowed},
+		{config.Action{ToAddr: "{sni}:443", AllowedHosts: []string{"*.api.example.com"}}, "", config.ErrHostNotAllowed},
+		{config.Action{ToAddr: "{sni_label5}.internal:443", AllowedHosts: []string{"*.internal"}}, "", config.ErrMissingAttribute},
+		{config.Action{ToAddr: "{ja3}:443", AllowedHosts: []string{"*"}}, "", config.ErrMissingAttribute},
+	} {
+		toAddr, err := tc.action.ResolveToAddr(attributes)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.action.ToAddr, tc.err, err)
+		}
+		if toAddr != tc.toAddr {
+			t.Errorf("%s: expected %s, got %s", tc.action.ToAddr, tc.toAddr, toAddr)
+		}
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	action := config.Action{Action: config.ACTION_FORWARD, ToAddr: "{sni}:443"}
+	if !errors.Is(action.Validate(), config.ErrTemplateNotAllowed) {
+		t.Errorf("templated to_addr without allowed_hosts should be rejected")
+	}
+
+	action.AllowedHosts = []string{"*.internal"}
+	if err := action.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
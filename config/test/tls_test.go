@@ -0,0 +1,124 @@
+package config_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+)
+
+// generateCert writes a self-signed certificate and its key to a temporary directory.
+func generateCert(t *testing.T) config.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "internal"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	cert := config.Certificate{CertFile: filepath.Join(dir, "internal.crt"), KeyFile: filepath.Join(dir, "internal.key")}
+	os.WriteFile(cert.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(cert.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return cert
+}
+
+func TestTerminateAction(t *testing.T) {
+	action := config.Action{}
+	err := json.Unmarshal([]byte(`{
+		"action": "TERMINATE",
+		"to_addr": "127.0.0.1:8080",
+		"certificates": [{"cert": "internal.crt", "key": "internal.key"}],
+		"upstream_tls": {"server_name": "backend.internal"}
+	}`), &action)
+	if err != nil {
+		t.Fatalf("failed to unmarshal action: %v", err)
+	}
+	if action.Action != config.ACTION_TERMINATE || len(action.Certificates) != 1 || action.UpstreamTLS.ServerName != "backend.internal" {
+		t.Errorf("unexpected action: %+v", action)
+	}
+	if !errors.Is(action.Validate(), config.ErrInvalidCertificate) {
+		t.Errorf("missing certificate files should be rejected")
+	}
+	cert := generateCert(t)
+	action.Certificates[0] = cert
+	if err := action.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	action.Certificates[0].KeyFile = cert.CertFile
+	if !errors.Is(action.Validate(), config.ErrInvalidCertificate) {
+		t.Errorf("certificate without a valid key should be rejected")
+	}
+	action.Certificates[0].KeyFile = ""
+	if !errors.Is(action.Validate(), config.ErrNoCertificate) {
+		t.Errorf("certificate without key should be rejected")
+	}
+	action.Certificates = nil
+	if !errors.Is(action.Validate(), config.ErrNoCertificate) {
+		t.Errorf("TERMINATE without certificates should be rejected")
+	}
+}
+
+func TestValidateUpstreamTLS(t *testing.T) {
+	action := config.Action{
+		Action:      config.ACTION_FORWARD,
+		ToAddr:      "backend.internal:443",
+		UpstreamTLS: &config.UpstreamTLS{CAFile: "ca.pem", Verify: config.VERIFY_CA_ONLY},
+	}
+	if !errors.Is(action.Validate(), config.ErrInvalidCA) {
+		t.Errorf("missing CA file should be rejected")
+	}
+	ca := generateCert(t)
+	action.UpstreamTLS.CAFile = ca.KeyFile
+	if !errors.Is(action.Validate(), config.ErrInvalidCA) {
+		t.Errorf("CA file without a certificate should be rejected")
+	}
+	action.UpstreamTLS.CAFile = ca.CertFile
+	if err := action.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	action.UpstreamTLS.Verify = "sometimes"
+	if !errors.Is(action.Validate(), config.ErrInvalidVerifyMode) {
+		t.Errorf("invalid verify mode should be rejected")
+	}
+
+	action.UpstreamTLS.Verify = ""
+	action.UpstreamTLS.ClientCertificate = &config.Certificate{CertFile: "proxy.crt"}
+	if action.Validate() == nil {
+		t.Errorf("client certificate without key should be rejected")
+	}
+	action.UpstreamTLS.ClientCertificate.KeyFile = "proxy.key"
+	if !errors.Is(action.Validate(), config.ErrInvalidCertificate) {
+		t.Errorf("missing client certificate files should be rejected")
+	}
+	cert := generateCert(t)
+	action.UpstreamTLS.ClientCertificate = &cert
+	if err := action.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
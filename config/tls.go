@@ -0,0 +1,131 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+// Example TERMINATE Action:
+// {
+// 		"action": "TERMINATE",
+// 		"to_addr": "127.0.0.1:8080",
+// 		"certificates": [
+// 			{"cert": "/etc/passthru/internal.crt", "key": "/etc/passthru/internal.key"},
+// 			{"cert": "/etc/passthru/wildcard.crt", "key": "/etc/passthru/wildcard.key"}
+// 		],
+// 		"upstream_tls": {"server_name": "backend.internal"}
+// }
+//
+// The certificate is selected by the SNI of the client among the certificates of the rule.
+// Without upstream_tls, the decrypted stream is forwarded to ToAddr in plaintext.
+//
+// Example upstream_tls to an internal PKI with a client certificate:
+// "upstream_tls": {
+// 		"server_name": "backend.internal",
+// 		"ca": "/etc/passthru/internal-ca.pem",
+// 		"client_certificate": {"cert": "/etc/passthru/proxy.crt", "key": "/etc/passthru/proxy.key"},
+// 		"verify": "full"
+// }
+
+var (
+	ErrNoCertificate      = errors.New("TERMINATE requires certificates")
+	ErrInvalidVerifyMode  = errors.New("invalid verify mode")
+	ErrInvalidCertificate = errors.New("invalid certificate")
+	ErrInvalidCA          = errors.New("invalid CA bundle")
+)
+
+// VerifyMode is how the certificate of the upstream is verified.
+type VerifyMode = string
+
+const (
+	VERIFY_FULL    VerifyMode = "full"    // the chain and the server name, the default
+	VERIFY_CA_ONLY VerifyMode = "ca_only" // the chain only, for certificates not issued to the server name
+	VERIFY_NONE    VerifyMode = "none"    // nothing, insecure
+)
+
+// Certificate is a certificate chain and its private key, both PEM encoded files.
+type Certificate struct {
+	CertFile string `json:"cert"`
+	KeyFile  string `json:"key"`
+}
+
+// UpstreamTLS configures the TLS connection to ToAddr of a FORWARD or TERMINATE action.
+type UpstreamTLS struct {
+	ServerName        string       `json:"server_name,omitempty"`        // SNI and the name to verify, the host of ToAddr by default
+	CAFile            string       `json:"ca,omitempty"`                 // PEM bundle of the CAs to trust instead of the system ones
+	ClientCertificate *Certificate `json:"client_certificate,omitempty"` // Presented to the upstream if requested
+	Verify            VerifyMode   `json:"verify,omitempty"`             // "full" by default, "ca_only" or "none"
+}
+
+func (a *Action) validateTLS() error {
+	if u := a.UpstreamTLS; u != nil {
+		switch u.Verify {
+		case "", VERIFY_FULL, VERIFY_CA_ONLY, VERIFY_NONE:
+		default:
+			logger.Errorf("to_addr %s: %v: %s", a.ToAddr, ErrInvalidVerifyMode, u.Verify)
+			return fmt.Errorf("to_addr %s: %w: %s", a.ToAddr, ErrInvalidVerifyMode, u.Verify)
+		}
+		if u.CAFile != "" {
+			if err := loadCAFile(u.CAFile); err != nil {
+				logger.Errorf("to_addr %s: %v", a.ToAddr, err)
+				return fmt.Errorf("to_addr %s: %w", a.ToAddr, err)
+			}
+		}
+		if c := u.ClientCertificate; c != nil && (c.CertFile == "" || c.KeyFile == "") {
+			logger.Errorf("to_addr %s: client certificate requires both cert and key", a.ToAddr)
+			return fmt.Errorf("to_addr %s: client certificate requires both cert and key", a.ToAddr)
+		}
+		if c := u.ClientCertificate; c != nil {
+			if err := c.load(); err != nil {
+				logger.Errorf("to_addr %s: %v", a.ToAddr, err)
+				return fmt.Errorf("to_addr %s: %w", a.ToAddr, err)
+			}
+		}
+	}
+
+	if a.Action != ACTION_TERMINATE {
+		return nil
+	}
+	if len(a.Certificates) == 0 {
+		logger.Errorf("to_addr %s: %v", a.ToAddr, ErrNoCertificate)
+		return fmt.Errorf("to_addr %s: %w", a.ToAddr, ErrNoCertificate)
+	}
+	for _, cert := range a.Certificates {
+		if cert.CertFile == "" || cert.KeyFile == "" {
+			logger.Errorf("to_addr %s: %v", a.ToAddr, ErrNoCertificate)
+			return fmt.Errorf("to_addr %s: %w: both cert and key are required", a.ToAddr, ErrNoCertificate)
+		}
+		if err := cert.load(); err != nil {
+			logger.Errorf("to_addr %s: %v", a.ToAddr, err)
+			return fmt.Errorf("to_addr %s: %w", a.ToAddr, err)
+		}
+	}
+	return nil
+}
+
+// load checks that the files can be read and the key matches the certificate, so that a broken
+// certificate fails the config when loaded instead of the first connection using it.
+func (c Certificate) load() error {
+	if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+		return fmt.Errorf("%w %s: %v", ErrInvalidCertificate, c.CertFile, err)
+	}
+	return nil
+}
+
+// loadCAFile checks that the PEM bundle can be read and has at least one certificate,
+// like load does for a certificate and its key.
+func loadCAFile(filename string) error {
+	pem, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("%w %s: %v", ErrInvalidCA, filename, err)
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+		return fmt.Errorf("%w %s: no certificate found", ErrInvalidCA, filename)
+	}
+	return nil
+}
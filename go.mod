@@ -1,5 +1,14 @@
 module github.com/gaukas/passthru
 
-go 1.16
+go 1.18
 
-require github.com/refraction-networking/utls v1.1.5
+require (
+	github.com/refraction-networking/utls v1.1.5
+	golang.org/x/sys v0.0.0-20220728004956-3c1f35247d10
+)
+
+require (
+	github.com/andybalholm/brotli v1.0.4 // indirect
+	github.com/klauspost/compress v1.15.9 // indirect
+	golang.org/x/crypto v0.0.0-20220829220503-c86fa9a7ed90 // indirect
+)
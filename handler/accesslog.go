@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+)
+
+// Example access log line, with the attributes of the connection:
+// 2026-10-19T12:00:00Z remote=192.0.2.1:51234 local=10.0.0.1:443 action=TERMINATE to=127.0.0.1:8081 client_cn=alice sni=internal.example.com
+
+// SetAccessLog makes the server write a line for each connection it takes an action on.
+// It must be called before Start.
+func (s *Server) SetAccessLog(w io.Writer) {
+	s.accessLog = w
+}
+
+func (s *Server) logAccess(conn net.Conn, action config.ActionType, toAddr string, attributes map[string]string) {
+	if s.accessLog == nil {
+		return
+	}
+
+	var line strings.Builder
+	fmt.Fprintf(&line, "%s remote=%s local=%s action=%s", time.Now().UTC().Format(time.RFC3339), conn.RemoteAddr(), conn.LocalAddr(), action)
+	if toAddr != "" {
+		fmt.Fprintf(&line, " to=%s", quoteValue(toAddr)) // may be made of attributes by a template
+	}
+
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&line, " %s=%s", key, quoteValue(attributes[key]))
+	}
+	line.WriteString("\n")
+
+	s.accessLogMu.Lock()
+	defer s.accessLogMu.Unlock()
+	io.WriteString(s.accessLog, line.String())
+}
+
+// quoteValue quotes a value if it can't be told apart from the next key otherwise,
+// or if it has anything to escape, like a control character in a client certificate.
+func quoteValue(value string) string {
+	quoted := strconv.Quote(value)
+	if value == "" || strings.ContainsAny(value, " =") || quoted[1:len(quoted)-1] != value {
+		return quoted
+	}
+	return value
+}
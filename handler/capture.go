@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/internal/logger"
+	"github.com/gaukas/passthru/internal/pcap"
+)
+
+// openCapture creates the pcapng file of the connection in the capture directory of the action,
+// unless the directory already has as many capture files as allowed.
+func (s *Server) openCapture(action config.Action, conn net.Conn, attributes map[string]string) (mirrorSink, error) {
+	maxFiles := action.CaptureMaxFiles
+	if maxFiles == 0 {
+		maxFiles = config.DEFAULT_CAPTURE_MAX_FILES
+	}
+	if !s.reserveCapture(action.Capture, maxFiles) {
+		return nil, fmt.Errorf("%d capture files in %s already", maxFiles, action.Capture)
+	}
+	defer s.releaseCapture(action.Capture) // counted on disk from now on
+
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s.pcapng", now.UTC().Format("20060102T150405.000000000"), fileSafe(conn.RemoteAddr().String()))
+	f, err := os.OpenFile(filepath.Join(action.Capture, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w, err := pcap.NewWriter(f, captureComment(conn, attributes))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	stream, err := w.NewStream(conn.RemoteAddr(), conn.LocalAddr(), now)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	maxBytes := action.CaptureMaxBytes
+	if maxBytes == 0 {
+		maxBytes = config.DEFAULT_CAPTURE_MAX_BYTES
+	}
+	return &captureSink{pcapSink: pcapSink{stream}, file: f, writer: w, maxBytes: maxBytes}, nil
+}
+
+// reserveCapture reserves a new file in the directory if there is room for it, counting the
+// files in the directory and the ones being created. releaseCapture must be called once the
+// file is created, or failed to be, so the count follows files removed by the operator too.
+func (s *Server) reserveCapture(dir string, maxFiles int) bool {
+	s.capturesMu.Lock()
+	defer s.capturesMu.Unlock()
+	existing, _ := filepath.Glob(filepath.Join(dir, "*.pcapng"))
+	if len(existing)+s.captures[dir] >= maxFiles {
+		return false
+	}
+	if s.captures == nil {
+		s.captures = make(map[string]int)
+	}
+	s.captures[dir]++
+	return true
+}
+
+func (s *Server) releaseCapture(dir string) {
+	s.capturesMu.Lock()
+	defer s.capturesMu.Unlock()
+	s.captures[dir]--
+	if s.captures[dir] <= 0 {
+		delete(s.captures, dir)
+	}
+}
+
+// captureComment describes the connection, with the protocol and the rule it matched.
+func captureComment(conn net.Conn, attributes map[string]string) string {
+	var comment strings.Builder
+	fmt.Fprintf(&comment, "passthru capture of %s on %s", conn.RemoteAddr(), conn.LocalAddr())
+	fmt.Fprintf(&comment, "\nprotocol: %s\nrule: %s", attributes["protocol"], attributes["rule"])
+
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		if key != "protocol" && key != "rule" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&comment, "\n%s: %s", key, attributes[key])
+	}
+	return comment.String()
+}
+
+// captureSink is the TCP stream of a single connection in its own file, which stops growing at maxBytes.
+type captureSink struct {
+	pcapSink
+	file      *os.File
+	writer    *pcap.Writer
+	maxBytes  int64
+	truncated bool
+}
+
+// packetOverhead is about the size of the headers of a packet in a pcapng file.
+const packetOverhead = 128
+
+func (c *captureSink) write(dir pcap.Direction, data []byte, t time.Time) error {
+	if c.truncated {
+		return nil
+	}
+	segments := int64(len(data)/pcap.MaxSegmentSize + 1)
+	if c.writer.Written()+int64(len(data))+segments*packetOverhead > c.maxBytes {
+		logger.Infof("Capture %s reached %d bytes, truncated", c.file.Name(), c.maxBytes)
+		c.truncated = true
+		return nil
+	}
+	return c.pcapSink.write(dir, data, t)
+}
+
+func (c *captureSink) close(t time.Time) error {
+	if !c.truncated {
+		c.pcapSink.close(t)
+	}
+	return c.file.Close()
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/internal/logger"
+	"github.com/gaukas/passthru/internal/proxyproto"
+)
+
+// clientIdentity returns the attributes of a verified client certificate, which can be used
+// in templates and are written to the access log.
+func clientIdentity(cert *x509.Certificate) map[string]string {
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return map[string]string{
+		"client_cn":     cert.Subject.CommonName,
+		"client_san":    strings.Join(subjectAltNames(cert), ","),
+		"client_issuer": cert.Issuer.String(),
+		"client_spki":   hex.EncodeToString(spki[:]),
+	}
+}
+
+func subjectAltNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// selectClientRoute returns the first route matching the certificate, or nil if none matches.
+func (s *Server) selectClientRoute(routes []config.ClientRoute, cert *x509.Certificate) *config.ClientRoute {
+	for i, route := range routes {
+		expr, err := s.routeExpr(route.Match)
+		if err != nil {
+			continue // rejected when the config is imported
+		}
+		if expr.Eval(func(term config.Rule) bool { return matchClientRule(term, cert) }) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// routeExpr returns the parsed match of a client route, which is parsed once for all handshakes.
+func (s *Server) routeExpr(match config.Rule) (*config.RuleExpr, error) {
+	if expr, ok := s.routeExprs.Load(match); ok {
+		return expr.(*config.RuleExpr), nil
+	}
+	expr, err := config.ParseRuleExpr(match)
+	if err != nil {
+		return nil, err
+	}
+	s.routeExprs.Store(match, expr)
+	return expr, nil
+}
+
+func matchClientRule(term config.Rule, cert *x509.Certificate) bool {
+	ruleType, value, err := config.ParseClientRule(term)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return false
+	}
+
+	switch ruleType {
+	case config.CLIENT_RULE_CATCHALL:
+		return true
+	case config.CLIENT_RULE_CN:
+		return cert.Subject.CommonName == value
+	case config.CLIENT_RULE_SAN:
+		for _, name := range subjectAltNames(cert) {
+			if strings.EqualFold(name, value) {
+				return true
+			}
+		}
+		return false
+	case config.CLIENT_RULE_ISSUER:
+		return cert.Issuer.CommonName == value || cert.Issuer.String() == value
+	case config.CLIENT_RULE_SPKI:
+		spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		return strings.EqualFold(hex.EncodeToString(spki[:]), value) || base64.StdEncoding.EncodeToString(spki[:]) == value
+	default:
+		return false
+	}
+}
+
+// proxyHeader builds a PROXY v2 header carrying the TLS parameters and the verified identity
+// of the client.
+func proxyHeader(conn net.Conn, state tls.ConnectionState, identity map[string]string) []byte {
+	sslTLVs := []proxyproto.TLV{
+		{Type: proxyproto.SubtypeSSLVersion, Value: []byte(tlsVersionName(state.Version))},
+		{Type: proxyproto.SubtypeSSLCipher, Value: []byte(tls.CipherSuiteName(state.CipherSuite))},
+	}
+	client := proxyproto.ClientSSL
+	if identity != nil {
+		client |= proxyproto.ClientCertConn | proxyproto.ClientCertSess
+		sslTLVs = append(sslTLVs, proxyproto.TLV{Type: proxyproto.SubtypeSSLCN, Value: []byte(identity["client_cn"])})
+	}
+
+	tlvs := []proxyproto.TLV{}
+	if state.ServerName != "" {
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.TypeAuthority, Value: []byte(state.ServerName)})
+	}
+	if state.NegotiatedProtocol != "" {
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.TypeALPN, Value: []byte(state.NegotiatedProtocol)})
+	}
+	tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.TypeSSL, Value: proxyproto.SSLValue(client, true, sslTLVs)})
+	if identity != nil {
+		tlvs = append(tlvs,
+			proxyproto.TLV{Type: proxyproto.TypeClientSAN, Value: []byte(identity["client_san"])},
+			proxyproto.TLV{Type: proxyproto.TypeClientIssuer, Value: []byte(identity["client_issuer"])},
+			proxyproto.TLV{Type: proxyproto.TypeClientSPKI, Value: []byte(identity["client_spki"])},
+		)
+	}
+
+	header := &proxyproto.Header{Source: conn.RemoteAddr(), Destination: conn.LocalAddr(), TLVs: tlvs}
+	return header.Marshal()
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS10:
+		return "TLSv1"
+	default:
+		return "unknown"
+	}
+}
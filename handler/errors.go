@@ -3,6 +3,13 @@ package handler
 import "errors"
 
 var (
-	ErrServerStopped = errors.New("server stopped")
-	ErrUnknownAction = errors.New("unknown action")
+	ErrServerStopped       = errors.New("server stopped")
+	ErrUnknownAction       = errors.New("unknown action")
+	ErrNoInheritedListener = errors.New("no inherited listener")
+
+	ErrUnsupportedSocketOption = errors.New("socket option not supported on this platform")
+
+	ErrProxyAuth    = errors.New("proxy authentication failed")
+	ErrProxyRefused = errors.New("proxy refused to connect")
+	ErrProxyFailure = errors.New("proxy protocol error")
 )
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+// listen opens a listener on the address with the socket options. For a unix socket,
+// a stale socket file left over by a previous run is removed first.
+func listen(listenAddr config.ListenAddr, opts *config.SocketOptions) (net.Listener, error) {
+	if listenAddr.Network == "unix" && !strings.HasPrefix(listenAddr.Address, "@") {
+		removeStaleSocket(listenAddr.Address)
+	}
+	listener, err := listenConfig(opts).Listen(context.Background(), listenAddr.Network, listenAddr.Address)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Backlog > 0 {
+		if err := setBacklog(listener, opts.Backlog); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// listenGroup returns the listeners for the address: the inherited ones if any, plus more
+// with SO_REUSEPORT up to the number in the socket options, all on the same port.
+// More listeners can only join inherited ones which have SO_REUSEPORT too.
+func listenGroup(listenAddr config.ListenAddr, inherited []net.Listener, opts *config.SocketOptions) ([]net.Listener, error) {
+	n := 1
+	if opts.ReusePort > 1 && strings.HasPrefix(listenAddr.Network, "tcp") {
+		n = opts.ReusePort
+	}
+
+	listeners := append([]net.Listener{}, inherited...)
+	if len(inherited) == 0 && listenAddr.Network == "fd" {
+		return nil, ErrNoInheritedListener
+	}
+	if len(inherited) > 0 && len(inherited) < n && !hasReusePort(inherited[0]) {
+		logger.Errorf("Inherited listener on %s has no SO_REUSEPORT, not opening %d more listeners for reuse_port", inherited[0].Addr(), n-len(inherited))
+		n = len(inherited)
+	}
+
+	for len(listeners) < n {
+		if len(listeners) > 0 { // e.g. the port is chosen by the system for "127.0.0.1:0"
+			listenAddr.Address = listeners[0].Addr().String()
+		}
+		listener, err := listen(listenAddr, opts)
+		if err != nil {
+			for _, l := range listeners[len(inherited):] {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+func removeStaleSocket(path string) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	// only remove it if nobody is listening on it anymore
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	logger.Warnf("Removing stale unix socket %s", path)
+	os.Remove(path)
+}
@@ -0,0 +1,310 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/internal/logger"
+	"github.com/gaukas/passthru/internal/pcap"
+)
+
+const (
+	// MIRROR_QUEUE_CHUNKS bounds the number of writes waiting for a slow sink, in addition to their size.
+	MIRROR_QUEUE_CHUNKS = 1024
+)
+
+// mirror copies what is relayed in both directions of a connection to a sink, asynchronously.
+// Whatever doesn't fit in the queue is dropped, so the connection never waits for the sink.
+type mirror struct {
+	queueSize int
+	chunks    chan mirrorChunk
+
+	mu        sync.Mutex
+	queued    int      // bytes in chunks
+	remaining [2]int64 // bytes left to mirror of each direction, negative for all
+	gap       [2]int64 // bytes dropped of each direction since the last chunk queued
+	dropped   int64
+	closed    bool
+}
+
+type mirrorChunk struct {
+	dir     pcap.Direction
+	data    []byte
+	time    time.Time
+	dropped int64 // bytes of the direction dropped before the chunk
+}
+
+// mirrorSink is opened by the mirror in the background, as it may be slow.
+type mirrorSink interface {
+	write(dir pcap.Direction, data []byte, t time.Time) error
+	skip(dir pcap.Direction, n int64) // n bytes dropped from the direction
+	close(t time.Time) error
+}
+
+// tee wraps the destination to copy both directions to the mirror and the capture of the action,
+// if any, and returns the function to stop copying once the connection is done.
+func (s *Server) tee(action config.Action, conn net.Conn, attributes map[string]string, connDst net.Conn) (io.Writer, io.Reader, func()) {
+	var downstream io.Writer = connDst
+	var upstream io.Reader = connDst
+	mirrors := []*mirror{}
+	if mc := action.Mirror; mc != nil {
+		mirrors = append(mirrors, startMirror(conn, fmt.Sprintf("%s %s", mc.Sink, mc.To), mc.MaxBytes, mc.QueueSize, func() (mirrorSink, error) {
+			return s.openMirrorSink(mc, conn)
+		}))
+	}
+	if action.Capture != "" {
+		mirrors = append(mirrors, startMirror(conn, "capture "+action.Capture, 0, 0, func() (mirrorSink, error) {
+			return s.openCapture(action, conn, attributes)
+		}))
+	}
+	for _, m := range mirrors {
+		downstream = &mirrorWriter{Writer: downstream, m: m, dir: pcap.ClientToServer}
+		upstream = &mirrorReader{Reader: upstream, m: m, dir: pcap.ServerToClient}
+	}
+
+	return downstream, upstream, func() {
+		for _, m := range mirrors {
+			m.close()
+		}
+	}
+}
+
+// startMirror starts mirroring the connection with the client to the sink opened by open,
+// up to maxBytes of each direction if positive.
+func startMirror(conn net.Conn, name string, maxBytes int64, queueSize int, open func() (mirrorSink, error)) *mirror {
+	m := &mirror{
+		queueSize: queueSize,
+		chunks:    make(chan mirrorChunk, MIRROR_QUEUE_CHUNKS),
+		remaining: [2]int64{-1, -1},
+	}
+	if m.queueSize == 0 {
+		m.queueSize = config.DEFAULT_MIRROR_QUEUE_SIZE
+	}
+	if maxBytes > 0 {
+		m.remaining = [2]int64{maxBytes, maxBytes}
+	}
+
+	go func() {
+		sink, err := open()
+		if err != nil {
+			logger.Warnf("Failed to open the mirror %s for %s: %v", name, conn.RemoteAddr(), err)
+		}
+		for chunk := range m.chunks {
+			m.mu.Lock()
+			m.queued -= len(chunk.data)
+			m.mu.Unlock()
+			if sink == nil {
+				continue // drain
+			}
+			if chunk.dropped > 0 {
+				sink.skip(chunk.dir, chunk.dropped)
+			}
+			if err := sink.write(chunk.dir, chunk.data, chunk.time); err != nil {
+				logger.Warnf("Failed to write to the mirror %s for %s: %v", name, conn.RemoteAddr(), err)
+				sink.close(time.Now())
+				sink = nil
+			}
+		}
+		if sink != nil {
+			m.mu.Lock()
+			gap := m.gap
+			m.mu.Unlock()
+			for dir, n := range gap {
+				if n > 0 {
+					sink.skip(pcap.Direction(dir), n)
+				}
+			}
+			sink.close(time.Now())
+		}
+		if m.dropped > 0 {
+			logger.Warnf("Dropped %d bytes mirroring %s to %s", m.dropped, conn.RemoteAddr(), name)
+		}
+	}()
+	return m
+}
+
+// write queues a copy of data sent in the direction, unless the queue is full.
+func (m *mirror) write(dir pcap.Direction, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed || m.remaining[dir] == 0 || len(data) == 0 {
+		return
+	}
+	if m.remaining[dir] > 0 && int64(len(data)) > m.remaining[dir] {
+		data = data[:m.remaining[dir]]
+	}
+
+	if m.queued+len(data) > m.queueSize {
+		m.drop(dir, len(data))
+		return
+	}
+	select {
+	case m.chunks <- mirrorChunk{dir, append([]byte(nil), data...), time.Now(), m.gap[dir]}:
+		m.queued += len(data)
+		m.gap[dir] = 0
+		if m.remaining[dir] > 0 {
+			m.remaining[dir] -= int64(len(data))
+		}
+	default:
+		m.drop(dir, len(data))
+	}
+}
+
+// drop counts n bytes of the direction not mirrored, must be called with mu held.
+func (m *mirror) drop(dir pcap.Direction, n int) {
+	m.dropped += int64(n)
+	m.gap[dir] += int64(n)
+}
+
+// close lets the sink finish with what is queued, without waiting for it.
+func (m *mirror) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.chunks)
+	}
+}
+
+// mirrorWriter mirrors what is written to the destination.
+type mirrorWriter struct {
+	io.Writer
+	m   *mirror
+	dir pcap.Direction
+}
+
+func (w *mirrorWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.m.write(w.dir, p[:n])
+	return n, err
+}
+
+// Close closes the destination like the ConnBuf does with its downstream.
+func (w *mirrorWriter) Close() error {
+	if closer, ok := w.Writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// mirrorReader mirrors what is read from the destination.
+type mirrorReader struct {
+	io.Reader
+	m   *mirror
+	dir pcap.Direction
+}
+
+func (r *mirrorReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.m.write(r.dir, p[:n])
+	return n, err
+}
+
+func (s *Server) openMirrorSink(mc *config.Mirror, conn net.Conn) (mirrorSink, error) {
+	switch mc.Sink {
+	case config.MIRROR_SINK_TCP:
+		network, address := config.ParseNetAddr(mc.To)
+		c, err := net.DialTimeout(network, address, DEFAULT_TIMEOUT)
+		if err != nil {
+			return nil, err
+		}
+		return &rawSink{c}, nil
+	case config.MIRROR_SINK_FILE:
+		name := fmt.Sprintf("%s-%s.bin", time.Now().UTC().Format("20060102T150405.000000000"), fileSafe(conn.RemoteAddr().String()))
+		f, err := os.OpenFile(filepath.Join(mc.To, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return &rawSink{f}, nil
+	case config.MIRROR_SINK_PCAP:
+		w, err := s.pcapWriter(mc.To)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := w.NewStream(conn.RemoteAddr(), conn.LocalAddr(), time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return &pcapSink{stream}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown sink %q", config.ErrInvalidMirror, mc.Sink)
+	}
+}
+
+// pcapWriter returns the writer of the pcapng file shared by all connections mirrored to it,
+// which stays open as long as the process. Each time the file is opened, a new section is appended.
+func (s *Server) pcapWriter(path string) (*pcap.Writer, error) {
+	s.pcapWritersMu.Lock()
+	defer s.pcapWritersMu.Unlock()
+	if w, ok := s.pcapWriters[path]; ok {
+		return w, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w, err := pcap.NewWriter(f, fmt.Sprintf("passthru mirror of %s", s.serverAddr))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if s.pcapWriters == nil {
+		s.pcapWriters = make(map[string]*pcap.Writer)
+	}
+	s.pcapWriters[path] = w
+	return w, nil
+}
+
+// rawSink gets both directions as they come.
+type rawSink struct {
+	io.WriteCloser
+}
+
+func (r *rawSink) write(dir pcap.Direction, data []byte, t time.Time) error {
+	_, err := r.Write(data)
+	return err
+}
+
+// skip does nothing, as the raw bytes can't tell a gap.
+func (r *rawSink) skip(dir pcap.Direction, n int64) {
+}
+
+func (r *rawSink) close(t time.Time) error {
+	return r.Close()
+}
+
+// pcapSink gets each direction apart in a TCP stream.
+type pcapSink struct {
+	stream *pcap.Stream
+}
+
+func (p *pcapSink) write(dir pcap.Direction, data []byte, t time.Time) error {
+	return p.stream.Write(dir, data, t)
+}
+
+func (p *pcapSink) skip(dir pcap.Direction, n int64) {
+	p.stream.Skip(dir, n)
+}
+
+func (p *pcapSink) close(t time.Time) error {
+	p.stream.Close(pcap.ClientToServer, t)
+	return p.stream.Close(pcap.ServerToClient, t)
+}
+
+// fileSafe replaces the characters not welcome in a file name, like the colons of an address.
+func fileSafe(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+)
+
+// Dialer dials the destination of a FORWARD action. It is satisfied by *net.Dialer,
+// and may be replaced, e.g. with an in-memory one in tests.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+const maxConnectResponseLen = 8192
+
+// viaDialer returns a Dialer dialing through the proxy, which is dialed with forward.
+func viaDialer(via string, forward Dialer) (Dialer, error) {
+	u, err := config.ParseVia(via)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyDialer{proxy: u, forward: forward}, nil
+}
+
+type proxyDialer struct {
+	proxy   *url.URL
+	forward Dialer
+}
+
+func (d *proxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake with the proxy is bounded by the context as well
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	switch d.proxy.Scheme {
+	case config.PROXY_SOCKS5:
+		err = socks5Connect(conn, address, d.proxy.User)
+	case config.PROXY_HTTP:
+		err = httpConnect(conn, address, d.proxy.User)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connecting to %s via %s: %w", address, d.proxy.Redacted(), err)
+	}
+	return conn, nil
+}
+
+// socks5Connect performs a SOCKS5 CONNECT (RFC 1928), with username/password authentication
+// (RFC 1929) if user is set.
+func socks5Connect(conn net.Conn, address string, user *url.Userinfo) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", portStr)
+	}
+
+	// greeting
+	methods := []byte{0x00} // no authentication
+	if user != nil {
+		methods = append(methods, 0x02) // username/password
+	}
+	_, err = conn.Write(append([]byte{0x05, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return ErrProxyFailure
+	}
+
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if user == nil {
+			return ErrProxyAuth
+		}
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return ErrProxyAuth
+		}
+		auth := []byte{0x01, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err = conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return ErrProxyAuth
+		}
+	default: // 0xff, no acceptable methods
+		return ErrProxyAuth
+	}
+
+	// request
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	// reply, with the bound address to be skipped
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != 0x05 {
+		return ErrProxyFailure
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("%w: SOCKS5 reply %d", ErrProxyRefused, header[1])
+	}
+	var addrLen int
+	switch header[3] {
+	case 0x01:
+		addrLen = net.IPv4len
+	case 0x04:
+		addrLen = net.IPv6len
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err = io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return ErrProxyFailure
+	}
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+// httpConnect asks an HTTP proxy to CONNECT to the address, with basic authentication if user is set.
+func httpConnect(conn net.Conn, address string, user *url.Userinfo) error {
+	req := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if user != nil {
+		password, _ := user.Password()
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)) + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return err
+	}
+
+	// read byte by byte so nothing sent by the destination after the response is consumed
+	resp := []byte{}
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(resp, []byte("\r\n\r\n")) {
+		if len(resp) >= maxConnectResponseLen {
+			return ErrProxyFailure
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		resp = append(resp, b[0])
+	}
+
+	httpResp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProxyFailure, err)
+	}
+	httpResp.Body.Close()
+	switch {
+	case httpResp.StatusCode == http.StatusProxyAuthRequired:
+		return ErrProxyAuth
+	case httpResp.StatusCode < 200 || httpResp.StatusCode > 299:
+		return fmt.Errorf("%w: %s", ErrProxyRefused, httpResp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/internal/pcap"
+)
+
+var (
+	// rateLimitHits counts the writes held back by each scope of rate limit: "conn", "rule" and "client".
+	rateLimitHits = expvar.NewMap("passthru_rate_limit_hits")
+	// rateLimitDelay sums the time connections were held back by rate limits.
+	rateLimitDelay = expvar.NewFloat("passthru_rate_limit_delay_seconds")
+)
+
+// tokenBucket allows rate bytes per second, and up to burst bytes at once after being idle.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit *config.RateLimit) *tokenBucket {
+	burst := limit.Burst
+	if burst == 0 {
+		burst = limit.Rate
+	}
+	return &tokenBucket{rate: float64(limit.Rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes n bytes from the bucket, going into debt if there are not enough,
+// and returns how long to wait before sending them for the debt to be paid off.
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// sharedBucket is the bucket of a rule or a client, kept as long as a connection uses it.
+type sharedBucket struct {
+	bucket *tokenBucket
+	refs   int
+}
+
+// shaper holds back what is relayed in one direction of a connection to the rate limits of each scope.
+type shaper struct {
+	scopes  []string
+	buckets []*tokenBucket
+	chunk   int // bytes reserved at once, at most the smallest burst so that no reservation exceeds a bucket
+
+	// waiting may hold the lock of the ConnBuf writing to the shaper, so it ends as soon as
+	// the connection is done or the server closes its connections
+	done    <-chan struct{}
+	closing <-chan struct{}
+}
+
+func (sh *shaper) add(scope string, bucket *tokenBucket) {
+	sh.scopes = append(sh.scopes, scope)
+	sh.buckets = append(sh.buckets, bucket)
+	if burst := int(bucket.burst); sh.chunk == 0 || burst < sh.chunk {
+		sh.chunk = burst
+	}
+}
+
+// wait reserves n bytes from every bucket and waits until the slowest one allows them,
+// or fails with net.ErrClosed if the connection or the server is shut down meanwhile.
+func (sh *shaper) wait(n int) error {
+	now := time.Now()
+	var delay time.Duration
+	for i, bucket := range sh.buckets {
+		if d := bucket.reserve(n, now); d > 0 {
+			rateLimitHits.Add(sh.scopes[i], 1)
+			if d > delay {
+				delay = d
+			}
+		}
+	}
+	if delay <= 0 {
+		return nil
+	}
+	rateLimitDelay.Add(delay.Seconds())
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-sh.done:
+		return net.ErrClosed
+	case <-sh.closing:
+		return net.ErrClosed
+	}
+}
+
+// shape wraps the destination to hold both directions to the rate limits of the action, if any,
+// and returns the function to release the buckets shared with other connections once the connection is done,
+// which also interrupts the directions waiting for their rate limits.
+func (s *Server) shape(action config.Action, conn net.Conn, attributes map[string]string, downstream io.Writer, upstream io.Reader) (io.Writer, io.Reader, func()) {
+	limits := action.RateLimit
+	if limits == nil {
+		return downstream, upstream, func() {}
+	}
+
+	// the same rule on another server has buckets of its own
+	rule := fmt.Sprintf("%s %s %s", s.serverAddr, attributes["protocol"], attributes["rule"])
+	client, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		client = conn.RemoteAddr().String()
+	}
+
+	var keys []string
+	done := make(chan struct{})
+	shapers := [2]*shaper{{done: done, closing: s.closing}, {done: done, closing: s.closing}}
+	for _, dir := range []pcap.Direction{pcap.ClientToServer, pcap.ServerToClient} {
+		if limits.Conn != nil {
+			shapers[dir].add("conn", newTokenBucket(limits.Conn))
+		}
+		if limits.Rule != nil {
+			key := fmt.Sprintf("rule %d %s", dir, rule)
+			shapers[dir].add("rule", s.acquireBucket(key, limits.Rule))
+			keys = append(keys, key)
+		}
+		if limits.Client != nil {
+			key := fmt.Sprintf("client %d %s %s", dir, rule, client)
+			shapers[dir].add("client", s.acquireBucket(key, limits.Client))
+			keys = append(keys, key)
+		}
+	}
+	if shapers[0].chunk == 0 {
+		return downstream, upstream, func() {}
+	}
+
+	var stopOnce sync.Once
+	return &shapedWriter{Writer: downstream, shaper: shapers[pcap.ClientToServer]},
+		&shapedReader{Reader: upstream, shaper: shapers[pcap.ServerToClient]},
+		func() {
+			stopOnce.Do(func() {
+				close(done)
+				for _, key := range keys {
+					s.releaseBucket(key)
+				}
+			})
+		}
+}
+
+// acquireBucket returns the bucket shared by the connections with the key, creating it if there is none.
+func (s *Server) acquireBucket(key string, limit *config.RateLimit) *tokenBucket {
+	s.rateLimitsMu.Lock()
+	defer s.rateLimitsMu.Unlock()
+	if s.rateLimits == nil {
+		s.rateLimits = make(map[string]*sharedBucket)
+	}
+	shared, ok := s.rateLimits[key]
+	if !ok {
+		shared = &sharedBucket{bucket: newTokenBucket(limit)}
+		s.rateLimits[key] = shared
+	}
+	shared.refs++
+	return shared.bucket
+}
+
+// releaseBucket forgets the bucket once no connection uses it, so idle clients don't pile up.
+func (s *Server) releaseBucket(key string) {
+	s.rateLimitsMu.Lock()
+	defer s.rateLimitsMu.Unlock()
+	if shared, ok := s.rateLimits[key]; ok {
+		shared.refs--
+		if shared.refs <= 0 {
+			delete(s.rateLimits, key)
+		}
+	}
+}
+
+// shapedWriter holds back what is written to the destination.
+type shapedWriter struct {
+	io.Writer
+	shaper *shaper
+}
+
+func (w *shapedWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > w.shaper.chunk {
+			chunk = chunk[:w.shaper.chunk]
+		}
+		if err := w.shaper.wait(len(chunk)); err != nil {
+			return n, err
+		}
+		m, err := w.Writer.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// Close closes the destination like the ConnBuf does with its downstream.
+func (w *shapedWriter) Close() error {
+	if closer, ok := w.Writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// shapedReader holds back what is read from the destination, reading no more than a chunk at once.
+type shapedReader struct {
+	io.Reader
+	shaper *shaper
+}
+
+func (r *shapedReader) Read(p []byte) (int, error) {
+	if len(p) > r.shaper.chunk {
+		p = p[:r.shaper.chunk]
+	}
+	n, err := r.Reader.Read(p)
+	if n > 0 && err == nil {
+		err = r.shaper.wait(n)
+	}
+	return n, err
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/internal/logger"
+	"github.com/gaukas/passthru/protocol"
+)
+
+var (
+	// TarpitInterval is the time between two bytes trickled to a tarpitted client.
+	TarpitInterval = 10 * time.Second
+)
+
+// reject closes the connection in the reject mode of the action.
+func (s *Server) reject(conn net.Conn, cBuf *protocol.ConnBuf, wg *sync.WaitGroup, action config.Action) error {
+	s.logAccess(conn, action.Action, "", cBuf.Attributes())
+
+	switch action.RejectMode {
+	case config.REJECT_MODE_FIN:
+		return writeAndClose(conn, wg, nil)
+	case config.REJECT_MODE_RST:
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0) // RST on close
+		} else {
+			logger.Warnf("reject_mode rst is only supported on TCP, closing the %s connection instead", conn.LocalAddr().Network())
+		}
+		return nil
+	case config.REJECT_MODE_DROP, config.REJECT_MODE_TARPIT:
+		return s.hold(conn, cBuf, wg, action)
+	default:
+		logger.Debugf("Doing nothing, connection will be closed by defer")
+		return nil // do nothing, conn will be closed by defer
+	}
+}
+
+// hold keeps the connection open, discarding what the client sends, and trickles
+// a random byte every TarpitInterval in the tarpit mode, until the client gives up,
+// the reject timeout is reached, or the server stops. Once the rule holds reject_max_held
+// connections, the next ones are closed right away.
+func (s *Server) hold(conn net.Conn, cBuf *protocol.ConnBuf, wg *sync.WaitGroup, action config.Action) error {
+	attributes := cBuf.Attributes()
+	rule := fmt.Sprintf("%s %s", attributes["protocol"], attributes["rule"])
+	maxHeld := action.RejectMaxHeld
+	if maxHeld == 0 {
+		maxHeld = config.DEFAULT_REJECT_MAX_HELD
+	}
+	if !s.reserveHeld(rule, maxHeld) {
+		logger.Debugf("Already holding %d connections of %s, closing %s", maxHeld, rule, conn.RemoteAddr())
+		return nil // closed by defer
+	}
+	defer s.releaseHeld(rule)
+
+	if err := cBuf.SetDownstream(io.Discard); err != nil {
+		return err
+	}
+
+	timeout := time.Duration(action.RejectTimeout) * time.Second
+	if timeout == 0 {
+		timeout = config.DEFAULT_REJECT_TIMEOUT * time.Second
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait() // conn->cBuf, until the client closes
+		close(done)
+	}()
+
+	var tick <-chan time.Time
+	if action.RejectMode == config.REJECT_MODE_TARPIT {
+		ticker := time.NewTicker(TarpitInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	b := make([]byte, 1)
+	for {
+		select {
+		case <-tick:
+			rand.Read(b)
+			conn.SetWriteDeadline(time.Now().Add(TarpitInterval))
+			if _, err := conn.Write(b); err != nil {
+				return nil // the client is gone
+			}
+		case <-done:
+			return nil
+		case <-deadline.C:
+			logger.Debugf("Giving up on holding %s", conn.RemoteAddr())
+			return nil
+		case <-s.stopped:
+			return nil
+		}
+	}
+}
+
+func (s *Server) reserveHeld(rule string, maxHeld int) bool {
+	s.heldMu.Lock()
+	defer s.heldMu.Unlock()
+	if s.held[rule] >= maxHeld {
+		return false
+	}
+	if s.held == nil {
+		s.held = make(map[string]int)
+	}
+	s.held[rule]++
+	return true
+}
+
+func (s *Server) releaseHeld(rule string) {
+	s.heldMu.Lock()
+	defer s.heldMu.Unlock()
+	s.held[rule]--
+	if s.held[rule] <= 0 {
+		delete(s.held, rule)
+	}
+}
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/internal/logger"
+	"github.com/gaukas/passthru/protocol"
+	ptls "github.com/gaukas/passthru/protocol/tls"
+)
+
+const (
+	// RESPOND_LINGER is how long to keep reading from the client after responding,
+	// so the response isn't lost to a reset caused by unread request bytes.
+	RESPOND_LINGER = time.Second
+)
+
+// respond writes the payload of the action to the client, then closes the connection.
+func (s *Server) respond(conn net.Conn, cBuf *protocol.ConnBuf, wg *sync.WaitGroup, action config.Action) error {
+	payload := []byte(action.Payload)
+	if action.PayloadFile != "" {
+		var err error
+		payload, err = os.ReadFile(action.PayloadFile)
+		if err != nil {
+			logger.Errorf("Failed to read the payload for %s: %v", conn.RemoteAddr(), err)
+			return err
+		}
+	}
+
+	s.logAccess(conn, action.Action, "", cBuf.Attributes())
+	return writeAndClose(conn, wg, payload)
+}
+
+// redirect sends a 301 or 308 to the https:// URL of the HTTP request, then closes the connection.
+func (s *Server) redirect(conn net.Conn, cBuf *protocol.ConnBuf, wg *sync.WaitGroup, action config.Action) error {
+	attributes := cBuf.Attributes()
+	host, path := attributes["host"], attributes["path"]
+	if host == "" {
+		logger.Warnf("No host to redirect %s to", conn.RemoteAddr())
+		s.logAccess(conn, config.ACTION_REJECT, "", attributes)
+		return writeAndClose(conn, wg, []byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	code := action.RedirectCode
+	if code == 0 {
+		code = config.DEFAULT_REDIRECT_CODE
+	}
+	reason := "Moved Permanently"
+	if code == 308 {
+		reason = "Permanent Redirect"
+	}
+	location := "https://" + host + path
+
+	logger.Infof("Redirecting %s to %s", conn.RemoteAddr(), location)
+	s.logAccess(conn, action.Action, location, attributes)
+	response := fmt.Sprintf("HTTP/1.1 %d %s\r\nLocation: %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", code, reason, location)
+	return writeAndClose(conn, wg, []byte(response))
+}
+
+// rejectTLSAlert sends a fatal TLS alert in the record version of the client, then closes the connection.
+func (s *Server) rejectTLSAlert(conn net.Conn, cBuf *protocol.ConnBuf, wg *sync.WaitGroup, action config.Action) error {
+	version := ptls.RecordVersion(cBuf)
+	description := ptls.AlertDescription(action.Alert)
+
+	logger.Infof("Rejecting %s with TLS alert %d", conn.RemoteAddr(), description)
+	s.logAccess(conn, action.Action, "", cBuf.Attributes())
+	return writeAndClose(conn, wg, ptls.AlertRecord(version, description))
+}
+
+// writeAndClose writes the response and closes the connection for writing,
+// then waits a while for the client to close, as the rest of the request is discarded.
+func writeAndClose(conn net.Conn, wg *sync.WaitGroup, response []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(DEFAULT_TIMEOUT))
+	if _, err := conn.Write(response); err != nil {
+		return err
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait() // conn->cBuf, until the client closes
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(RESPOND_LINGER):
+	}
+	return nil
+}
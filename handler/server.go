@@ -9,6 +9,7 @@ import (
 
 	"github.com/gaukas/passthru/config"
 	"github.com/gaukas/passthru/internal/logger"
+	"github.com/gaukas/passthru/internal/pcap"
 	"github.com/gaukas/passthru/protocol"
 )
 
@@ -25,16 +26,50 @@ const (
 
 const (
 	DEFAULT_TIMEOUT = 5 * time.Second
+
+	// MAX_BUFFER_SIZE bounds the bytes buffered from the client while identifying the protocol.
+	// Beyond it, the connection takes the FALLBACK action, if any.
+	MAX_BUFFER_SIZE = 128 * 1024
 )
 
 type Server struct {
-	serverAddr config.ServerAddr
-	listener   net.Listener
+	serverAddr  config.ServerAddr
+	listenAddrs []config.ListenAddr
+	listeners   []net.Listener
+	inherited   map[config.ListenAddr][]net.Listener
+
+	socketOptions config.SocketOptions
+	dialer        Dialer // nil for a net.Dialer with the socket options
+
+	tlsConfigs sync.Map // certificates of TERMINATE actions, or the upstream_tls -> *tls.Config
+	routeExprs sync.Map // matches of client routes -> *config.RuleExpr
+
+	accessLog   io.Writer
+	accessLogMu sync.Mutex
+
+	pcapWriters   map[string]*pcap.Writer // pcap files mirrored to by path
+	pcapWritersMu sync.Mutex
+	captures      map[string]int // capture files being created by directory
+	capturesMu    sync.Mutex
+
+	rateLimits   map[string]*sharedBucket // token buckets shared by the connections of a rule or a client
+	rateLimitsMu sync.Mutex
+
+	held   map[string]int // connections dropped or tarpitted by rule
+	heldMu sync.Mutex
+
+	conns   map[net.Conn]struct{} // connections being handled
+	connsMu sync.Mutex
 
 	protocolManager *protocol.ProtocolManager
 
-	connBuf chan net.Conn
-	mode    ServerMode
+	connBuf  chan net.Conn
+	mode     ServerMode
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	closing     chan struct{} // closed when Shutdown gives up on the remaining connections
+	closingOnce sync.Once
 }
 
 // Required parameters will be provided from the main function
@@ -43,56 +78,182 @@ func NewServer(serverAddr config.ServerAddr, protocolManager *protocol.ProtocolM
 		serverAddr:      serverAddr,
 		protocolManager: protocolManager,
 		mode:            mode,
+		connBuf:         make(chan net.Conn),
+		inherited:       make(map[config.ListenAddr][]net.Listener),
+		conns:           make(map[net.Conn]struct{}),
+		stopped:         make(chan struct{}),
+		closing:         make(chan struct{}),
 	}
 }
 
+// Inherit makes the server accept on an already-open listener for one of the addresses
+// in its serverAddr, instead of listening on it. It must be called before Start, once for
+// each listener of the address, e.g. for all listeners with SO_REUSEPORT handed over in an upgrade.
+func (s *Server) Inherit(listenAddr config.ListenAddr, listener net.Listener) {
+	s.inherited[listenAddr] = append(s.inherited[listenAddr], listener)
+}
+
+// SetSocketOptions sets the options of the listening sockets, and the connections accepted
+// and dialed by the server. It must be called before Start.
+func (s *Server) SetSocketOptions(opts config.SocketOptions) {
+	s.socketOptions = opts
+}
+
+// SetDialer replaces the Dialer used to dial the destinations. It must be called before Start.
+func (s *Server) SetDialer(d Dialer) {
+	s.dialer = d
+}
+
+// Start listens on every address in the serverAddr, each with its own accept loop.
+// Addresses with an inherited listener are not listened on again.
 func (s *Server) Start() error {
 	logger.Warnf("Starting server on %s", s.serverAddr)
-	listener, err := net.Listen("tcp", s.serverAddr)
+	listenAddrs, err := config.ParseServerAddr(s.serverAddr)
 	if err != nil {
 		logger.Errorf("Failed to start server on %s: %s", s.serverAddr, err)
 		return err
 	}
 
-	s.listener = listener
-	s.connBuf = make(chan net.Conn)
+	for _, listenAddr := range listenAddrs {
+		inherited := s.inherited[listenAddr]
+		for _, listener := range inherited {
+			logger.Infof("Using inherited listener on %s for %s", listener.Addr(), listenAddr)
+		}
 
-	go s.acceptLoop()
+		listeners, err := listenGroup(listenAddr, inherited, &s.socketOptions)
+		if err != nil {
+			logger.Errorf("Failed to start server on %s: %s", listenAddr, err)
+			s.closeListeners()
+			return err
+		}
+		for _, listener := range listeners {
+			logger.Infof("Listening on %s", listener.Addr())
+			s.listenAddrs = append(s.listenAddrs, listenAddr)
+			s.listeners = append(s.listeners, listener)
+		}
+	}
+
+	for _, listener := range s.listeners {
+		go s.acceptLoop(listener)
+	}
 
 	return nil
 }
 
 func (s *Server) Stop() error {
-	logger.Warnf("Stopping server on %s", s.serverAddr)
-	close(s.connBuf)
-	if s.listener != nil {
-		err := s.listener.Close()
-		if err != nil {
-			return err
+	var err error
+	s.stopOnce.Do(func() {
+		logger.Warnf("Stopping server on %s", s.serverAddr)
+		close(s.stopped)
+		err = s.closeListeners()
+		logger.Infof("Server on %s stopped", s.serverAddr)
+	})
+	return err
+}
+
+// Shutdown stops accepting new connections, and waits for the connections being handled
+// to finish until the context is done, when the remaining connections are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Stop()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for s.ActiveConns() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			logger.Warnf("Closing %d connections still active on %s", s.ActiveConns(), s.serverAddr)
+			s.closingOnce.Do(func() { close(s.closing) })
+			s.connsMu.Lock()
+			for conn := range s.conns {
+				conn.Close()
+			}
+			s.connsMu.Unlock()
+			return ctx.Err()
 		}
 	}
-	logger.Infof("Server on %s stopped", s.serverAddr)
-	return nil
+	return err
+}
+
+// ActiveConns returns the number of connections being handled.
+func (s *Server) ActiveConns() int {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	return len(s.conns)
 }
 
-func (s *Server) acceptLoop() {
+// Listeners returns the listeners of a started server by the address in the config
+// they listen on, all of them with SO_REUSEPORT.
+func (s *Server) Listeners() map[config.ListenAddr][]net.Listener {
+	listeners := make(map[config.ListenAddr][]net.Listener)
+	for i, listener := range s.listeners {
+		listeners[s.listenAddrs[i]] = append(listeners[s.listenAddrs[i]], listener)
+	}
+	return listeners
+}
+
+// Addrs returns the addresses the server is listening on.
+func (s *Server) Addrs() []net.Addr {
+	addrs := []net.Addr{}
+	for _, listener := range s.listeners {
+		addrs = append(addrs, listener.Addr())
+	}
+	return addrs
+}
+
+func (s *Server) closeListeners() error {
+	var errClose error
+	for _, listener := range s.listeners {
+		err := listener.Close()
+		if err != nil && errClose == nil {
+			errClose = err
+		}
+	}
+	return errClose
+}
+
+func (s *Server) isStopped() bool {
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) acceptLoop(listener net.Listener) {
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
+			if s.isStopped() {
+				return
+			}
 			logger.Errorf("Failed to accept connection: %s, shutting down the server... ", err)
 			s.Stop()
 			return
 		}
-		logger.Infof("Accepted connection from %s", conn.RemoteAddr())
+		logger.Infof("Accepted connection from %s on %s", conn.RemoteAddr(), listener.Addr())
+		if err := applyConnOptions(conn, &s.socketOptions); err != nil {
+			logger.Warnf("Failed to set socket options for %s: %v", conn.RemoteAddr(), err)
+		}
+		s.track(conn)
 
 		if s.mode == SERVER_MODE_UNLIMITED {
 			logger.Debugf("Starting a new goroutine to handle the connection from %s", conn.RemoteAddr())
-			ctxExpire, cancel := context.WithTimeout(context.Background(), DEFAULT_TIMEOUT)
-			go s.handleConn(ctxExpire, conn)
-			defer cancel()
+			go func(conn net.Conn) {
+				ctxExpire, cancel := context.WithTimeout(context.Background(), DEFAULT_TIMEOUT)
+				defer cancel()
+				s.handleConn(ctxExpire, conn)
+			}(conn)
 		} else {
 			logger.Debugf("Passing the connection from %s to the channel", conn.RemoteAddr())
-			s.connBuf <- conn
+			select {
+			case s.connBuf <- conn:
+			case <-s.stopped:
+				conn.Close()
+				s.untrack(conn)
+				return
+			}
 		}
 	}
 }
@@ -103,11 +264,10 @@ func (s *Server) acceptLoop() {
 func (s *Server) HandleNextConn(ctx context.Context) error {
 	select {
 	case conn := <-s.connBuf:
-		if conn == nil {
-			logger.Errorf("Connection channel is closed, cannot handle the next connection")
-			return ErrServerStopped
-		}
 		return s.handleConn(ctx, conn)
+	case <-s.stopped:
+		logger.Errorf("Server is stopped, cannot handle the next connection")
+		return ErrServerStopped
 	case <-ctx.Done():
 		logger.Errorf("Context is Done due to reason: %v, cannot handle the next connection", ctx.Err())
 		return ctx.Err()
@@ -116,6 +276,7 @@ func (s *Server) HandleNextConn(ctx context.Context) error {
 
 func (s *Server) handleConn(ctx context.Context, conn net.Conn) error {
 	defer conn.Close()
+	defer s.untrack(conn) // tracked since accepted
 	wg := &sync.WaitGroup{}
 
 	// Copy the connection
@@ -124,6 +285,8 @@ func (s *Server) handleConn(ctx context.Context, conn net.Conn) error {
 	// Perform the action
 	cBuf := protocol.NewConnBuf()
 	defer cBuf.Close()
+	cBuf.SetRemoteAddr(conn.RemoteAddr())
+	cBuf.SetLimit(MAX_BUFFER_SIZE)
 
 	wg.Add(1)
 	go func(wg *sync.WaitGroup) {
@@ -146,29 +309,110 @@ func (s *Server) handleConn(ctx context.Context, conn net.Conn) error {
 
 	switch action.Action {
 	case config.ACTION_FORWARD:
-		// dial up the destination
-		connDst, err := net.Dial("tcp", action.ToAddr)
+		// dial up the destination, not for longer than the identification could take
+		ctxDial, cancelDial := context.WithTimeout(context.Background(), DEFAULT_TIMEOUT)
+		defer cancelDial()
+		connDst, toAddr, err := s.dialDestination(ctxDial, action, cBuf)
 		if err != nil {
 			return err
 		}
 		defer connDst.Close()
+		if action.UpstreamTLS != nil {
+			connDst, err = s.upstreamTLS(connDst, action.UpstreamTLS, toAddr)
+			if err != nil {
+				return err
+			}
+			defer connDst.Close()
+		}
+
+		logger.Infof("Forwarding connection from %s to %s", conn.RemoteAddr(), toAddr)
+		s.logAccess(conn, action.Action, toAddr, cBuf.Attributes())
 
-		logger.Infof("Forwarding connection from %s to %s", conn.RemoteAddr(), action.ToAddr)
+		// Copy both directions to the mirror and the capture, if any
+		downstream, upstream, stopTee := s.tee(action, conn, cBuf.Attributes(), connDst)
+		defer stopTee()
+		// Hold both directions to the rate limits, if any
+		downstream, upstream, stopShape := s.shape(action, conn, cBuf.Attributes(), downstream, upstream)
+		defer stopShape()
 
 		// Set downstream for the connection buffer
-		err = cBuf.SetDownstream(connDst)
+		err = cBuf.SetDownstream(downstream)
 		if err != nil {
 			return err
 		}
 
-		io.Copy(conn, connDst) // connDst->conn, so it is a bidirectional pipe
-		wg.Wait()              // wait for conn->cBuf(->connDst) to finish
+		// once the client is done sending, let the destination know
+		go func() {
+			wg.Wait()
+			if cw, ok := connDst.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			} else {
+				connDst.Close()
+			}
+		}()
+
+		_, err = io.Copy(conn, upstream) // connDst->conn, so it is a bidirectional pipe
+		if err != nil {
+			stopShape() // either end is gone, don't keep the other direction waiting for its rate limit
+		}
+		wg.Wait() // wait for conn->cBuf(->connDst) to finish
 		return nil
+	case config.ACTION_TERMINATE:
+		return s.terminate(conn, cBuf, wg, action)
+	case config.ACTION_RESPOND:
+		return s.respond(conn, cBuf, wg, action)
+	case config.ACTION_HTTP_REDIRECT:
+		return s.redirect(conn, cBuf, wg, action)
+	case config.ACTION_REJECT_TLS_ALERT:
+		return s.rejectTLSAlert(conn, cBuf, wg, action)
 	case config.ACTION_REJECT:
-                logger.Debugf("Doing nothing, connection will be closed by defer")
-		return nil // do nothing, conn will be closed by defer
+		return s.reject(conn, cBuf, wg, action)
 	default:
                 logger.Errorf("Error Unknown Action!!")
 		return ErrUnknownAction
 	}
 }
+
+// dialDestination dials the ToAddr of the action, filled with the attributes of the connection
+// if it is a template, and returns the connection with the address dialed. The context bounds
+// the dial, including the handshake with the proxy the action goes via, if any.
+func (s *Server) dialDestination(ctx context.Context, action config.Action, cBuf *protocol.ConnBuf) (net.Conn, string, error) {
+	toAddr, err := action.ResolveToAddr(cBuf.Attributes())
+	if err != nil {
+		logger.Errorf("Failed to resolve the destination for %s: %v", cBuf.RemoteAddr(), err)
+		return nil, "", err
+	}
+
+	network, address := config.ParseNetAddr(toAddr)
+	var d Dialer = s.dialer
+	if d == nil {
+		d = dialer(&s.socketOptions)
+	}
+	if action.Via != "" {
+		d, err = viaDialer(action.Via, d)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	connDst, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		logger.Errorf("Failed to dial %s for %s: %v", toAddr, cBuf.RemoteAddr(), err)
+		return nil, "", err
+	}
+	if err := applyConnOptions(connDst, &s.socketOptions); err != nil {
+		logger.Warnf("Failed to set socket options for %s: %v", toAddr, err)
+	}
+	return connDst, toAddr, nil
+}
+
+func (s *Server) track(conn net.Conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	s.conns[conn] = struct{}{}
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	delete(s.conns, conn)
+}
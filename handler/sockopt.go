@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+)
+
+// listenConfig applies the socket options to the listening sockets, and the keepalive
+// to the connections accepted on them.
+func listenConfig(opts *config.SocketOptions) *net.ListenConfig {
+	return &net.ListenConfig{
+		KeepAlive: keepAlive(opts),
+		Control: func(network, address string, c syscall.RawConn) error {
+			if !strings.HasPrefix(network, "tcp") {
+				return nil
+			}
+			return control(c, func(fd int) error { return setListenOptions(fd, opts) })
+		},
+	}
+}
+
+// dialer applies the socket options to the connections dialed to the destination.
+func dialer(opts *config.SocketOptions) *net.Dialer {
+	return &net.Dialer{
+		KeepAlive: keepAlive(opts),
+		Control: func(network, address string, c syscall.RawConn) error {
+			if !strings.HasPrefix(network, "tcp") {
+				return nil
+			}
+			return control(c, func(fd int) error { return setDialOptions(fd, opts) })
+		},
+	}
+}
+
+// applyConnOptions applies the socket options not inherited from the listener, or set after
+// the connection is established, to an accepted or dialed connection.
+func applyConnOptions(conn net.Conn, opts *config.SocketOptions) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if opts.NoDelay != nil {
+		if err := tcpConn.SetNoDelay(*opts.NoDelay); err != nil {
+			return err
+		}
+	}
+	if opts.ReceiveBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(opts.ReceiveBuffer); err != nil {
+			return err
+		}
+	}
+	if opts.SendBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(opts.SendBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func keepAlive(opts *config.SocketOptions) time.Duration {
+	if opts.KeepAlive < 0 {
+		return -1 // disabled
+	}
+	return time.Duration(opts.KeepAlive) * time.Second // 0 for the default of net
+}
+
+func control(c syscall.RawConn, f func(fd int) error) error {
+	var errSet error
+	err := c.Control(func(fd uintptr) {
+		errSet = f(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return errSet
+}
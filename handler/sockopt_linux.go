@@ -0,0 +1,84 @@
+//go:build linux
+
+package handler
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/gaukas/passthru/config"
+	"golang.org/x/sys/unix"
+)
+
+const fastOpenQueueLen = 256 // pending TCP Fast Open requests per listener
+
+func setListenOptions(fd int, opts *config.SocketOptions) error {
+	if opts.ReusePort > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return err
+		}
+	}
+	if opts.FastOpen {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, fastOpenQueueLen); err != nil {
+			return err
+		}
+	}
+	return setBufferOptions(fd, opts)
+}
+
+func setDialOptions(fd int, opts *config.SocketOptions) error {
+	if opts.FastOpen {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1); err != nil {
+			return err
+		}
+	}
+	return setBufferOptions(fd, opts)
+}
+
+// setBufferOptions sets the buffer sizes before connecting or listening, so they are
+// considered for the TCP window scale.
+func setBufferOptions(fd int, opts *config.SocketOptions) error {
+	if opts.ReceiveBuffer > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, opts.ReceiveBuffer); err != nil {
+			return err
+		}
+	}
+	if opts.SendBuffer > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, opts.SendBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setBacklog changes the length of the accept queue of a listener,
+// since listen(2) on a listening socket updates it on Linux.
+func setBacklog(listener net.Listener, backlog int) error {
+	sc, ok := listener.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	c, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return control(c, func(fd int) error { return unix.Listen(fd, backlog) })
+}
+
+// hasReusePort tells whether SO_REUSEPORT is set on a listener, e.g. one inherited from systemd.
+func hasReusePort(listener net.Listener) bool {
+	sc, ok := listener.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	c, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var value int
+	err = control(c, func(fd int) (err error) {
+		value, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT)
+		return err
+	})
+	return err == nil && value != 0
+}
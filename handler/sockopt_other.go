@@ -0,0 +1,31 @@
+//go:build !linux
+
+package handler
+
+import (
+	"net"
+
+	"github.com/gaukas/passthru/config"
+)
+
+func setListenOptions(fd int, opts *config.SocketOptions) error {
+	if opts.ReusePort > 0 || opts.FastOpen {
+		return ErrUnsupportedSocketOption
+	}
+	return nil // buffer sizes are set on the connections only
+}
+
+func setDialOptions(fd int, opts *config.SocketOptions) error {
+	if opts.FastOpen {
+		return ErrUnsupportedSocketOption
+	}
+	return nil
+}
+
+func setBacklog(listener net.Listener, backlog int) error {
+	return ErrUnsupportedSocketOption
+}
+
+func hasReusePort(listener net.Listener) bool {
+	return false
+}
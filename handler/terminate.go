@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/internal/logger"
+	"github.com/gaukas/passthru/protocol"
+)
+
+// terminate completes the TLS handshake with the client, replaying the bytes already
+// in the ConnBuf, and forwards the decrypted stream to the destination, which is
+// chosen by the client certificate if the action has client_auth.
+func (s *Server) terminate(conn net.Conn, cBuf *protocol.ConnBuf, wg *sync.WaitGroup, action config.Action) error {
+	tlsConfig, err := s.serverTLSConfig(action)
+	if err != nil {
+		logger.Errorf("Failed to load certificates for %s: %v", conn.RemoteAddr(), err)
+		return err
+	}
+
+	// conn->cBuf->pipe->tlsConn, as the ClientHello is already consumed from conn
+	pipeConn, pipeEnd := net.Pipe()
+	defer pipeConn.Close()
+	go func() {
+		err := cBuf.SetDownstream(pipeEnd) // blocks until the handshake reads the buffered bytes
+		if err != nil {
+			pipeEnd.Close()
+			return
+		}
+		wg.Wait() // once the client is done sending, let the handshake or the copy know
+		pipeEnd.Close()
+	}()
+
+	tlsConn := tls.Server(&pipedConn{Conn: conn, reader: pipeConn}, tlsConfig)
+	defer tlsConn.Close()
+	ctxHandshake, cancel := context.WithTimeout(context.Background(), DEFAULT_TIMEOUT)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctxHandshake); err != nil {
+		logger.Errorf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return err
+	}
+
+	state := tlsConn.ConnectionState()
+
+	// the verified identity of the client, and where it goes
+	destination := action
+	var identity map[string]string
+	if action.ClientAuth != nil && len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		identity = clientIdentity(cert)
+		for key, value := range identity {
+			cBuf.SetAttribute(key, value)
+		}
+		if route := s.selectClientRoute(action.ClientAuth.Routes, cert); route != nil {
+			logger.Debugf("Client certificate %q from %s matches %q", cert.Subject.CommonName, conn.RemoteAddr(), route.Match)
+			destination = route.Action
+		}
+	}
+	if destination.Action == config.ACTION_REJECT || destination.ToAddr == "" {
+		logger.Infof("Rejecting terminated connection from %s", conn.RemoteAddr())
+		s.logAccess(conn, config.ACTION_REJECT, "", cBuf.Attributes())
+		return nil
+	}
+
+	ctxDial, cancelDial := context.WithTimeout(context.Background(), DEFAULT_TIMEOUT)
+	defer cancelDial()
+	connDst, toAddr, err := s.dialDestination(ctxDial, destination, cBuf)
+	if err != nil {
+		return err
+	}
+	defer connDst.Close()
+
+	if action.ClientAuth != nil && action.ClientAuth.ProxyProtocol {
+		if _, err := connDst.Write(proxyHeader(conn, state, identity)); err != nil {
+			return err
+		}
+	}
+
+	if destination.UpstreamTLS != nil {
+		connDst, err = s.upstreamTLS(connDst, destination.UpstreamTLS, toAddr)
+		if err != nil {
+			return err
+		}
+		defer connDst.Close()
+	}
+
+	logger.Infof("Terminated TLS from %s (SNI %s), forwarding to %s", conn.RemoteAddr(), state.ServerName, toAddr)
+	s.logAccess(conn, action.Action, toAddr, cBuf.Attributes())
+
+	// Copy both directions to the mirror and the capture, if any, in plaintext
+	downstream, upstream, stopTee := s.tee(action, conn, cBuf.Attributes(), connDst)
+	defer stopTee()
+	downstream, upstream, stopShape := s.shape(action, conn, cBuf.Attributes(), downstream, upstream)
+	defer stopShape()
+
+	// not on wg, which the pipe to the handshake waits for before closing
+	var wgUpstream sync.WaitGroup
+	wgUpstream.Add(1)
+	go func() {
+		defer wgUpstream.Done()
+		io.Copy(downstream, tlsConn) // tlsConn->connDst
+		if cw, ok := connDst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			connDst.Close()
+		}
+	}()
+	_, err = io.Copy(tlsConn, upstream) // connDst->tlsConn
+	if err != nil {
+		stopShape() // either end is gone, don't keep the other direction waiting for its rate limit
+	}
+	tlsConn.CloseWrite()
+	wgUpstream.Wait() // wait for tlsConn->connDst to finish, before the mirror, the capture and connDst are closed
+	return nil
+}
+
+// serverTLSConfig returns the tls.Config with the certificates of the action,
+// which are loaded once for all connections.
+func (s *Server) serverTLSConfig(action config.Action) (*tls.Config, error) {
+	files := []string{}
+	for _, cert := range action.Certificates {
+		files = append(files, cert.CertFile, cert.KeyFile)
+	}
+	if action.ClientAuth != nil {
+		files = append(files, action.ClientAuth.CAFile)
+	}
+	key := strings.Join(files, "\x00")
+	if tlsConfig, ok := s.tlsConfigs.Load(key); ok {
+		return tlsConfig.(*tls.Config), nil
+	}
+
+	tlsConfig := &tls.Config{}
+	for _, cert := range action.Certificates {
+		certificate, err := tls.LoadX509KeyPair(cert.CertFile, cert.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		// selected by SNI among the certificates
+		tlsConfig.Certificates = append(tlsConfig.Certificates, certificate)
+	}
+	if action.ClientAuth != nil {
+		pool, err := loadCertPool(action.ClientAuth.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	s.tlsConfigs.Store(key, tlsConfig)
+	return tlsConfig, nil
+}
+
+// pipedConn reads what the client sent through the ConnBuf, and writes to the client directly.
+type pipedConn struct {
+	net.Conn          // the client
+	reader   net.Conn // the end of the pipe the ConnBuf writes to
+}
+
+func (c *pipedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *pipedConn) Close() error {
+	c.reader.Close()
+	return c.Conn.Close()
+}
+
+func (c *pipedConn) SetDeadline(t time.Time) error {
+	c.reader.SetDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *pipedConn) SetReadDeadline(t time.Time) error {
+	return c.reader.SetReadDeadline(t)
+}
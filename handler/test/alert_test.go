@@ -0,0 +1,30 @@
+package handler_test
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+)
+
+func TestRejectTLSAlert(t *testing.T) {
+	address := startServer(t, config.ProtocolGroup{"TLS": config.Filter{
+		"SNI denied.example.com": {Action: config.ACTION_REJECT_TLS_ALERT, Alert: config.ALERT_ACCESS_DENIED},
+		"CATCHALL":               {Action: config.ACTION_REJECT_TLS_ALERT, Alert: config.ALERT_UNRECOGNIZED_NAME},
+	}})
+
+	for serverName, want := range map[string]string{
+		"denied.example.com":  "access denied",
+		"unknown.example.com": "unrecognized name",
+	} {
+		conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err == nil {
+			conn.Close()
+			t.Fatalf("expected the handshake to fail")
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected alert %q for %s, got %v", want, serverName, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package handler_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+)
+
+// waitForCaptures waits for n capture files in the directory, as captures are asynchronous.
+func waitForCaptures(dir string, n int) []string {
+	var files []string
+	waitFor(func() bool {
+		files, _ = filepath.Glob(filepath.Join(dir, "*.pcapng"))
+		return len(files) >= n
+	})
+	return files
+}
+
+func TestCapture(t *testing.T) {
+	dir := t.TempDir()
+	address := startServer(t, testRule(config.Action{
+		Action:          config.ACTION_FORWARD,
+		ToAddr:          startEchoServer(t),
+		Capture:         dir,
+		CaptureMaxFiles: 2,
+	}))
+	for i := 0; i < 3; i++ {
+		roundTrip(t, "tcp", address, len(hello))
+	}
+
+	files := waitForCaptures(dir, 2)
+	time.Sleep(100 * time.Millisecond) // for a third one, if any
+	if files, _ = filepath.Glob(filepath.Join(dir, "*.pcapng")); len(files) != 2 {
+		t.Fatalf("expected 2 capture files, got %d", len(files))
+	}
+
+	data := waitForFile(files[0], func(data []byte) bool { return bytes.Count(data, []byte(hello)) >= 2 })
+	if n := bytes.Count(data, []byte(hello)); n != 2 {
+		t.Errorf("expected both directions captured, got %d payloads", n)
+	}
+	for _, expected := range []string{"protocol: dummy", "rule: test", "passthru capture of 127.0.0.1:"} {
+		if !bytes.Contains(data, []byte(expected)) {
+			t.Errorf("expected %q in the comment", expected)
+		}
+	}
+}
+
+func TestCaptureMaxFilesRecounted(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "caps")
+	address := startServer(t, testRule(config.Action{
+		Action:          config.ACTION_FORWARD,
+		ToAddr:          startEchoServer(t),
+		Capture:         dir,
+		CaptureMaxFiles: 1,
+	}))
+
+	// failing to create the file doesn't take the room of one
+	roundTrip(t, "tcp", address, len(hello))
+	time.Sleep(100 * time.Millisecond)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("failed to create %s: %v", dir, err)
+	}
+	roundTrip(t, "tcp", address, len(hello))
+	files := waitForCaptures(dir, 1)
+	if len(files) != 1 {
+		t.Fatalf("expected a capture file, got %d", len(files))
+	}
+
+	// emptying the directory makes room again
+	time.Sleep(100 * time.Millisecond) // for the capture to finish
+	os.Remove(files[0])
+	roundTrip(t, "tcp", address, len(hello))
+	if files = waitForCaptures(dir, 1); len(files) != 1 {
+		t.Errorf("expected a new capture file once the directory is emptied, got %d", len(files))
+	}
+}
+
+func TestCaptureMaxBytes(t *testing.T) {
+	dir := t.TempDir()
+	address := startServer(t, testRule(config.Action{
+		Action:          config.ACTION_FORWARD,
+		ToAddr:          startEchoServer(t),
+		Capture:         dir,
+		CaptureMaxBytes: 4096,
+	}))
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", address, err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	payload := append([]byte("test"), bytes.Repeat([]byte("x"), 1<<20)...)
+	go conn.Write(payload)
+	if _, err := io.ReadFull(conn, make([]byte, len(payload))); err != nil {
+		t.Fatalf("failed to read from %s: %v", address, err)
+	}
+	conn.Close()
+
+	files := waitForCaptures(dir, 1)
+	if len(files) != 1 {
+		t.Fatalf("expected a capture file, got %d", len(files))
+	}
+	time.Sleep(100 * time.Millisecond) // for the capture to finish
+	if info, err := os.Stat(files[0]); err != nil || info.Size() > 4096 || info.Size() == 0 {
+		t.Errorf("expected the capture to stop at 4096 bytes: %v, %v", info, err)
+	}
+}
@@ -0,0 +1,250 @@
+package handler_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/internal/proxyproto"
+)
+
+// issueClientCert returns a client certificate for the common name and emails, signed by the CA.
+func issueClientCert(t *testing.T, ca config.Certificate, cn string, emails ...string) tls.Certificate {
+	caPair, err := tls.LoadX509KeyPair(ca.CertFile, ca.KeyFile)
+	if err != nil {
+		t.Fatalf("failed to load CA: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caPair.Certificate[0])
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: cn},
+		EmailAddresses: emails,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caPair.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startTagServer starts a server writing the tag to every connection, and returns its address.
+func startTagServer(t *testing.T, tag string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(tag))
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// readTag connects with the client certificate and returns what the upstream wrote, if anything.
+func readTag(t *testing.T, address string, tlsConfig *tls.Config) string {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", address, tlsConfig)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tag, _ := io.ReadAll(conn)
+	return string(tag)
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestClientCertRouting(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverPool := generateCert(t, dir, "mtls.internal")
+	ca, _ := generateCert(t, dir, "Clients CA")
+	otherCA, _ := generateCert(t, dir, "Other CA")
+
+	alice := issueClientCert(t, ca, "alice")
+	bob := issueClientCert(t, ca, "bob", "bob@example.com")
+	carol := issueClientCert(t, ca, "carol")
+	ops := issueClientCert(t, ca, "R&D (AND Ops)")
+	mallory := issueClientCert(t, otherCA, "alice")
+	spki := sha256.Sum256(mustParse(t, carol).RawSubjectPublicKeyInfo)
+
+	accessLog := &syncBuffer{}
+	address := startServer(t, config.ProtocolGroup{"TLS": config.Filter{
+		config.Rule("SNI mtls.internal"): config.Action{
+			Action:       config.ACTION_TERMINATE,
+			ToAddr:       startTagServer(t, "default"),
+			Certificates: []config.Certificate{serverCert},
+			ClientAuth: &config.ClientAuth{
+				CAFile: ca.CertFile,
+				Routes: []config.ClientRoute{
+					{Match: "CN alice", Action: config.Action{Action: config.ACTION_FORWARD, ToAddr: startTagServer(t, "alice")}},
+					{Match: "SAN bob@example.com AND ISSUER Clients CA", Action: config.Action{Action: config.ACTION_FORWARD, ToAddr: startTagServer(t, "bob")}},
+					{Match: "SPKI " + hex.EncodeToString(spki[:]), Action: config.Action{Action: config.ACTION_REJECT}},
+					{Match: `CN "R&D (AND Ops)"`, Action: config.Action{Action: config.ACTION_FORWARD, ToAddr: startTagServer(t, "ops")}},
+				},
+			},
+		},
+	}}, withAccessLog(accessLog))
+
+	for name, tc := range map[string]struct {
+		certs []tls.Certificate
+		tag   string
+	}{
+		"alice":          {[]tls.Certificate{alice}, "alice"},
+		"bob":            {[]tls.Certificate{bob}, "bob"},
+		"carol":          {[]tls.Certificate{carol}, ""},
+		"quoted CN":      {[]tls.Certificate{ops}, "ops"},
+		"untrusted":      {[]tls.Certificate{mallory}, ""},
+		"no certificate": {nil, ""},
+	} {
+		tag := readTag(t, address, &tls.Config{ServerName: "mtls.internal", RootCAs: serverPool, Certificates: tc.certs})
+		if tag != tc.tag {
+			t.Errorf("%s: expected %q, got %q", name, tc.tag, tag)
+		}
+	}
+
+	// routes without a match go to to_addr of the action
+	dave := issueClientCert(t, ca, "dave")
+	if tag := readTag(t, address, &tls.Config{ServerName: "mtls.internal", RootCAs: serverPool, Certificates: []tls.Certificate{dave}}); tag != "default" {
+		t.Errorf("dave: expected %q, got %q", "default", tag)
+	}
+	// a client could make the log ambiguous, or mess with the terminal reading it
+	eve := issueClientCert(t, ca, "eve\x1b[2J")
+	readTag(t, address, &tls.Config{ServerName: "mtls.internal", RootCAs: serverPool, Certificates: []tls.Certificate{eve}})
+
+	log := accessLog.String()
+	if strings.Contains(log, "\x1b") {
+		t.Errorf("access log should escape control characters:\n%q", log)
+	}
+	for _, expected := range []string{
+		"action=TERMINATE to=",
+		"client_cn=alice",
+		"client_san=bob@example.com",
+		"action=REJECT",
+		`client_issuer="CN=Clients CA"`,
+		"sni=mtls.internal",
+		`client_cn="eve\x1b[2J"`,
+	} {
+		if !strings.Contains(log, expected) {
+			t.Errorf("access log should contain %s:\n%s", expected, log)
+		}
+	}
+}
+
+func mustParse(t *testing.T, cert tls.Certificate) *x509.Certificate {
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return parsed
+}
+
+func TestClientCertProxyProtocol(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverPool := generateCert(t, dir, "mtls.internal")
+	ca, _ := generateCert(t, dir, "Clients CA")
+	alice := issueClientCert(t, ca, "alice", "alice@example.com")
+	spki := sha256.Sum256(mustParse(t, alice).RawSubjectPublicKeyInfo)
+
+	// an upstream reading the PROXY header, then writing the identity in it back
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header, err := proxyproto.Parse(conn)
+		if err != nil {
+			conn.Write([]byte(err.Error()))
+			return
+		}
+
+		identity := []string{header.Source.String()}
+		for _, tlv := range header.TLVs {
+			switch tlv.Type {
+			case proxyproto.TypeAuthority, proxyproto.TypeClientSAN, proxyproto.TypeClientSPKI:
+				identity = append(identity, string(tlv.Value))
+			case proxyproto.TypeSSL:
+				subTLVs, _ := proxyproto.ParseTLVs(tlv.Value[5:])
+				for _, sub := range subTLVs {
+					if sub.Type == proxyproto.SubtypeSSLCN {
+						identity = append(identity, string(sub.Value))
+					}
+				}
+			}
+		}
+		conn.Write([]byte(strings.Join(identity, " ")))
+	}()
+
+	address := startServer(t, config.ProtocolGroup{"TLS": config.Filter{
+		config.Rule("SNI mtls.internal"): config.Action{
+			Action:       config.ACTION_TERMINATE,
+			ToAddr:       listener.Addr().String(),
+			Certificates: []config.Certificate{serverCert},
+			ClientAuth:   &config.ClientAuth{CAFile: ca.CertFile, ProxyProtocol: true},
+		},
+	}})
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: "mtls.internal", RootCAs: serverPool, Certificates: []tls.Certificate{alice}})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reply, _ := io.ReadAll(conn)
+
+	expected := strings.Join([]string{conn.LocalAddr().String(), "mtls.internal", "alice", "alice@example.com", hex.EncodeToString(spki[:])}, " ")
+	if string(reply) != expected {
+		t.Errorf("expected %q, got %q", expected, reply)
+	}
+}
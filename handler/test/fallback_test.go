@@ -0,0 +1,82 @@
+package handler_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/handler"
+)
+
+func TestFallbackToDecoy(t *testing.T) {
+	decoy := startEchoServer(t)
+	address := startServer(t, config.ProtocolGroup{
+		"TLS":      config.Filter{"SNI ours.example.com": {Action: config.ACTION_REJECT}},
+		"FALLBACK": config.Filter{"FALLBACK": {Action: config.ACTION_FORWARD, ToAddr: decoy}},
+	})
+
+	// not TLS at all, forwarded byte-for-byte
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", address, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("GET / HTTP/1.1\r\nHost: probe\r\n\r\n")
+	conn.Write(msg)
+	reply := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != string(msg) {
+		t.Errorf("expected the probe echoed by the decoy, got %q, %v", reply, err)
+	}
+
+	// a ClientHello with an SNI that isn't ours, echoed back as is
+	echoed := make(chan bool, 1)
+	client, serverEnd := net.Pipe()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: "theirs.example.com", InsecureSkipVerify: true}).Handshake()
+	}()
+	go func() {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			echoed <- false
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		clientHello := make([]byte, 5)
+		io.ReadFull(serverEnd, clientHello)
+		rest := make([]byte, int(clientHello[3])<<8|int(clientHello[4]))
+		io.ReadFull(serverEnd, rest)
+		clientHello = append(clientHello, rest...)
+		conn.Write(clientHello)
+		reply := make([]byte, len(clientHello))
+		io.ReadFull(conn, reply)
+		echoed <- bytes.Equal(reply, clientHello)
+		serverEnd.Close()
+	}()
+	if !<-echoed {
+		t.Errorf("expected the ClientHello echoed by the decoy")
+	}
+}
+
+func TestForwardBeyondBufferSize(t *testing.T) {
+	address := startServer(t, testRule(config.Action{Action: config.ACTION_FORWARD, ToAddr: startEchoServer(t)}))
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", address, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// sent at once, filling the buffer before the protocol is identified
+	payload := append([]byte("test"), bytes.Repeat([]byte("x"), 4*handler.MAX_BUFFER_SIZE)...)
+	go conn.Write(payload)
+	reply := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, reply); err != nil || !bytes.Equal(reply, payload) {
+		t.Errorf("expected the payload echoed back: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package handler_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+)
+
+// startMirrorSink accepts a single connection and returns everything it receives.
+func startMirrorSink(t *testing.T) (string, <-chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start mirror sink: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestMirrorTCP(t *testing.T) {
+	sinkAddr, received := startMirrorSink(t)
+	address := startServer(t, testRule(config.Action{
+		Action: config.ACTION_FORWARD,
+		ToAddr: startEchoServer(t),
+		Mirror: &config.Mirror{Sink: config.MIRROR_SINK_TCP, To: sinkAddr},
+	}))
+	roundTrip(t, "tcp", address, len(hello))
+
+	// both directions of the echo
+	if data := <-received; string(data) != "test: hello passthrutest: hello passthru" {
+		t.Errorf("unexpected mirror: %q", data)
+	}
+}
+
+func TestMirrorFileMaxBytes(t *testing.T) {
+	dir := t.TempDir()
+	address := startServer(t, testRule(config.Action{
+		Action: config.ACTION_FORWARD,
+		ToAddr: startEchoServer(t),
+		Mirror: &config.Mirror{Sink: config.MIRROR_SINK_FILE, To: dir, MaxBytes: 4},
+	}))
+	roundTrip(t, "tcp", address, len(hello))
+
+	var files []string
+	waitFor(func() bool {
+		files, _ = filepath.Glob(filepath.Join(dir, "*.bin"))
+		return len(files) > 0
+	})
+	if len(files) != 1 {
+		t.Fatalf("expected a mirror file, got %v", files)
+	}
+	if data := waitForFile(files[0], func(data []byte) bool { return len(data) >= 8 }); string(data) != "testtest" {
+		t.Errorf("expected the first 4 bytes of each direction, got %q", data)
+	}
+}
+
+func TestMirrorPcap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirror.pcapng")
+	address := startServer(t, testRule(config.Action{
+		Action: config.ACTION_FORWARD,
+		ToAddr: startEchoServer(t),
+		Mirror: &config.Mirror{Sink: config.MIRROR_SINK_PCAP, To: path},
+	}))
+	roundTrip(t, "tcp", address, len(hello))
+	roundTrip(t, "tcp", address, len(hello))
+
+	data := waitForFile(path, func(data []byte) bool { return bytes.Count(data, []byte(hello)) >= 4 })
+	if !bytes.HasPrefix(data, []byte{0x0A, 0x0D, 0x0D, 0x0A}) {
+		t.Fatalf("expected a pcapng file, got %x", data)
+	}
+	if n := bytes.Count(data, []byte(hello)); n != 4 {
+		t.Errorf("expected both directions of both connections, got %d payloads", n)
+	}
+}
+
+func TestMirrorPcapDropped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirror.pcapng")
+	address := startServer(t, testRule(config.Action{
+		Action: config.ACTION_FORWARD,
+		ToAddr: startEchoServer(t),
+		Mirror: &config.Mirror{Sink: config.MIRROR_SINK_PCAP, To: path, QueueSize: 1024},
+	}))
+	roundTrip(t, "tcp", address, 1<<20)
+
+	// far more than the queue takes while the file is opened, the gap is told apart
+	data := waitForFile(path, func(data []byte) bool { return bytes.Contains(data, []byte("bytes dropped before this segment")) })
+	if !bytes.Contains(data, []byte("bytes dropped before this segment")) {
+		t.Errorf("expected a comment on the bytes dropped")
+	}
+}
+
+func TestMirrorSlowSink(t *testing.T) {
+	// a sink that never reads
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start mirror sink: %v", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	defer func() {
+		select {
+		case conn := <-accepted:
+			conn.Close()
+		default:
+		}
+	}()
+
+	address := startServer(t, testRule(config.Action{
+		Action: config.ACTION_FORWARD,
+		ToAddr: startEchoServer(t),
+		Mirror: &config.Mirror{Sink: config.MIRROR_SINK_TCP, To: listener.Addr().String(), QueueSize: 1024},
+	}))
+	// far more than the socket buffers of the sink can take, without waiting for the mirror
+	roundTrip(t, "tcp", address, 16<<20)
+}
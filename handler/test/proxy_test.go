@@ -0,0 +1,228 @@
+package handler_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/handler"
+)
+
+// serveProxy accepts connections and relays each to the destination returned by handshake.
+func serveProxy(t *testing.T, handshake func(conn net.Conn) (string, bool)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				target, ok := handshake(conn)
+				if !ok {
+					return
+				}
+				connDst, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer connDst.Close()
+				go io.Copy(connDst, conn)
+				io.Copy(conn, connDst)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// startSOCKS5Proxy starts a SOCKS5 proxy requiring the username and password if set.
+// It connects to the destination before replying, so the reply is sent right away.
+func startSOCKS5Proxy(t *testing.T, username, password string) string {
+	return serveProxy(t, func(conn net.Conn) (string, bool) {
+		r := bufio.NewReader(conn)
+		header := make([]byte, 2)
+		io.ReadFull(r, header)
+		methods := make([]byte, header[1])
+		io.ReadFull(r, methods)
+
+		if username == "" {
+			conn.Write([]byte{0x05, 0x00})
+		} else {
+			conn.Write([]byte{0x05, 0x02})
+			io.ReadFull(r, header)
+			user := make([]byte, header[1])
+			io.ReadFull(r, user)
+			l, _ := r.ReadByte()
+			pass := make([]byte, l)
+			io.ReadFull(r, pass)
+			if string(user) != username || string(pass) != password {
+				conn.Write([]byte{0x01, 0x01})
+				return "", false
+			}
+			conn.Write([]byte{0x01, 0x00})
+		}
+
+		req := make([]byte, 4)
+		io.ReadFull(r, req)
+		var host string
+		switch req[3] {
+		case 0x01:
+			ip := make([]byte, 4)
+			io.ReadFull(r, ip)
+			host = net.IP(ip).String()
+		case 0x03:
+			l, _ := r.ReadByte()
+			name := make([]byte, l)
+			io.ReadFull(r, name)
+			host = string(name)
+		default:
+			return "", false
+		}
+		port := make([]byte, 2)
+		io.ReadFull(r, port)
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+		return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), true
+	})
+}
+
+// startHTTPProxy starts an HTTP CONNECT proxy requiring basic authentication if set.
+func startHTTPProxy(t *testing.T, username, password string) string {
+	return serveProxy(t, func(conn net.Conn) (string, bool) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect {
+			return "", false
+		}
+		if username != "" {
+			expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+			if req.Header.Get("Proxy-Authorization") != expected {
+				conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+				return "", false
+			}
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		return req.Host, true
+	})
+}
+
+// expectClosed expects the server to close the connection without forwarding.
+func expectClosed(t *testing.T, address string) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", address, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("test: hello passthru"))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+}
+
+func TestForwardViaProxy(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	for name, via := range map[string]string{
+		"socks5":      "socks5://" + startSOCKS5Proxy(t, "", ""),
+		"socks5 auth": "socks5://user:pass@" + startSOCKS5Proxy(t, "user", "pass"),
+		"http":        "http://" + startHTTPProxy(t, "", ""),
+		"http auth":   "http://user:pass@" + startHTTPProxy(t, "user", "pass"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			roundTrip(t, "tcp", startServer(t, testRule(config.Action{Action: config.ACTION_FORWARD, ToAddr: echoAddr, Via: via})), len(hello))
+		})
+	}
+}
+
+func TestForwardViaProxyAuthFailed(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	for name, via := range map[string]string{
+		"socks5": "socks5://user:wrong@" + startSOCKS5Proxy(t, "user", "pass"),
+		"http":   "http://user:wrong@" + startHTTPProxy(t, "user", "pass"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			expectClosed(t, startServer(t, testRule(config.Action{Action: config.ACTION_FORWARD, ToAddr: echoAddr, Via: via})))
+		})
+	}
+}
+
+func TestForwardViaProxyTimeout(t *testing.T) {
+	// a proxy accepting connections and never answering
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start proxy: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn) // reading the handshake, never answering
+				conn.Close()
+			}()
+		}
+	}()
+
+	address := startServer(t, testRule(config.Action{Action: config.ACTION_FORWARD, ToAddr: "backend.invalid:443", Via: "socks5://" + listener.Addr().String()}))
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", address, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * handler.DEFAULT_TIMEOUT))
+	conn.Write([]byte("test: hello passthru"))
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Errorf("expected the connection to be closed once the dial timed out, still open")
+	} else if err == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+}
+
+// pipeDialer connects every dial to an in-memory echo server.
+type pipeDialer struct {
+	mutex     sync.Mutex
+	addresses []string
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mutex.Lock()
+	d.addresses = append(d.addresses, address)
+	d.mutex.Unlock()
+
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		io.Copy(server, server)
+	}()
+	return client, nil
+}
+
+func TestServerDialer(t *testing.T) {
+	d := &pipeDialer{}
+	address := startServer(t, testRule(config.Action{Action: config.ACTION_FORWARD, ToAddr: "backend.invalid:443"}), withDialer(d))
+	roundTrip(t, "tcp", address, len(hello))
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.addresses) != 1 || d.addresses[0] != "backend.invalid:443" {
+		t.Errorf("unexpected dials: %v", d.addresses)
+	}
+}
@@ -0,0 +1,99 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/handler"
+)
+
+func rateLimitHits(scope string) int64 {
+	hits := expvar.Get("passthru_rate_limit_hits").(*expvar.Map).Get(scope)
+	if hits == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(hits.String(), 10, 64)
+	return n
+}
+
+func TestRateLimitConn(t *testing.T) {
+	address := startServer(t, testRule(config.Action{
+		Action:    config.ACTION_FORWARD,
+		ToAddr:    startEchoServer(t),
+		RateLimit: &config.RateLimits{Conn: &config.RateLimit{Rate: 256 << 10, Burst: 32 << 10}},
+	}))
+	hits := rateLimitHits("conn")
+
+	start := time.Now()
+	roundTrip(t, "tcp", address, 160<<10) // 128 KiB beyond the burst, 0.5s each way
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("expected about 0.5s, took %v", elapsed)
+	}
+	if rateLimitHits("conn") == hits {
+		t.Errorf("expected the conn limit to be hit")
+	}
+}
+
+func TestRateLimitClient(t *testing.T) {
+	address := startServer(t, testRule(config.Action{
+		Action:    config.ACTION_FORWARD,
+		ToAddr:    startEchoServer(t),
+		RateLimit: &config.RateLimits{Client: &config.RateLimit{Rate: 128 << 10, Burst: 32 << 10}},
+	}))
+	hits := rateLimitHits("client")
+
+	// 96 KiB beyond the burst of the client together, 0.75s each way, instead of 0.25s alone
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			roundTrip(t, "tcp", address, 64<<10)
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond || elapsed > 4*time.Second {
+		t.Errorf("expected about 0.75s, took %v", elapsed)
+	}
+	if rateLimitHits("client") == hits {
+		t.Errorf("expected the client limit to be hit")
+	}
+}
+
+func TestRateLimitShutdown(t *testing.T) {
+	pm := newProtocolManager(t, testRule(config.Action{
+		Action:    config.ACTION_FORWARD,
+		ToAddr:    startEchoServer(t),
+		RateLimit: &config.RateLimits{Conn: &config.RateLimit{Rate: 1 << 10, Burst: 16 << 10}},
+	}))
+	server := handler.NewServer("127.0.0.1:0", pm, handler.SERVER_MODE_UNLIMITED)
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", server.Addrs()[0].String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	// 48 KiB beyond the burst, held back for 16s a chunk
+	go conn.Write(append([]byte("test"), bytes.Repeat([]byte("x"), 64<<10)...))
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if !waitFor(func() bool { return server.ActiveConns() == 0 }) {
+		t.Errorf("expected the connection waiting for its rate limit to be closed, got %d active", server.ActiveConns())
+	}
+}
@@ -0,0 +1,98 @@
+package handler_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/handler"
+)
+
+// rejected sends a matching request to the server, and reads with the timeout.
+func rejected(t *testing.T, address string, timeout time.Duration) (int, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", address, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	conn.Write([]byte("test: hello passthru"))
+	return conn.Read(make([]byte, 16))
+}
+
+func TestRejectModes(t *testing.T) {
+	_, err := rejected(t, startServer(t, testRule(config.Action{Action: config.ACTION_REJECT, RejectMode: config.REJECT_MODE_RST})), 5*time.Second)
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("rst: expected a reset, got %v", err)
+	}
+
+	_, err = rejected(t, startServer(t, testRule(config.Action{Action: config.ACTION_REJECT, RejectMode: config.REJECT_MODE_FIN})), 5*time.Second)
+	if err != io.EOF {
+		t.Errorf("fin: expected EOF, got %v", err)
+	}
+
+	_, err = rejected(t, startServer(t, testRule(config.Action{Action: config.ACTION_REJECT, RejectMode: config.REJECT_MODE_DROP})), 500*time.Millisecond)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("drop: expected the connection to be held, got %v", err)
+	}
+
+	_, err = rejected(t, startServer(t, testRule(config.Action{Action: config.ACTION_REJECT, RejectMode: config.REJECT_MODE_DROP, RejectTimeout: 1})), 5*time.Second)
+	if err != io.EOF {
+		t.Errorf("drop: expected EOF after the reject timeout, got %v", err)
+	}
+}
+
+func TestRejectTarpit(t *testing.T) {
+	interval := handler.TarpitInterval
+	handler.TarpitInterval = 100 * time.Millisecond
+	defer func() { handler.TarpitInterval = interval }()
+
+	n, err := rejected(t, startServer(t, testRule(config.Action{Action: config.ACTION_REJECT, RejectMode: config.REJECT_MODE_TARPIT})), 5*time.Second)
+	if err != nil || n != 1 {
+		t.Errorf("tarpit: expected a single byte, got %d bytes and %v", n, err)
+	}
+}
+
+func TestRejectMaxHeld(t *testing.T) {
+	address := startServer(t, testRule(config.Action{Action: config.ACTION_REJECT, RejectMode: config.REJECT_MODE_DROP, RejectMaxHeld: 1}))
+
+	held, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", address, err)
+	}
+	defer held.Close()
+	held.Write([]byte("test: hello passthru"))
+	time.Sleep(200 * time.Millisecond) // until the connection is held
+
+	// over the limit, closed right away
+	_, err = rejected(t, address, 5*time.Second)
+	if err != io.EOF {
+		t.Errorf("expected EOF over reject_max_held, got %v", err)
+	}
+
+	held.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = held.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("expected the first connection to be held, got %v", err)
+	}
+}
+
+func TestRejectHoldStopped(t *testing.T) {
+	server := handler.NewServer("127.0.0.1:0", newProtocolManager(t, testRule(config.Action{Action: config.ACTION_REJECT, RejectMode: config.REJECT_MODE_DROP})), handler.SERVER_MODE_UNLIMITED)
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	address := server.Addrs()[0].String()
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		server.Stop()
+	}()
+	if _, err := rejected(t, address, 5*time.Second); err != io.EOF {
+		t.Errorf("expected the held connection to be closed on stop, got %v", err)
+	}
+}
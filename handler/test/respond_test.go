@@ -0,0 +1,72 @@
+package handler_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+)
+
+// request sends the request and returns everything the server replies with before closing.
+func request(t *testing.T, address, req string) string {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", address, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatalf("failed to write to %s: %v", address, err)
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("failed to read from %s: %v", address, err)
+	}
+	return string(reply)
+}
+
+func TestRespond(t *testing.T) {
+	payloadFile := filepath.Join(t.TempDir(), "maintenance.http")
+	if err := os.WriteFile(payloadFile, []byte("HTTP/1.1 503 Service Unavailable\r\n\r\nfrom file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	address := startServer(t, config.ProtocolGroup{"HTTP": config.Filter{
+		"HOST example.com": {Action: config.ACTION_RESPOND, Payload: "hello"},
+		"CATCHALL":         {Action: config.ACTION_RESPOND, PayloadFile: payloadFile},
+	}})
+
+	if reply := request(t, address, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); reply != "hello" {
+		t.Errorf("unexpected reply: %q", reply)
+	}
+	if reply := request(t, address, "GET / HTTP/1.1\r\nHost: example.net\r\n\r\n"); reply != "HTTP/1.1 503 Service Unavailable\r\n\r\nfrom file" {
+		t.Errorf("unexpected reply: %q", reply)
+	}
+}
+
+func TestHTTPRedirect(t *testing.T) {
+	address := startServer(t, config.ProtocolGroup{"HTTP": config.Filter{
+		"HOST example.com": {Action: config.ACTION_HTTP_REDIRECT, RedirectCode: 308},
+		"CATCHALL":         {Action: config.ACTION_HTTP_REDIRECT},
+	}})
+
+	for req, want := range map[string]string{
+		"GET /a?b=c HTTP/1.1\r\nHost: example.com\r\n\r\n":     "HTTP/1.1 308 Permanent Redirect\r\nLocation: https://example.com/a?b=c\r\n",
+		"POST /login HTTP/1.1\r\nHost: example.net:80\r\n\r\n": "HTTP/1.1 301 Moved Permanently\r\nLocation: https://example.net/login\r\n",
+		"GET / HTTP/1.1\r\nHost: [::1]\r\n\r\n":                "HTTP/1.1 301 Moved Permanently\r\nLocation: https://[::1]/\r\n",
+		"GET / HTTP/1.0\r\n\r\n":                               "HTTP/1.1 400 Bad Request\r\n",
+	} {
+		reply := request(t, address, req)
+		if len(reply) < len(want) || reply[:len(want)] != want {
+			t.Errorf("unexpected reply to %q: %q", req, reply)
+		}
+	}
+	// no header injected into the redirect through the request target
+	if reply := request(t, address, "GET /a\nSet-Cookie:x HTTP/1.1\r\nHost: example.com\r\n\r\n"); strings.Contains(reply, "Set-Cookie") {
+		t.Errorf("unexpected reply: %q", reply)
+	}
+}
@@ -0,0 +1,368 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/handler"
+	"github.com/gaukas/passthru/protocol"
+	phttp "github.com/gaukas/passthru/protocol/http"
+	ptls "github.com/gaukas/passthru/protocol/tls"
+)
+
+// DummyProtocol matches connections starting with "test"
+type DummyProtocol struct {
+}
+
+func (p *DummyProtocol) Name() config.Protocol {
+	return config.Protocol("dummy")
+}
+
+func (p *DummyProtocol) Clone() protocol.Protocol {
+	return &DummyProtocol{}
+}
+
+func (p *DummyProtocol) ApplyRules(rules []config.Rule) error {
+	return nil
+}
+
+func (p *DummyProtocol) Identify(ctx context.Context, cBuf *protocol.ConnBuf) (config.Rule, error) {
+	buf := make([]byte, 4)
+	for ctx.Err() == nil {
+		err := cBuf.Peek(buf, 4)
+		if err == protocol.ErrNotEnoughData {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		} else if err != nil {
+			return config.Rule(""), err
+		}
+
+		if string(buf) == "test" {
+			return config.Rule("test"), nil
+		}
+		return config.Rule(""), errors.New("no match rules")
+	}
+	return config.Rule(""), ctx.Err()
+}
+
+// startEchoServer starts a server echoing everything back, and returns its address.
+func startEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start echo server: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// protocols are registered by newProtocolManager for the protocol group to identify connections with.
+var protocols = []protocol.Protocol{&DummyProtocol{}, &phttp.Protocol{}, &ptls.Protocol{}}
+
+// testRule is the protocol group taking the action for connections starting with "test".
+func testRule(action config.Action) config.ProtocolGroup {
+	return config.ProtocolGroup{
+		config.Protocol("dummy"): config.Filter{
+			config.Rule("test"): action,
+		},
+	}
+}
+
+// newProtocolManager imports the protocol group, with the protocols it has rules for.
+func newProtocolManager(t *testing.T, pg config.ProtocolGroup) *protocol.ProtocolManager {
+	pm := protocol.NewProtocolManager()
+	for _, p := range protocols {
+		if _, ok := pg[p.Name()]; ok {
+			pm.RegisterProtocol(p)
+		}
+	}
+	err := pm.ImportProtocolGroup(pg)
+	if err != nil {
+		t.Fatalf("Error importing protocol group: %s", err)
+	}
+	return pm
+}
+
+// serverOption configures a server started by startServer.
+type serverOption func(server *handler.Server)
+
+func withAccessLog(w io.Writer) serverOption {
+	return func(server *handler.Server) { server.SetAccessLog(w) }
+}
+
+func withDialer(d handler.Dialer) serverOption {
+	return func(server *handler.Server) { server.SetDialer(d) }
+}
+
+// startServer starts a server on a loopback port for the protocol group, stopped once the test is done,
+// and returns its address.
+func startServer(t *testing.T, pg config.ProtocolGroup, opts ...serverOption) string {
+	server := handler.NewServer("127.0.0.1:0", newProtocolManager(t, pg), handler.SERVER_MODE_UNLIMITED)
+	for _, opt := range opts {
+		opt(server)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(func() { server.Stop() })
+	return server.Addrs()[0].String()
+}
+
+// hello is what roundTrip sends, matching the test rule.
+const hello = "test: hello passthru"
+
+// roundTrip sends n bytes of hello repeated through the server and expects them echoed back.
+// Failures are reported with Errorf, so that it can be called from other goroutines.
+func roundTrip(t *testing.T, network, address string, n int) {
+	conn, err := net.DialTimeout(network, address, time.Second)
+	if err != nil {
+		t.Errorf("failed to dial %s %s: %v", network, address, err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	msg := bytes.Repeat([]byte(hello), n/len(hello)+1)[:n]
+	go conn.Write(msg)
+	reply := make([]byte, n)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		t.Errorf("failed to read from %s: %v", address, err)
+	} else if !bytes.Equal(reply, msg) {
+		t.Errorf("unexpected reply from %s", address)
+	}
+}
+
+// waitFor polls the condition for up to 5 seconds, as mirrors, captures and the end of
+// connections are asynchronous, and returns whether it was met.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+// waitForFile waits for the content of the file to meet the condition, and returns it.
+func waitForFile(path string, cond func(data []byte) bool) []byte {
+	var data []byte
+	waitFor(func() bool {
+		var err error
+		data, err = os.ReadFile(path)
+		return err == nil && cond(data)
+	})
+	return data
+}
+
+// TestServerHalfClose checks that the destination gets EOF once the client is done sending,
+// so that neither the destination nor the handler wait forever for a client that is gone.
+func TestServerHalfClose(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := io.ReadAll(conn) // until the client is done sending
+		received <- request
+	}()
+
+	address := startServer(t, testRule(config.Action{Action: config.ACTION_FORWARD, ToAddr: upstream.Addr().String()}))
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	conn.Write([]byte("test: hello passthru"))
+	conn.Close()
+
+	select {
+	case request := <-received:
+		if string(request) != "test: hello passthru" {
+			t.Errorf("unexpected request: %q", request)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("destination got no EOF after the client closed")
+	}
+}
+
+func TestServerMultipleListeners(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	pm := newProtocolManager(t, testRule(config.Action{Action: config.ACTION_FORWARD, ToAddr: echoAddr}))
+
+	socketPath := filepath.Join(t.TempDir(), "passthru.sock")
+	server := handler.NewServer("tcp4:127.0.0.1:0, tcp:127.0.0.1:0, unix:"+socketPath, pm, handler.SERVER_MODE_UNLIMITED)
+	err := server.Start()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	addrs := server.Addrs()
+	if len(addrs) != 3 {
+		t.Fatalf("expected 3 listeners, got %v", addrs)
+	}
+	for _, addr := range addrs {
+		roundTrip(t, addr.Network(), addr.String(), len(hello))
+	}
+
+	server.Stop()
+	server.Stop() // stopping twice is fine
+	_, err = net.DialTimeout("unix", socketPath, time.Second)
+	if err == nil {
+		t.Errorf("server should not accept connections after stopped")
+	}
+}
+
+func TestServerForwardToUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "upstream.sock")
+	upstream, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", socketPath, err)
+	}
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	address := startServer(t, testRule(config.Action{Action: config.ACTION_FORWARD, ToAddr: "unix:" + socketPath}))
+	roundTrip(t, "tcp", address, len(hello))
+}
+
+func TestServerInheritListener(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	pm := newProtocolManager(t, testRule(config.Action{Action: config.ACTION_FORWARD, ToAddr: echoAddr}))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	server := handler.NewServer("fd:https, tcp:127.0.0.1:0", pm, handler.SERVER_MODE_UNLIMITED)
+	server.Inherit(config.ListenAddr{Network: "fd", Address: "https"}, listener)
+	err = server.Start()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	addrs := server.Addrs()
+	if len(addrs) != 2 || addrs[0].String() != listener.Addr().String() {
+		t.Fatalf("expected the inherited listener and a new one, got %v", addrs)
+	}
+	for _, addr := range addrs {
+		roundTrip(t, addr.Network(), addr.String(), len(hello))
+	}
+
+	server = handler.NewServer("fd:missing", pm, handler.SERVER_MODE_UNLIMITED)
+	if err := server.Start(); err != handler.ErrNoInheritedListener {
+		t.Errorf("expected %v, got %v", handler.ErrNoInheritedListener, err)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	pm := newProtocolManager(t, testRule(config.Action{Action: config.ACTION_FORWARD, ToAddr: echoAddr}))
+	server := handler.NewServer("127.0.0.1:0", pm, handler.SERVER_MODE_UNLIMITED)
+	err := server.Start()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	addr := server.Addrs()[0].String()
+
+	// a connection being forwarded
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("test"))
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+
+	// drained once the client closes the connection
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		conn.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		t.Errorf("failed to shut down: %v", err)
+	}
+	if server.ActiveConns() != 0 {
+		t.Errorf("expected no active connections, got %d", server.ActiveConns())
+	}
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	if err == nil {
+		t.Errorf("server should not accept connections after shut down")
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	pm := newProtocolManager(t, testRule(config.Action{Action: config.ACTION_FORWARD, ToAddr: echoAddr}))
+	server := handler.NewServer("127.0.0.1:0", pm, handler.SERVER_MODE_UNLIMITED)
+	err := server.Start()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", server.Addrs()[0].String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("test"))
+	io.ReadFull(conn, make([]byte, 4))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// the remaining connection is closed
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+}
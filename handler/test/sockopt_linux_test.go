@@ -0,0 +1,152 @@
+//go:build linux
+
+package handler_test
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/handler"
+	"golang.org/x/sys/unix"
+)
+
+func getsockopt(t *testing.T, sc syscall.Conn, level, opt int) int {
+	c, err := sc.SyscallConn()
+	if err != nil {
+		t.Fatalf("failed to get raw conn: %v", err)
+	}
+	var value int
+	c.Control(func(fd uintptr) {
+		value, err = unix.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil {
+		t.Fatalf("failed to get socket option %d: %v", opt, err)
+	}
+	return value
+}
+
+func TestServerReusePort(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	pm := newProtocolManager(t, testRule(config.Action{Action: config.ACTION_FORWARD, ToAddr: echoAddr}))
+
+	noDelay := false
+	server := handler.NewServer("127.0.0.1:0", pm, handler.SERVER_MODE_UNLIMITED)
+	server.SetSocketOptions(config.SocketOptions{
+		ReusePort:     4,
+		KeepAlive:     10,
+		NoDelay:       &noDelay,
+		FastOpen:      true,
+		Backlog:       128,
+		ReceiveBuffer: 1 << 16,
+		SendBuffer:    1 << 16,
+	})
+	err := server.Start()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	addrs := server.Addrs()
+	if len(addrs) != 4 {
+		t.Fatalf("expected 4 listeners, got %v", addrs)
+	}
+	for _, addr := range addrs[1:] {
+		if addr.String() != addrs[0].String() {
+			t.Fatalf("listeners should share the same address, got %v", addrs)
+		}
+	}
+	listeners := server.Listeners()[config.ListenAddr{Network: "tcp", Address: "127.0.0.1:0"}]
+	if len(listeners) != 4 {
+		t.Fatalf("expected 4 listeners to hand over, got %v", listeners)
+	}
+	for _, listener := range listeners {
+		sc := listener.(syscall.Conn)
+		if getsockopt(t, sc, unix.SOL_SOCKET, unix.SO_REUSEPORT) != 1 {
+			t.Errorf("SO_REUSEPORT not set on %s", listener.Addr())
+		}
+		if getsockopt(t, sc, unix.IPPROTO_TCP, unix.TCP_FASTOPEN) == 0 {
+			t.Errorf("TCP_FASTOPEN not set on %s", listener.Addr())
+		}
+	}
+
+	for i := 0; i < 16; i++ {
+		roundTrip(t, "tcp", addrs[0].String(), len(hello))
+	}
+}
+
+func TestServerReusePortUnix(t *testing.T) {
+	pm := newProtocolManager(t, testRule(config.Action{Action: config.ACTION_REJECT}))
+	server := handler.NewServer("unix:"+t.TempDir()+"/passthru.sock", pm, handler.SERVER_MODE_UNLIMITED)
+	server.SetSocketOptions(config.SocketOptions{ReusePort: 4})
+	err := server.Start()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	if len(server.Addrs()) != 1 {
+		t.Errorf("expected a single unix listener, got %v", server.Addrs())
+	}
+}
+
+func TestServerReusePortHandOver(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	pm := newProtocolManager(t, testRule(config.Action{Action: config.ACTION_FORWARD, ToAddr: echoAddr}))
+
+	old := handler.NewServer("127.0.0.1:0", pm, handler.SERVER_MODE_UNLIMITED)
+	old.SetSocketOptions(config.SocketOptions{ReusePort: 3})
+	if err := old.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer old.Stop()
+
+	// the new server takes all listeners over instead of listening again
+	next := handler.NewServer("127.0.0.1:0", pm, handler.SERVER_MODE_UNLIMITED)
+	next.SetSocketOptions(config.SocketOptions{ReusePort: 3})
+	for listenAddr, group := range old.Listeners() {
+		for _, listener := range group {
+			next.Inherit(listenAddr, listener)
+		}
+	}
+	if err := next.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer next.Stop()
+
+	oldAddrs, nextAddrs := old.Addrs(), next.Addrs()
+	if len(nextAddrs) != 3 {
+		t.Fatalf("expected the 3 listeners handed over, got %v", nextAddrs)
+	}
+	for i := range nextAddrs {
+		if nextAddrs[i].String() != oldAddrs[i].String() {
+			t.Errorf("expected %s, got %s", oldAddrs[i], nextAddrs[i])
+		}
+	}
+	roundTrip(t, "tcp", nextAddrs[0].String(), len(hello))
+}
+
+func TestServerReusePortInheritedWithout(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	pm := newProtocolManager(t, testRule(config.Action{Action: config.ACTION_FORWARD, ToAddr: echoAddr}))
+
+	// like a systemd socket without ReusePort=yes
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	server := handler.NewServer("fd:https", pm, handler.SERVER_MODE_UNLIMITED)
+	server.SetSocketOptions(config.SocketOptions{ReusePort: 4})
+	server.Inherit(config.ListenAddr{Network: "fd", Address: "https"}, listener)
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	if addrs := server.Addrs(); len(addrs) != 1 || addrs[0].String() != listener.Addr().String() {
+		t.Fatalf("expected the inherited listener only, got %v", addrs)
+	}
+	roundTrip(t, "tcp", listener.Addr().String(), len(hello))
+}
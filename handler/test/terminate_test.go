@@ -0,0 +1,226 @@
+package handler_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+)
+
+// generateCert writes a self-signed certificate for the names to the directory,
+// and returns its files and a pool trusting it.
+func generateCert(t *testing.T, dir string, names ...string) (config.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	cert := config.Certificate{
+		CertFile: filepath.Join(dir, names[0]+".crt"),
+		KeyFile:  filepath.Join(dir, names[0]+".key"),
+	}
+	os.WriteFile(cert.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(cert.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	parsed, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return cert, pool
+}
+
+// startTLSEchoServer starts a TLS server echoing everything back, requiring a client certificate
+// trusted by clientCAs if set, and returns its address.
+func startTLSEchoServer(t *testing.T, cert config.Certificate, clientCAs *x509.CertPool) string {
+	certificate, err := tls.LoadX509KeyPair(cert.CertFile, cert.KeyFile)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	if clientCAs != nil {
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// tlsRoundTrip sends a message over TLS and expects it echoed back,
+// returning the certificate presented by the server.
+func tlsRoundTrip(t *testing.T, address string, tlsConfig *tls.Config) *x509.Certificate {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", address, tlsConfig)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", address, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	msg := []byte("hello passthru")
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	reply := make([]byte, len(msg))
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(reply) != string(msg) {
+		t.Fatalf("unexpected reply: %s", reply)
+	}
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestTerminate(t *testing.T) {
+	dir := t.TempDir()
+	certA, poolA := generateCert(t, dir, "a.internal")
+	certB, poolB := generateCert(t, dir, "b.internal", "*.b.internal")
+	echoAddr := startEchoServer(t)
+
+	address := startServer(t, config.ProtocolGroup{"TLS": config.Filter{
+		config.Rule("SNI a.internal OR SNI b.internal OR SNI x.b.internal"): config.Action{
+			Action:       config.ACTION_TERMINATE,
+			ToAddr:       echoAddr,
+			Certificates: []config.Certificate{certA, certB},
+		},
+		config.Rule("CATCHALL"): config.Action{Action: config.ACTION_REJECT},
+	}})
+
+	for serverName, pool := range map[string]*x509.CertPool{
+		"a.internal":   poolA,
+		"b.internal":   poolB,
+		"x.b.internal": poolB,
+	} {
+		cert := tlsRoundTrip(t, address, &tls.Config{ServerName: serverName, RootCAs: pool})
+		if cert.VerifyHostname(serverName) != nil {
+			t.Errorf("%s: unexpected certificate for %v", serverName, cert.DNSNames)
+		}
+	}
+}
+
+func TestTerminateUntrustedUpstream(t *testing.T) {
+	dir := t.TempDir()
+	cert, pool := generateCert(t, dir, "a.internal")
+	backendCert, _ := generateCert(t, dir, "backend.internal")
+
+	backendAddr := startTLSEchoServer(t, backendCert, nil) // not trusted by passthru
+
+	address := startServer(t, config.ProtocolGroup{"TLS": config.Filter{
+		config.Rule("SNI a.internal"): config.Action{
+			Action:       config.ACTION_TERMINATE,
+			ToAddr:       backendAddr,
+			Certificates: []config.Certificate{cert},
+			UpstreamTLS:  &config.UpstreamTLS{ServerName: "backend.internal"},
+		},
+	}})
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: "a.internal", RootCAs: pool})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("hello"))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Errorf("connection should be closed when the upstream is not trusted")
+	}
+}
+
+func TestTerminateHalfClose(t *testing.T) {
+	dir := t.TempDir()
+	cert, pool := generateCert(t, dir, "a.internal")
+
+	// the upstream is done sending first, but still reads what the client sends
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(hello))
+		conn.(*net.TCPConn).CloseWrite()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	address := startServer(t, config.ProtocolGroup{"TLS": config.Filter{
+		config.Rule("SNI a.internal"): config.Action{
+			Action:       config.ACTION_TERMINATE,
+			ToAddr:       listener.Addr().String(),
+			Certificates: []config.Certificate{cert},
+		},
+	}})
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: "a.internal", RootCAs: pool})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if reply, err := io.ReadAll(conn); err != nil || string(reply) != hello {
+		t.Fatalf("unexpected reply: %q, %v", reply, err)
+	}
+	conn.Write([]byte(hello))
+	conn.CloseWrite()
+
+	select {
+	case data := <-received:
+		if data != hello {
+			t.Errorf("upstream received %q after closing for writing, expected %q", data, hello)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("upstream didn't receive the end of the client stream")
+	}
+}
@@ -0,0 +1,82 @@
+package handler_test
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+)
+
+// expectTLSClosed expects the server to close the TLS connection without forwarding.
+func expectTLSClosed(t *testing.T, address string, tlsConfig *tls.Config) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", address, tlsConfig)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", address, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("hello"))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+}
+
+func TestTerminateUpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	edgeCert, edgePool := generateCert(t, dir, "a.internal")
+	backendCert, _ := generateCert(t, dir, "backend.internal")
+	proxyCert, proxyPool := generateCert(t, dir, "proxy.internal")
+	otherCert, _ := generateCert(t, dir, "other.internal")
+
+	backendAddr := startTLSEchoServer(t, backendCert, nil)
+	mtlsAddr := startTLSEchoServer(t, backendCert, proxyPool)
+
+	for name, tc := range map[string]struct {
+		toAddr      string
+		upstreamTLS config.UpstreamTLS
+		ok          bool
+	}{
+		"full":                {backendAddr, config.UpstreamTLS{ServerName: "backend.internal", CAFile: backendCert.CertFile}, true},
+		"wrong name":          {backendAddr, config.UpstreamTLS{ServerName: "wrong.internal", CAFile: backendCert.CertFile}, false},
+		"wrong CA":            {backendAddr, config.UpstreamTLS{ServerName: "backend.internal", CAFile: otherCert.CertFile}, false},
+		"ca_only":             {backendAddr, config.UpstreamTLS{ServerName: "wrong.internal", CAFile: backendCert.CertFile, Verify: config.VERIFY_CA_ONLY}, true},
+		"ca_only wrong CA":    {backendAddr, config.UpstreamTLS{CAFile: otherCert.CertFile, Verify: config.VERIFY_CA_ONLY}, false},
+		"none":                {backendAddr, config.UpstreamTLS{Verify: config.VERIFY_NONE}, true},
+		"mtls":                {mtlsAddr, config.UpstreamTLS{ServerName: "backend.internal", CAFile: backendCert.CertFile, ClientCertificate: &proxyCert}, true},
+		"mtls wrong cert":     {mtlsAddr, config.UpstreamTLS{ServerName: "backend.internal", CAFile: backendCert.CertFile, ClientCertificate: &otherCert}, false},
+		"mtls without a cert": {mtlsAddr, config.UpstreamTLS{ServerName: "backend.internal", CAFile: backendCert.CertFile}, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			upstreamTLS := tc.upstreamTLS
+			address := startServer(t, config.ProtocolGroup{"TLS": config.Filter{
+				config.Rule("SNI a.internal"): config.Action{
+					Action:       config.ACTION_TERMINATE,
+					ToAddr:       tc.toAddr,
+					Certificates: []config.Certificate{edgeCert},
+					UpstreamTLS:  &upstreamTLS,
+				},
+			}})
+			clientConfig := &tls.Config{ServerName: "a.internal", RootCAs: edgePool}
+			if tc.ok {
+				tlsRoundTrip(t, address, clientConfig)
+			} else {
+				expectTLSClosed(t, address, clientConfig)
+			}
+		})
+	}
+}
+
+func TestForwardUpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	backendCert, _ := generateCert(t, dir, "backend.internal")
+	backendAddr := startTLSEchoServer(t, backendCert, nil)
+
+	address := startServer(t, testRule(config.Action{
+		Action:      config.ACTION_FORWARD,
+		ToAddr:      backendAddr,
+		UpstreamTLS: &config.UpstreamTLS{ServerName: "backend.internal", CAFile: backendCert.CertFile},
+	}))
+	roundTrip(t, "tcp", address, len(hello))
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+var errNoPeerCertificate = errors.New("no certificate from the upstream")
+
+// upstreamTLS wraps the connection to the destination in TLS and completes the handshake.
+func (s *Server) upstreamTLS(connDst net.Conn, upstreamTLS *config.UpstreamTLS, toAddr string) (net.Conn, error) {
+	tlsConfig, err := s.clientTLSConfig(upstreamTLS, toAddr)
+	if err != nil {
+		logger.Errorf("Failed to load the TLS settings for %s: %v", toAddr, err)
+		return nil, err
+	}
+
+	tlsConn := tls.Client(connDst, tlsConfig)
+	ctxHandshake, cancel := context.WithTimeout(context.Background(), DEFAULT_TIMEOUT)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctxHandshake); err != nil {
+		logger.Errorf("TLS handshake with %s failed: %v", toAddr, err)
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// clientTLSConfig returns the tls.Config to connect to the destination. The CA bundle and
+// the client certificate are loaded once for all connections.
+func (s *Server) clientTLSConfig(upstreamTLS *config.UpstreamTLS, toAddr string) (*tls.Config, error) {
+	key := strings.Join([]string{"upstream", upstreamTLS.CAFile, upstreamTLS.Verify}, "\x00")
+	if c := upstreamTLS.ClientCertificate; c != nil {
+		key += "\x00" + c.CertFile + "\x00" + c.KeyFile
+	}
+
+	var base *tls.Config
+	if cached, ok := s.tlsConfigs.Load(key); ok {
+		base = cached.(*tls.Config)
+	} else {
+		var err error
+		base, err = loadClientTLSConfig(upstreamTLS)
+		if err != nil {
+			return nil, err
+		}
+		s.tlsConfigs.Store(key, base)
+	}
+
+	tlsConfig := base.Clone()
+	tlsConfig.ServerName = upstreamTLS.ServerName
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(toAddr)
+	}
+	return tlsConfig, nil
+}
+
+func loadClientTLSConfig(upstreamTLS *config.UpstreamTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if upstreamTLS.CAFile != "" {
+		pool, err := loadCertPool(upstreamTLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c := upstreamTLS.ClientCertificate; c != nil {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	switch upstreamTLS.Verify {
+	case config.VERIFY_CA_ONLY:
+		// verify the chain as usual, except for the server name
+		roots := tlsConfig.RootCAs
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errNoPeerCertificate
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			return err
+		}
+	case config.VERIFY_NONE:
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
+// loadCertPool loads the certificates in a PEM bundle.
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", filename)
+	}
+	return pool, nil
+}
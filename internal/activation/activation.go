@@ -0,0 +1,84 @@
+package activation
+
+import (
+	"net"
+
+	"github.com/gaukas/passthru/config"
+)
+
+// Socket activation as described in sd_listen_fds(3): the service manager passes
+// LISTEN_FDS sockets starting from fd 3, named by LISTEN_FDNAMES, to the process LISTEN_PID.
+
+var (
+	// ListenFdsStart is the first file descriptor passed, SD_LISTEN_FDS_START.
+	ListenFdsStart = 3
+)
+
+// Listener is a listener passed by the service manager with its FileDescriptorName.
+type Listener struct {
+	Name string
+	net.Listener
+}
+
+// Name returns the name of the listener for the address in the config, which Find matches.
+func Name(listenAddr config.ListenAddr) string {
+	if listenAddr.Network == "fd" {
+		return listenAddr.Address
+	}
+	return listenAddr.String()
+}
+
+// Find returns the listener for the address in the config, or nil if there is none.
+// An "fd:<name>" address matches the listener by its name, other addresses by their Name
+// or the local address of the listener, where 0.0.0.0 and [::] are considered the same.
+func Find(listeners []Listener, listenAddr config.ListenAddr) net.Listener {
+	if found := FindAll(listeners, listenAddr); len(found) > 0 {
+		return found[0]
+	}
+	return nil
+}
+
+// FindAll returns all listeners for the address in the config, matched like Find does,
+// e.g. the listeners sharing a port with SO_REUSEPORT handed over in an upgrade.
+func FindAll(listeners []Listener, listenAddr config.ListenAddr) []net.Listener {
+	found := []net.Listener{}
+	for _, l := range listeners {
+		if l.Name == Name(listenAddr) {
+			found = append(found, l.Listener)
+		}
+	}
+	if len(found) > 0 || listenAddr.Network == "fd" {
+		return found
+	}
+	for _, l := range listeners {
+		if sameAddr(l.Addr(), listenAddr) {
+			found = append(found, l.Listener)
+		}
+	}
+	return found
+}
+
+func sameAddr(addr net.Addr, listenAddr config.ListenAddr) bool {
+	switch addr := addr.(type) {
+	case *net.UnixAddr:
+		return listenAddr.Network == "unix" && addr.Name == listenAddr.Address
+	case *net.TCPAddr:
+		if listenAddr.Network == "unix" {
+			return false
+		}
+		want, err := net.ResolveTCPAddr(listenAddr.Network, listenAddr.Address)
+		if err != nil || want.Port != addr.Port {
+			return false
+		}
+		if isUnspecified(want.IP) || isUnspecified(addr.IP) {
+			return isUnspecified(want.IP) && isUnspecified(addr.IP)
+		}
+		return want.IP.Equal(addr.IP)
+	default:
+		return false
+	}
+}
+
+func isUnspecified(ip net.IP) bool {
+	return ip == nil || ip.IsUnspecified()
+}
@@ -0,0 +1,8 @@
+//go:build !aix && !android && !darwin && !dragonfly && !freebsd && !hurd && !illumos && !ios && !linux && !netbsd && !openbsd && !solaris
+
+package activation
+
+// Listeners returns no listener, as socket activation is only supported on unix.
+func Listeners() ([]Listener, error) {
+	return nil, nil
+}
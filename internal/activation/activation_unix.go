@@ -0,0 +1,66 @@
+//go:build aix || android || darwin || dragonfly || freebsd || hurd || illumos || ios || linux || netbsd || openbsd || solaris
+
+package activation
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+// Listeners returns the listeners passed via socket activation, if any,
+// and unsets the environment variables so they won't be inherited by child processes.
+func Listeners() ([]Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil // not for us
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	fds := make([]uintptr, 0, nfds)
+	for i := 0; i < nfds; i++ {
+		fds = append(fds, uintptr(ListenFdsStart+i))
+	}
+	return FileListeners(fds, names)
+}
+
+// FileListeners creates listeners from already-open file descriptors, which are closed afterwards.
+// names[i] names fds[i], and the name defaults to "unknown" like systemd does.
+func FileListeners(fds []uintptr, names []string) ([]Listener, error) {
+	listeners := []Listener{}
+	for i, fd := range fds {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		syscall.CloseOnExec(int(fd))
+		f := os.NewFile(fd, name)
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("fd %d (%s) is not a listening socket: %w", fd, name, err)
+		}
+		logger.Infof("Inherited listener %s on %s", name, listener.Addr())
+		listeners = append(listeners, Listener{Name: name, Listener: listener})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,160 @@
+//go:build aix || android || darwin || dragonfly || freebsd || hurd || illumos || ios || linux || netbsd || openbsd || solaris
+
+package activation_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/internal/activation"
+)
+
+// listenerFd returns a duplicate file descriptor of a new listener, as if passed by systemd.
+func listenerFd(t *testing.T, network, address string) (uintptr, net.Addr) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("failed to listen on %s %s: %v", network, address, err)
+	}
+	defer listener.Close()
+
+	var f *os.File
+	switch l := listener.(type) {
+	case *net.TCPListener:
+		f, err = l.File()
+	case *net.UnixListener:
+		l.SetUnlinkOnClose(false)
+		f, err = l.File()
+	}
+	if err != nil {
+		t.Fatalf("failed to get the file of the listener: %v", err)
+	}
+	defer f.Close()
+
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("failed to dup: %v", err)
+	}
+	return uintptr(fd), listener.Addr()
+}
+
+func TestListeners(t *testing.T) {
+	fd, addr := listenerFd(t, "tcp", "127.0.0.1:0")
+
+	activation.ListenFdsStart = int(fd)
+	defer func() { activation.ListenFdsStart = 3 }()
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "https")
+
+	listeners, err := activation.Listeners()
+	if err != nil {
+		t.Fatalf("failed to get listeners: %v", err)
+	}
+	if len(listeners) != 1 {
+		t.Fatalf("expected 1 listener, got %d", len(listeners))
+	}
+	defer listeners[0].Close()
+	if listeners[0].Name != "https" || listeners[0].Addr().String() != addr.String() {
+		t.Errorf("unexpected listener %s on %s", listeners[0].Name, listeners[0].Addr())
+	}
+
+	// accepts connections
+	go func() {
+		conn, err := net.Dial("tcp", addr.String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := listeners[0].Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	conn.Close()
+
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("environment variables should be unset")
+	}
+}
+
+func TestListenersNotForUs(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+
+	listeners, err := activation.Listeners()
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("expected no listeners, got %v, %v", listeners, err)
+	}
+}
+
+func TestFind(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "passthru.sock")
+	fdTCP, addrTCP := listenerFd(t, "tcp", "127.0.0.1:0")
+	fdAny, addrAny := listenerFd(t, "tcp", ":0")
+	fdUnix, _ := listenerFd(t, "unix", socketPath)
+
+	listeners, err := activation.FileListeners([]uintptr{fdTCP, fdAny, fdUnix}, []string{"https", "", "local"})
+	if err != nil {
+		t.Fatalf("failed to create listeners: %v", err)
+	}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	if listeners[1].Name != "unknown" {
+		t.Errorf("unnamed listener should be named unknown, got %s", listeners[1].Name)
+	}
+
+	_, portAny, _ := net.SplitHostPort(addrAny.String())
+	for _, tc := range []struct {
+		listenAddr config.ListenAddr
+		expected   net.Listener
+	}{
+		{config.ListenAddr{Network: "fd", Address: "https"}, listeners[0]},
+		{config.ListenAddr{Network: "fd", Address: "local"}, listeners[2]},
+		{config.ListenAddr{Network: "fd", Address: "missing"}, nil},
+		{config.ListenAddr{Network: "tcp", Address: addrTCP.String()}, listeners[0]},
+		{config.ListenAddr{Network: "tcp4", Address: "0.0.0.0:" + portAny}, listeners[1]},
+		{config.ListenAddr{Network: "tcp", Address: "[::]:" + portAny}, listeners[1]},
+		{config.ListenAddr{Network: "tcp", Address: "127.0.0.1:" + portAny}, nil},
+		{config.ListenAddr{Network: "unix", Address: socketPath}, listeners[2]},
+	} {
+		var expected net.Listener
+		if tc.expected != nil {
+			expected = tc.expected.(activation.Listener).Listener
+		}
+		if found := activation.Find(listeners, tc.listenAddr); found != expected {
+			t.Errorf("%s: expected %v, got %v", tc.listenAddr, expected, found)
+		}
+	}
+}
+
+func TestFindAll(t *testing.T) {
+	fdFirst, addr := listenerFd(t, "tcp", "127.0.0.1:0")
+	fdSecond, _ := listenerFd(t, "tcp", "127.0.0.1:0")
+
+	// e.g. the listeners with SO_REUSEPORT of an address, handed over in an upgrade
+	listeners, err := activation.FileListeners([]uintptr{fdFirst, fdSecond}, []string{"tcp:127.0.0.1:443", "tcp:127.0.0.1:443"})
+	if err != nil {
+		t.Fatalf("failed to create listeners: %v", err)
+	}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	found := activation.FindAll(listeners, config.ListenAddr{Network: "tcp", Address: "127.0.0.1:443"})
+	if len(found) != 2 || found[0] != listeners[0].Listener || found[1] != listeners[1].Listener {
+		t.Errorf("expected both listeners, got %v", found)
+	}
+	found = activation.FindAll(listeners, config.ListenAddr{Network: "tcp", Address: addr.String()})
+	if len(found) != 1 || found[0] != listeners[0].Listener {
+		t.Errorf("expected the listener on %s, got %v", addr, found)
+	}
+}
@@ -0,0 +1,111 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// pcapng as described in https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+// A single section with a single interface of raw IP packets, in the byte order of the host
+// that wrote it, which readers detect by the byte-order magic.
+
+const (
+	blockSectionHeader        uint32 = 0x0A0D0D0A
+	blockInterfaceDescription uint32 = 0x00000001
+	blockEnhancedPacket       uint32 = 0x00000006
+
+	byteOrderMagic uint32 = 0x1A2B3C4D
+
+	linkTypeRaw uint16 = 101 // IPv4 or IPv6, without a link-layer header
+
+	optEndOfOpt uint16 = 0
+	optComment  uint16 = 1
+)
+
+var order = binary.LittleEndian
+
+// Writer writes packets to a pcapng file. It is safe for concurrent use.
+type Writer struct {
+	mu      sync.Mutex
+	w       io.Writer
+	written int64
+}
+
+// NewWriter writes the section header, with the comment if not empty, and the interface of
+// the packets to w, and returns the Writer to write the packets with.
+func NewWriter(w io.Writer, comment string) (*Writer, error) {
+	pw := &Writer{w: w}
+
+	shb := make([]byte, 16)
+	order.PutUint32(shb[0:], byteOrderMagic)
+	order.PutUint16(shb[4:], 1)                  // major version
+	order.PutUint16(shb[6:], 0)                  // minor version
+	order.PutUint64(shb[8:], 0xFFFFFFFFFFFFFFFF) // section length unknown
+	if err := pw.writeBlock(blockSectionHeader, shb, comment); err != nil {
+		return nil, err
+	}
+
+	idb := make([]byte, 8)
+	order.PutUint16(idb[0:], linkTypeRaw)
+	order.PutUint32(idb[4:], 0) // no snapshot length
+	if err := pw.writeBlock(blockInterfaceDescription, idb, ""); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// WritePacket writes an IP packet captured at t, with the comment if not empty.
+func (pw *Writer) WritePacket(t time.Time, packet []byte, comment string) error {
+	micros := uint64(t.UnixNano() / 1000) // the default resolution of an interface
+	epb := make([]byte, 20, 20+len(packet)+3)
+	order.PutUint32(epb[0:], 0) // interface
+	order.PutUint32(epb[4:], uint32(micros>>32))
+	order.PutUint32(epb[8:], uint32(micros))
+	order.PutUint32(epb[12:], uint32(len(packet)))
+	order.PutUint32(epb[16:], uint32(len(packet)))
+	epb = append(epb, packet...)
+	epb = append(epb, make([]byte, pad(len(packet)))...)
+	return pw.writeBlock(blockEnhancedPacket, epb, comment)
+}
+
+// Written returns the number of bytes written so far.
+func (pw *Writer) Written() int64 {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.written
+}
+
+func (pw *Writer) writeBlock(blockType uint32, body []byte, comment string) error {
+	var options []byte
+	if len(comment) > 0xFFFF {
+		comment = comment[:0xFFFF]
+	}
+	if comment != "" {
+		options = make([]byte, 4, 4+len(comment)+3+4)
+		order.PutUint16(options[0:], optComment)
+		order.PutUint16(options[2:], uint16(len(comment)))
+		options = append(options, comment...)
+		options = append(options, make([]byte, pad(len(comment)))...)
+		options = append(options, 0, 0, 0, 0) // optEndOfOpt
+	}
+
+	total := 12 + len(body) + len(options)
+	block := make([]byte, 8, total)
+	order.PutUint32(block[0:], blockType)
+	order.PutUint32(block[4:], uint32(total))
+	block = append(block, body...)
+	block = append(block, options...)
+	block = append(block, block[4:8]...) // the total length again
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	n, err := pw.w.Write(block)
+	pw.written += int64(n)
+	return err
+}
+
+func pad(n int) int {
+	return (4 - n%4) % 4
+}
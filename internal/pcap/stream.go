@@ -0,0 +1,181 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// A Stream is a synthetic TCP connection between a client and a server, written to the pcapng
+// file as if it were captured, for the payload relayed in both directions to be followed by
+// any reader of pcap files. The handshake, sequence numbers and checksums are made up.
+
+const (
+	tcpFIN byte = 0x01
+	tcpSYN byte = 0x02
+	tcpPSH byte = 0x08
+	tcpACK byte = 0x10
+
+	// MaxSegmentSize bounds the payload of a single packet.
+	MaxSegmentSize = 16384
+)
+
+// Direction of the payload in a Stream.
+type Direction uint8
+
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+type Stream struct {
+	w       *Writer
+	client  *net.TCPAddr
+	server  *net.TCPAddr
+	seq     [2]uint32 // next sequence number of the client and the server
+	skipped [2]int64  // bytes skipped since the last segment of the client and the server
+}
+
+// NewStream writes the handshake of a TCP connection from client to server at t.
+// Addresses other than TCP ones, like Unix sockets, are replaced with loopback addresses.
+func (pw *Writer) NewStream(client, server net.Addr, t time.Time) (*Stream, error) {
+	s := &Stream{
+		w:      pw,
+		client: tcpAddr(client, net.IPv4(127, 0, 0, 1), 40000),
+		server: tcpAddr(server, net.IPv4(127, 0, 0, 2), 443),
+		seq:    [2]uint32{1000, 2000},
+	}
+	if (s.client.IP.To4() == nil) != (s.server.IP.To4() == nil) { // mixed families
+		s.client.IP, s.server.IP = s.client.IP.To16(), s.server.IP.To16()
+	}
+
+	if err := s.writeSegment(ClientToServer, tcpSYN, nil, t); err != nil {
+		return nil, err
+	}
+	s.seq[ClientToServer]++
+	if err := s.writeSegment(ServerToClient, tcpSYN|tcpACK, nil, t); err != nil {
+		return nil, err
+	}
+	s.seq[ServerToClient]++
+	if err := s.writeSegment(ClientToServer, tcpACK, nil, t); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write writes the payload sent in the direction at t, in segments of at most MaxSegmentSize.
+func (s *Stream) Write(dir Direction, payload []byte, t time.Time) error {
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > MaxSegmentSize {
+			n = MaxSegmentSize
+		}
+		if err := s.writeSegment(dir, tcpPSH|tcpACK, payload[:n], t); err != nil {
+			return err
+		}
+		s.seq[dir] += uint32(n)
+		payload = payload[n:]
+	}
+	return nil
+}
+
+// Skip leaves a gap of n bytes not captured in the direction, like a capture dropping packets,
+// so readers see the missing bytes instead of the payload around them joined together.
+// The next segment of the direction has a comment with the number of bytes dropped.
+func (s *Stream) Skip(dir Direction, n int64) {
+	s.seq[dir] += uint32(n)
+	s.skipped[dir] += n
+}
+
+// Close writes the FIN of the direction at t.
+func (s *Stream) Close(dir Direction, t time.Time) error {
+	err := s.writeSegment(dir, tcpFIN|tcpACK, nil, t)
+	s.seq[dir]++
+	return err
+}
+
+func (s *Stream) writeSegment(dir Direction, flags byte, payload []byte, t time.Time) error {
+	src, dst := s.client, s.server
+	if dir == ServerToClient {
+		src, dst = s.server, s.client
+	}
+	ack := uint32(0)
+	if flags&tcpACK != 0 {
+		ack = s.seq[1-dir]
+	}
+
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], s.seq[dir])
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // data offset, no options
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	tcp = append(tcp, payload...)
+
+	var packet []byte
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		ip := make([]byte, 20, 20+len(tcp))
+		ip[0] = 0x45 // version 4, 5 words
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+		ip[8] = 64                                 // TTL
+		ip[9] = 6                                  // TCP
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(pseudoHeaderSum(src4, dst4, len(tcp)), tcp))
+		packet = append(ip, tcp...)
+	} else {
+		ip := make([]byte, 40, 40+len(tcp))
+		ip[0] = 0x60 // version 6
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6  // TCP
+		ip[7] = 64 // hop limit
+		copy(ip[8:], src.IP.To16())
+		copy(ip[24:], dst.IP.To16())
+		binary.BigEndian.PutUint16(tcp[16:], checksum(pseudoHeaderSum(src.IP.To16(), dst.IP.To16(), len(tcp)), tcp))
+		packet = append(ip, tcp...)
+	}
+	comment := ""
+	if s.skipped[dir] > 0 {
+		comment = fmt.Sprintf("%d bytes dropped before this segment", s.skipped[dir])
+		s.skipped[dir] = 0
+	}
+	return s.w.WritePacket(t, packet, comment)
+}
+
+func tcpAddr(addr net.Addr, ip net.IP, port int) *net.TCPAddr {
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP != nil {
+		return &net.TCPAddr{IP: tcp.IP, Port: tcp.Port}
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// pseudoHeaderSum sums the pseudo header of TCP, which is the same for IPv4 and IPv6
+// except for the length of the addresses.
+func pseudoHeaderSum(src, dst net.IP, length int) uint32 {
+	sum := uint32(0)
+	for _, addr := range [][]byte{src, dst} {
+		for i := 0; i < len(addr); i += 2 {
+			sum += uint32(addr[i])<<8 | uint32(addr[i+1])
+		}
+	}
+	return sum + 6 + uint32(length)
+}
+
+// checksum is the internet checksum of RFC 1071 of data, starting from sum.
+func checksum(sum uint32, data []byte) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,154 @@
+package pcap_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/internal/pcap"
+)
+
+type block struct {
+	blockType uint32
+	body      []byte
+}
+
+// readBlocks splits a pcapng file into its blocks, checking both lengths of each.
+func readBlocks(t *testing.T, data []byte) []block {
+	blocks := []block{}
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block: %x", data)
+		}
+		total := int(binary.LittleEndian.Uint32(data[4:]))
+		if total%4 != 0 || total > len(data) || binary.LittleEndian.Uint32(data[total-4:]) != uint32(total) {
+			t.Fatalf("bad block length %d", total)
+		}
+		blocks = append(blocks, block{binary.LittleEndian.Uint32(data), data[8 : total-4]})
+		data = data[total:]
+	}
+	return blocks
+}
+
+// sum16 is the one's complement sum, which is 0xFFFF over data with a valid checksum.
+func sum16(sum uint32, data []byte) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return uint16(sum)
+}
+
+func TestStream(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := pcap.NewWriter(buf, "rule SNI example.com")
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51234}
+	server := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+	now := time.Now()
+	s, err := w.NewStream(client, server, now)
+	if err != nil {
+		t.Fatalf("failed to create stream: %v", err)
+	}
+	s.Write(pcap.ClientToServer, []byte("hello"), now)
+	s.Write(pcap.ServerToClient, bytes.Repeat([]byte("x"), pcap.MaxSegmentSize+1), now)
+	s.Close(pcap.ClientToServer, now)
+	s.Close(pcap.ServerToClient, now)
+
+	if w.Written() != int64(buf.Len()) {
+		t.Errorf("expected %d bytes written, got %d", buf.Len(), w.Written())
+	}
+
+	blocks := readBlocks(t, buf.Bytes())
+	if len(blocks) != 2+3+1+2+2 {
+		t.Fatalf("expected 10 blocks, got %d", len(blocks))
+	}
+	if blocks[0].blockType != 0x0A0D0D0A || !bytes.Contains(blocks[0].body, []byte("rule SNI example.com")) {
+		t.Errorf("expected a section header with the comment")
+	}
+	if blocks[1].blockType != 1 || binary.LittleEndian.Uint16(blocks[1].body) != 101 {
+		t.Errorf("expected an interface of raw IP packets")
+	}
+
+	payloads := map[uint16][]byte{} // by source port
+	flags := []byte{}
+	for _, b := range blocks[2:] {
+		if b.blockType != 6 {
+			t.Fatalf("expected an enhanced packet block, got %d", b.blockType)
+		}
+		packet := b.body[20 : 20+binary.LittleEndian.Uint32(b.body[12:])]
+		ip, tcp := packet[:20], packet[20:]
+		if ip[0] != 0x45 || int(binary.BigEndian.Uint16(ip[2:])) != len(packet) || sum16(0, ip) != 0xFFFF {
+			t.Errorf("bad IPv4 header: %x", ip)
+		}
+		pseudo := append(append([]byte{}, ip[12:20]...), 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+		if sum16(uint32(sum16(0, pseudo)), tcp) != 0xFFFF {
+			t.Errorf("bad TCP checksum")
+		}
+		src := binary.BigEndian.Uint16(tcp)
+		payloads[src] = append(payloads[src], tcp[20:]...)
+		flags = append(flags, tcp[13])
+	}
+	if string(payloads[51234]) != "hello" || len(payloads[443]) != pcap.MaxSegmentSize+1 {
+		t.Errorf("unexpected payloads: %d and %d bytes", len(payloads[51234]), len(payloads[443]))
+	}
+	if flags[0] != 0x02 || flags[1] != 0x12 || flags[len(flags)-1] != 0x11 {
+		t.Errorf("unexpected flags: %x", flags)
+	}
+}
+
+func TestStreamSkip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := pcap.NewWriter(buf, "")
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	now := time.Now()
+	s, err := w.NewStream(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51234}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}, now)
+	if err != nil {
+		t.Fatalf("failed to create stream: %v", err)
+	}
+	s.Write(pcap.ClientToServer, []byte("hello"), now)
+	s.Skip(pcap.ClientToServer, 100)
+	s.Write(pcap.ClientToServer, []byte("world"), now)
+
+	blocks := readBlocks(t, buf.Bytes())
+	seq := func(b block) uint32 {
+		return binary.BigEndian.Uint32(b.body[20+20+4:])
+	}
+	hello, world := blocks[len(blocks)-2], blocks[len(blocks)-1]
+	if seq(world) != seq(hello)+5+100 {
+		t.Errorf("expected a gap of 100 bytes, got %d", seq(world)-seq(hello)-5)
+	}
+	if bytes.Contains(hello.body, []byte("dropped")) || !bytes.Contains(world.body, []byte("100 bytes dropped before this segment")) {
+		t.Errorf("expected a comment on the segment after the gap only")
+	}
+}
+
+func TestStreamUnix(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := pcap.NewWriter(buf, "")
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	client := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234}
+	server := &net.UnixAddr{Name: "/run/passthru.sock", Net: "unix"}
+	if _, err := w.NewStream(client, server, time.Now()); err != nil {
+		t.Fatalf("failed to create stream: %v", err)
+	}
+	for _, b := range readBlocks(t, buf.Bytes())[2:] {
+		if b.body[20]>>4 != 6 {
+			t.Errorf("expected IPv6 packets for mixed addresses")
+		}
+	}
+}
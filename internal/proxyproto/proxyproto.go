@@ -0,0 +1,163 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// PROXY protocol version 2, as described in https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+// Only the PROXY command over TCP is produced, with the TLVs set by the caller.
+
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	versionCommand byte = 0x21 // version 2, PROXY
+
+	familyUnspec byte = 0x00
+	familyTCP4   byte = 0x11
+	familyTCP6   byte = 0x21
+
+	headerLen = 16
+)
+
+// Types of TLVs
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02 // the host name requested by the client, i.e. the SNI
+	TypeSSL       byte = 0x20
+
+	SubtypeSSLVersion byte = 0x21
+	SubtypeSSLCN      byte = 0x22
+	SubtypeSSLCipher  byte = 0x23
+
+	// Custom types, in the range 0xE0-0xEF reserved for applications
+	TypeClientSAN    byte = 0xE0 // comma-separated subject alternative names of the client certificate
+	TypeClientIssuer byte = 0xE1 // issuer of the client certificate
+	TypeClientSPKI   byte = 0xE2 // hex SHA-256 of the subject public key info of the client certificate
+)
+
+// Client flags of TypeSSL
+const (
+	ClientSSL      byte = 0x01
+	ClientCertConn byte = 0x02
+	ClientCertSess byte = 0x04
+)
+
+var ErrInvalidHeader = errors.New("invalid PROXY v2 header")
+
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is a PROXY v2 header for a connection from Source to Destination.
+type Header struct {
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []TLV
+}
+
+// SSLValue builds the value of a TypeSSL TLV with the sub-TLVs.
+func SSLValue(client byte, verified bool, subTLVs []TLV) []byte {
+	value := []byte{client, 0, 0, 0, 0}
+	if !verified {
+		binary.BigEndian.PutUint32(value[1:], 1)
+	}
+	return append(value, marshalTLVs(subTLVs)...)
+}
+
+// Marshal encodes the header. Addresses other than TCP are sent as UNSPEC.
+func (h *Header) Marshal() []byte {
+	family, addrs := familyUnspec, []byte{}
+	src, okSrc := h.Source.(*net.TCPAddr)
+	dst, okDst := h.Destination.(*net.TCPAddr)
+	if okSrc && okDst {
+		if src.IP.To4() != nil && dst.IP.To4() != nil {
+			family = familyTCP4
+			addrs = append(addrs, src.IP.To4()...)
+			addrs = append(addrs, dst.IP.To4()...)
+		} else {
+			family = familyTCP6
+			addrs = append(addrs, src.IP.To16()...)
+			addrs = append(addrs, dst.IP.To16()...)
+		}
+		addrs = append(addrs, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	}
+
+	payload := append(addrs, marshalTLVs(h.TLVs)...)
+	header := append([]byte{}, signature...)
+	header = append(header, versionCommand, family, byte(len(payload)>>8), byte(len(payload)))
+	return append(header, payload...)
+}
+
+// Parse reads a header from r.
+func Parse(r io.Reader) (*Header, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], signature) || header[12] != versionCommand {
+		return nil, ErrInvalidHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	h := &Header{}
+	var ipLen int
+	switch header[13] {
+	case familyTCP4:
+		ipLen = net.IPv4len
+	case familyTCP6:
+		ipLen = net.IPv6len
+	case familyUnspec:
+	default:
+		return nil, ErrInvalidHeader
+	}
+	if ipLen > 0 {
+		if len(payload) < 2*ipLen+4 {
+			return nil, ErrInvalidHeader
+		}
+		ports := payload[2*ipLen:]
+		h.Source = &net.TCPAddr{IP: net.IP(payload[:ipLen]), Port: int(binary.BigEndian.Uint16(ports))}
+		h.Destination = &net.TCPAddr{IP: net.IP(payload[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+		payload = payload[2*ipLen+4:]
+	}
+
+	tlvs, err := ParseTLVs(payload)
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+	return h, nil
+}
+
+// ParseTLVs decodes a sequence of TLVs, e.g. the sub-TLVs of TypeSSL after its first 5 bytes.
+func ParseTLVs(data []byte) ([]TLV, error) {
+	tlvs := []TLV{}
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, ErrInvalidHeader
+		}
+		length := int(binary.BigEndian.Uint16(data[1:]))
+		if len(data) < 3+length {
+			return nil, ErrInvalidHeader
+		}
+		tlvs = append(tlvs, TLV{Type: data[0], Value: data[3 : 3+length]})
+		data = data[3+length:]
+	}
+	return tlvs, nil
+}
+
+func marshalTLVs(tlvs []TLV) []byte {
+	data := []byte{}
+	for _, tlv := range tlvs {
+		data = append(data, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		data = append(data, tlv.Value...)
+	}
+	return data
+}
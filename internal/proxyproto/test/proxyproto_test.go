@@ -0,0 +1,85 @@
+package proxyproto_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/gaukas/passthru/internal/proxyproto"
+)
+
+func TestMarshalTCP4(t *testing.T) {
+	header := &proxyproto.Header{
+		Source:      &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51234},
+		Destination: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443},
+		TLVs:        []proxyproto.TLV{{Type: proxyproto.TypeAuthority, Value: []byte("example.com")}},
+	}
+
+	expected, _ := hex.DecodeString("0d0a0d0a000d0a515549540a" + "2111" + "001a" +
+		"c0000201" + "0a000001" + "c822" + "01bb" +
+		"02000b" + hex.EncodeToString([]byte("example.com")))
+	if data := header.Marshal(); !bytes.Equal(data, expected) {
+		t.Errorf("expected %x, got %x", expected, data)
+	}
+}
+
+func TestMarshalParse(t *testing.T) {
+	ssl := proxyproto.SSLValue(proxyproto.ClientSSL|proxyproto.ClientCertConn, true, []proxyproto.TLV{
+		{Type: proxyproto.SubtypeSSLVersion, Value: []byte("TLSv1.3")},
+		{Type: proxyproto.SubtypeSSLCN, Value: []byte("alice")},
+	})
+
+	for _, tc := range []struct {
+		source, destination net.Addr
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}},
+		{&net.UnixAddr{Name: "/run/client.sock", Net: "unix"}, &net.UnixAddr{Name: "/run/passthru.sock", Net: "unix"}},
+	} {
+		header := &proxyproto.Header{
+			Source:      tc.source,
+			Destination: tc.destination,
+			TLVs: []proxyproto.TLV{
+				{Type: proxyproto.TypeSSL, Value: ssl},
+				{Type: proxyproto.TypeClientSPKI, Value: []byte("5c0d")},
+			},
+		}
+		parsed, err := proxyproto.Parse(bytes.NewReader(append(header.Marshal(), "payload"...)))
+		if err != nil {
+			t.Fatalf("failed to parse header from %s: %v", tc.source, err)
+		}
+
+		if _, ok := tc.source.(*net.TCPAddr); ok {
+			if parsed.Source.String() != tc.source.String() || parsed.Destination.String() != tc.destination.String() {
+				t.Errorf("expected %s -> %s, got %s -> %s", tc.source, tc.destination, parsed.Source, parsed.Destination)
+			}
+		} else if parsed.Source != nil || parsed.Destination != nil {
+			t.Errorf("expected no addresses for %s, got %s -> %s", tc.source, parsed.Source, parsed.Destination)
+		}
+
+		if len(parsed.TLVs) != 2 || parsed.TLVs[0].Type != proxyproto.TypeSSL || string(parsed.TLVs[1].Value) != "5c0d" {
+			t.Fatalf("unexpected TLVs: %v", parsed.TLVs)
+		}
+		value := parsed.TLVs[0].Value
+		if value[0] != proxyproto.ClientSSL|proxyproto.ClientCertConn || !bytes.Equal(value[1:5], []byte{0, 0, 0, 0}) {
+			t.Errorf("unexpected SSL TLV: %x", value)
+		}
+		subTLVs, err := proxyproto.ParseTLVs(value[5:])
+		if err != nil || len(subTLVs) != 2 || string(subTLVs[1].Value) != "alice" {
+			t.Errorf("unexpected sub-TLVs: %v, %v", subTLVs, err)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"v1":        []byte("PROXY TCP4 192.0.2.1 10.0.0.1 51234 443\r\n"),
+		"truncated": (&proxyproto.Header{}).Marshal()[:10],
+		"bad TLV":   append((&proxyproto.Header{}).Marshal()[:14], 0x00, 0x02, 0x20, 0x00),
+	} {
+		if _, err := proxyproto.Parse(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+//go:build aix || android || darwin || dragonfly || freebsd || hurd || illumos || ios || linux || netbsd || openbsd || solaris
+
+package upgrade_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/internal/activation"
+	"github.com/gaukas/passthru/internal/upgrade"
+)
+
+// socketPair returns both ends of a connected unix socket pair.
+func socketPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("failed to create socket pair: %v", err)
+	}
+
+	conns := []*net.UnixConn{}
+	for _, fd := range fds {
+		f := os.NewFile(uintptr(fd), "pair")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("failed to create conn: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conns = append(conns, conn.(*net.UnixConn))
+	}
+	return conns[0], conns[1]
+}
+
+func TestHandOver(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "passthru.sock")
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	unixListener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	oldConn, newConn := socketPair(t)
+	handedOver := []activation.Listener{
+		{Name: "tcp:127.0.0.1:443", Listener: tcpListener},
+		{Name: "unix:" + socketPath, Listener: unixListener},
+	}
+	err = upgrade.Send(oldConn, handedOver)
+	if err != nil {
+		t.Fatalf("failed to send listeners: %v", err)
+	}
+	listeners, err := upgrade.Receive(newConn)
+	if err != nil {
+		t.Fatalf("failed to receive listeners: %v", err)
+	}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	if len(listeners) != 2 || listeners[0].Name != "tcp:127.0.0.1:443" || listeners[1].Name != "unix:"+socketPath {
+		t.Fatalf("unexpected listeners: %v", listeners)
+	}
+	if listeners[0].Addr().String() != tcpListener.Addr().String() {
+		t.Errorf("expected %s, got %s", tcpListener.Addr(), listeners[0].Addr())
+	}
+
+	// the old process stops accepting, the socket file must be kept for the new one
+	upgrade.KeepSocketFiles(handedOver)
+	tcpListener.Close()
+	unixListener.Close()
+	for _, l := range listeners {
+		go func(addr net.Addr) {
+			conn, err := net.Dial(addr.Network(), addr.String())
+			if err == nil {
+				conn.Close()
+			}
+		}(l.Addr())
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatalf("failed to accept on %s: %v", l.Addr(), err)
+		}
+		conn.Close()
+	}
+}
+
+func TestHandOverFailed(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "passthru.sock")
+	unixListener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	oldConn, newConn := socketPair(t)
+	err = upgrade.Send(oldConn, []activation.Listener{{Name: "unix:" + socketPath, Listener: unixListener}})
+	if err != nil {
+		t.Fatalf("failed to send listeners: %v", err)
+	}
+	newConn.Close() // the new process exited before it was ready
+
+	// the old process exits too, without leaving the socket file behind
+	unixListener.Close()
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("expected the socket file to be removed, got %v", err)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	oldConn, newConn := socketPair(t)
+	go upgrade.Ready(newConn)
+	if err := upgrade.WaitReady(oldConn, time.Second); err != nil {
+		t.Errorf("expected ready, got %v", err)
+	}
+
+	if err := upgrade.WaitReady(oldConn, 10*time.Millisecond); !errors.Is(err, upgrade.ErrNotReady) {
+		t.Errorf("expected %v, got %v", upgrade.ErrNotReady, err)
+	}
+
+	oldConn, newConn = socketPair(t)
+	newConn.Close() // the new process exited
+	if err := upgrade.WaitReady(oldConn, time.Second); !errors.Is(err, upgrade.ErrNotReady) {
+		t.Errorf("expected %v, got %v", upgrade.ErrNotReady, err)
+	}
+}
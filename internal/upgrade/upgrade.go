@@ -0,0 +1,46 @@
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// An upgrade starts a new process of the (possibly replaced) executable with the same arguments,
+// and passes the listeners to it over a unix socket with SCM_RIGHTS. The new process tells the
+// old one when it is ready to accept connections, and the old one stops accepting and drains.
+
+const (
+	// EnvUpgradeFd is set in the new process to the fd of the unix socket to the old process.
+	EnvUpgradeFd = "PASSTHRU_UPGRADE_FD"
+
+	maxListeners = 253 // SCM_MAX_FD
+	maxNamesLen  = 64 * 1024
+)
+
+var (
+	// ReadyTimeout bounds the time for the new process to become ready.
+	ReadyTimeout = 30 * time.Second
+
+	ErrTooManyListeners = errors.New("too many listeners to hand over")
+	ErrNotReady         = errors.New("new process is not ready")
+	ErrUnsupported      = errors.New("upgrade is only supported on unix")
+)
+
+// Ready tells the old process that the new one accepts connections on the listeners.
+func Ready(conn *net.UnixConn) error {
+	_, err := conn.Write([]byte{1})
+	return err
+}
+
+// WaitReady waits for the new process to call Ready.
+func WaitReady(conn *net.UnixConn, timeout time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1)
+	_, err := conn.Read(buf)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotReady, err)
+	}
+	return nil
+}
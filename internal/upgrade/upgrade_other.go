@@ -0,0 +1,33 @@
+//go:build !aix && !android && !darwin && !dragonfly && !freebsd && !hurd && !illumos && !ios && !linux && !netbsd && !openbsd && !solaris
+
+package upgrade
+
+import (
+	"net"
+
+	"github.com/gaukas/passthru/internal/activation"
+)
+
+// Upgrade returns ErrUnsupported, as listeners can only be handed over on unix.
+func Upgrade(listeners []activation.Listener) error {
+	return ErrUnsupported
+}
+
+// Inherited returns no listener, as there is no upgrade in progress without unix.
+func Inherited() ([]activation.Listener, *net.UnixConn, error) {
+	return nil, nil, nil
+}
+
+// Send returns ErrUnsupported.
+func Send(conn *net.UnixConn, listeners []activation.Listener) error {
+	return ErrUnsupported
+}
+
+// KeepSocketFiles does nothing.
+func KeepSocketFiles(listeners []activation.Listener) {
+}
+
+// Receive returns ErrUnsupported.
+func Receive(conn *net.UnixConn) ([]activation.Listener, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,175 @@
+//go:build aix || android || darwin || dragonfly || freebsd || hurd || illumos || ios || linux || netbsd || openbsd || solaris
+
+package upgrade
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"github.com/gaukas/passthru/internal/activation"
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+// Upgrade starts a new process, hands the listeners over, and waits for it to be ready.
+// If it fails, the new process is killed and the listeners are left untouched.
+func Upgrade(listeners []activation.Listener) error {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+	local := os.NewFile(uintptr(fds[0]), "upgrade")
+	remote := os.NewFile(uintptr(fds[1]), "upgrade")
+	defer local.Close()
+
+	conn, err := net.FileConn(local)
+	if err != nil {
+		remote.Close()
+		return err
+	}
+	defer conn.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		remote.Close()
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{remote} // fd 3
+	cmd.Env = append(os.Environ(), EnvUpgradeFd+"=3")
+	err = cmd.Start()
+	remote.Close()
+	if err != nil {
+		return err
+	}
+	logger.Warnf("Started new process %d, handing over %d listeners", cmd.Process.Pid, len(listeners))
+
+	err = Send(conn.(*net.UnixConn), listeners)
+	if err == nil {
+		err = WaitReady(conn.(*net.UnixConn), ReadyTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	KeepSocketFiles(listeners)
+	logger.Warnf("New process %d is ready", cmd.Process.Pid)
+	return nil
+}
+
+// Inherited returns the listeners handed over by the old process, and the connection to
+// it to call Ready on. Without an upgrade in progress, no listener is returned.
+func Inherited() ([]activation.Listener, *net.UnixConn, error) {
+	fdStr := os.Getenv(EnvUpgradeFd)
+	if fdStr == "" {
+		return nil, nil, nil
+	}
+	os.Unsetenv(EnvUpgradeFd)
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid %s: %s", EnvUpgradeFd, fdStr)
+	}
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), "upgrade")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	listeners, err := Receive(conn.(*net.UnixConn))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return listeners, conn.(*net.UnixConn), nil
+}
+
+// Send passes the listeners with their names in a single message.
+// Once the new process is ready, KeepSocketFiles must be called before closing the listeners.
+func Send(conn *net.UnixConn, listeners []activation.Listener) error {
+	if len(listeners) > maxListeners {
+		return ErrTooManyListeners
+	}
+
+	names := []string{}
+	fds := []int{}
+	for _, l := range listeners {
+		sc, ok := l.Listener.(syscall.Conn)
+		if !ok {
+			return fmt.Errorf("listener %s on %s has no file descriptor", l.Name, l.Addr())
+		}
+		rawConn, err := sc.SyscallConn()
+		if err != nil {
+			return err
+		}
+		rawConn.Control(func(fd uintptr) {
+			fds = append(fds, int(fd))
+		})
+		names = append(names, l.Name)
+	}
+
+	data, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	_, _, err = conn.WriteMsgUnix(data, syscall.UnixRights(fds...), nil)
+	return err
+}
+
+// KeepSocketFiles makes closing the unix listeners leave their socket files for the new process
+// they are shared with. Until then, a failed upgrade leaves no socket file behind.
+func KeepSocketFiles(listeners []activation.Listener) {
+	for _, l := range listeners {
+		if ul, ok := l.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+}
+
+// Receive receives the listeners sent by Send.
+func Receive(conn *net.UnixConn) ([]activation.Listener, error) {
+	data := make([]byte, maxNamesLen)
+	oob := make([]byte, syscall.CmsgSpace(maxListeners*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(data, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	fds := []uintptr{}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		rights, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+		for _, fd := range rights {
+			fds = append(fds, uintptr(fd))
+		}
+	}
+
+	names := []string{}
+	err = json.Unmarshal(data[:n], &names)
+	if err == nil && len(names) != len(fds) {
+		err = fmt.Errorf("got %d listeners for %d names", len(fds), len(names))
+	}
+	if err != nil {
+		for _, fd := range fds {
+			syscall.Close(int(fd))
+		}
+		return nil, err
+	}
+	return activation.FileListeners(fds, names)
+}
@@ -0,0 +1,126 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+// CIDRList is a list of IP networks a client's remote address can be matched against.
+type CIDRList struct {
+	nets []*net.IPNet
+}
+
+// ParseCIDRList parses a comma-separated list of CIDRs, like "10.0.0.0/8,192.168.0.0/16".
+// A bare IP address is treated as a single-host network.
+func ParseCIDRList(s string) (*CIDRList, error) {
+	cl := &CIDRList{}
+	for _, entry := range strings.Split(s, ",") {
+		err := cl.add(entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(cl.nets) == 0 {
+		return nil, fmt.Errorf("empty CIDR list: %s", s)
+	}
+	return cl, nil
+}
+
+// LoadCIDRFile reads a CIDR list from a file with one CIDR per line.
+// Empty lines and lines starting with '#' are ignored.
+func LoadCIDRFile(filename string) (*CIDRList, error) {
+	logger.Debugf("Loading CIDR list from %s", filename)
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cl := &CIDRList{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err = cl.add(line)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+func (cl *CIDRList) add(entry string) error {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return nil
+	}
+
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address: %s", entry)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			cl.nets = append(cl.nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+		} else {
+			cl.nets = append(cl.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+		}
+		return nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR: %s", entry)
+	}
+	cl.nets = append(cl.nets, ipNet)
+	return nil
+}
+
+// ContainsIP reports whether ip is in any of the networks in the list.
+func (cl *CIDRList) ContainsIP(ip net.IP) bool {
+	if cl == nil || ip == nil {
+		return false
+	}
+	for _, ipNet := range cl.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether the IP of addr is in any of the networks in the list.
+// Addresses without an IP (e.g. Unix sockets) never match.
+func (cl *CIDRList) Contains(addr net.Addr) bool {
+	return cl.ContainsIP(AddrIP(addr))
+}
+
+// AddrIP extracts the IP address from a net.Addr, or returns nil if there is none.
+func AddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
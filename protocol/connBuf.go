@@ -3,12 +3,14 @@ package protocol
 import (
 	"errors"
 	"io"
+	"net"
 	"sync"
         "github.com/gaukas/passthru/internal/logger"
 )
 
 var (
 	ErrNotEnoughData = errors.New("not enough data in buffer")
+	ErrBufferFull    = errors.New("buffer is full")
 )
 
 // Thread-safe buffer in order to allow inspection of the connection
@@ -20,18 +22,49 @@ type ConnBuf struct {
 	// Performance improvement
 	bufCleared bool      // safe guard to prevent anything write to downstream while buffer remains.
 	downstream io.Writer // if set, will write to this writer instead of the buffer
+
+	remoteAddr net.Addr          // address of the client, if known
+	attributes map[string]string // attributes extracted by the protocol that identified the connection
+
+	// Bound of the buffer, writes are held back once it is reached until there is a downstream
+	limit    int
+	notFull  *sync.Cond
+	full     chan struct{}
+	fullOnce sync.Once
 }
 
 func NewConnBuf() *ConnBuf {
-	return &ConnBuf{
-		buf: make([]byte, 0),
+	cb := &ConnBuf{
+		buf:  make([]byte, 0),
+		full: make(chan struct{}),
 	}
+	cb.notFull = sync.NewCond(&cb.mutex)
+	return cb
+}
+
+// SetLimit bounds the number of bytes buffered before a downstream is set, 0 for unlimited.
+// Once the limit is reached, Full is closed, Peek returns ErrBufferFull for more than
+// is buffered, and further writes block until there is a downstream or the ConnBuf is closed,
+// so no byte is lost. Protocols should give up identifying the connection with ErrBufferFull.
+func (cb *ConnBuf) SetLimit(limit int) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.limit = limit
+}
+
+// Full is closed once the buffer has reached its limit.
+func (cb *ConnBuf) Full() <-chan struct{} {
+	return cb.full
 }
 
 func (cb *ConnBuf) Write(p []byte) (n int, err error) {
 	cb.mutex.Lock()
 	defer cb.mutex.Unlock()
 
+	for cb.limit > 0 && len(cb.buf) >= cb.limit && cb.downstream == nil && !cb.closed {
+		cb.notFull.Wait()
+	}
+
 	if cb.closed {
 		return 0, io.ErrClosedPipe
 	}
@@ -59,6 +92,9 @@ func (cb *ConnBuf) Write(p []byte) (n int, err error) {
 // must be called when caller holds the lock
 func (cb *ConnBuf) writeBufferLocked(p []byte) (n int, err error) {
 	cb.buf = append(cb.buf, p...)
+	if cb.limit > 0 && len(cb.buf) >= cb.limit {
+		cb.fullOnce.Do(func() { close(cb.full) })
+	}
 	return len(p), nil
 }
 
@@ -85,6 +121,7 @@ func (cb *ConnBuf) Read(p []byte) (n int, err error) {
 
 	// means n > 0
 	cb.buf = cb.buf[n:] // advance the buffer
+	cb.notFull.Broadcast()
 
 	return
 }
@@ -93,6 +130,7 @@ func (cb *ConnBuf) Close() error {
 	cb.mutex.Lock()
 	defer cb.mutex.Unlock()
 	cb.closed = true
+	cb.notFull.Broadcast()
 
 	if cb.downstream != nil { // close the downstream if it is a closer
 		if closer, ok := cb.downstream.(io.Closer); ok {
@@ -103,7 +141,8 @@ func (cb *ConnBuf) Close() error {
 	return nil
 }
 
-// Peek copies at least n bytes from the buffer, or return error
+// Peek copies at least n bytes from the buffer, or return error.
+// ErrBufferFull is returned instead of ErrNotEnoughData if the buffer has reached its limit.
 func (cb *ConnBuf) Peek(p []byte, n int) error {
 	cb.mutex.RLock() // ReadLock since it is static
 	defer cb.mutex.RUnlock()
@@ -113,15 +152,26 @@ func (cb *ConnBuf) Peek(p []byte, n int) error {
 
 	nRead := copy(p, cb.buf)
 	if nRead < n {
+		if cb.limit > 0 && len(cb.buf) >= cb.limit {
+			return ErrBufferFull // no more data until there is a downstream
+		}
 		return ErrNotEnoughData
 	}
 	return nil
 }
 
+// Len returns the number of bytes buffered, which can be peeked.
+func (cb *ConnBuf) Len() int {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+	return len(cb.buf)
+}
+
 func (cb *ConnBuf) SetDownstream(w io.Writer) error {
 	cb.mutex.Lock()
 	defer cb.mutex.Unlock()
 	cb.downstream = w
+	cb.notFull.Broadcast()
 
 	// if anything left in the buffer, write it to the downstream
 	if len(cb.buf) > 0 {
@@ -132,3 +182,39 @@ func (cb *ConnBuf) SetDownstream(w io.Writer) error {
 	}
 	return nil
 }
+
+// SetRemoteAddr records the address of the client the buffered bytes come from.
+func (cb *ConnBuf) SetRemoteAddr(addr net.Addr) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.remoteAddr = addr
+}
+
+// RemoteAddr returns the address of the client, or nil if unknown.
+func (cb *ConnBuf) RemoteAddr() net.Addr {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+	return cb.remoteAddr
+}
+
+// SetAttribute records an attribute extracted from the connection, like the SNI of a TLS ClientHello.
+// Attributes can be used to fill the placeholders in a templated config.Action.
+func (cb *ConnBuf) SetAttribute(key, value string) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.attributes == nil {
+		cb.attributes = make(map[string]string)
+	}
+	cb.attributes[key] = value
+}
+
+// Attributes returns a copy of all attributes recorded.
+func (cb *ConnBuf) Attributes() map[string]string {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+	attributes := make(map[string]string, len(cb.attributes))
+	for key, value := range cb.attributes {
+		attributes[key] = value
+	}
+	return attributes
+}
@@ -0,0 +1,55 @@
+package http
+
+import (
+	"context"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/internal/logger"
+	"github.com/gaukas/passthru/protocol"
+)
+
+// Protocol identifies plaintext HTTP/1.x requests by their Host header.
+type Protocol struct {
+	rules []Rule
+}
+
+func (p *Protocol) Name() config.Protocol {
+	return "HTTP"
+}
+
+func (p *Protocol) Clone() protocol.Protocol {
+	pCopy := &Protocol{}
+	pCopy.rules = append(pCopy.rules, p.rules...)
+	return pCopy
+}
+
+func (p *Protocol) ApplyRules(rules []config.Rule) error {
+	parsedRules, err := ParseRules(rules)
+	if err != nil {
+		return err
+	}
+
+	p.rules = parsedRules
+
+	return nil
+}
+
+func (p *Protocol) Identify(ctx context.Context, cBuf *protocol.ConnBuf) (config.Rule, error) {
+	info, err := ParseRequest(ctx, cBuf)
+	if err != nil {
+		return "", err
+	}
+
+	logger.Debugf("HTTP request from %v: %s %s Host=%q", cBuf.RemoteAddr(), info.Method, info.Path, info.Host)
+
+	for _, rule := range p.rules {
+		if rule.Match(info) {
+			cBuf.SetAttribute("host", info.Host)
+			cBuf.SetAttribute("method", info.Method)
+			cBuf.SetAttribute("path", info.Path)
+			return rule.RuleName, nil
+		}
+	}
+	logger.Debugf("No rule matched!!")
+	return "", protocol.ErrNoRuleMatched
+}
@@ -0,0 +1,157 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gaukas/passthru/protocol"
+)
+
+const (
+	// MaxHeaderLen is the longest request header to be buffered before giving up.
+	MaxHeaderLen = 8192
+)
+
+var (
+	ErrNotHTTP        = errors.New("not an HTTP/1.x request")
+	ErrHeaderTooLarge = errors.New("request header too large")
+)
+
+// RequestInfo is what is known about an HTTP/1.x request from its header.
+type RequestInfo struct {
+	Method string // like "GET"
+	Path   string // the request target, like "/index.html?q=1"
+	Proto  string // like "HTTP/1.1"
+	Host   string // the Host header, or the host of an absolute request target, without the port
+}
+
+// ParseRequest waits for the request header in the ConnBuf and parses it, without consuming it.
+func ParseRequest(ctx context.Context, cbuf *protocol.ConnBuf) (RequestInfo, error) {
+	for ctx.Err() == nil {
+		n := cbuf.Len()
+		if n > MaxHeaderLen {
+			n = MaxHeaderLen
+		}
+		buf := make([]byte, n)
+		if err := cbuf.Peek(buf, n); err != nil {
+			if err == io.EOF {
+				return RequestInfo{}, err
+			}
+			time.Sleep(20 * time.Millisecond)
+			continue
+		}
+
+		info, err := ParseRequestHeader(buf)
+		if err == protocol.ErrNotEnoughData {
+			if n == MaxHeaderLen {
+				return RequestInfo{}, ErrHeaderTooLarge
+			}
+			select {
+			case <-cbuf.Full():
+				return RequestInfo{}, protocol.ErrBufferFull
+			default:
+			}
+			time.Sleep(20 * time.Millisecond)
+			continue
+		}
+		return info, err
+	}
+
+	return RequestInfo{}, ctx.Err()
+}
+
+// ParseRequestHeader parses the request line and the headers, ending with an empty line.
+// It returns protocol.ErrNotEnoughData if data looks like the beginning of a request.
+func ParseRequestHeader(data []byte) (RequestInfo, error) {
+	// fail fast on anything else, e.g. a TLS record
+	lineEnd := bytes.IndexByte(data, '\n')
+	requestLine := data
+	if lineEnd >= 0 {
+		requestLine = data[:lineEnd]
+	}
+	for i, c := range requestLine {
+		if c == ' ' && i > 0 {
+			break
+		}
+		if c < 'A' || c > 'Z' {
+			return RequestInfo{}, ErrNotHTTP
+		}
+	}
+
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return RequestInfo{}, protocol.ErrNotEnoughData
+	}
+	lines := strings.Split(string(data[:headerEnd]), "\r\n")
+	// a bare CR or LF, or any other control character, would end up in a redirect or the access log as is
+	if hasControl(lines[0], false) {
+		return RequestInfo{}, ErrNotHTTP
+	}
+	for _, line := range lines[1:] {
+		if hasControl(line, true) {
+			return RequestInfo{}, ErrNotHTTP
+		}
+	}
+
+	parts := strings.Split(lines[0], " ")
+	if len(parts) != 3 || parts[1] == "" || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		return RequestInfo{}, ErrNotHTTP
+	}
+	info := RequestInfo{
+		Method: parts[0],
+		Path:   parts[1],
+		Proto:  parts[2],
+	}
+
+	// an absolute request target, like "GET http://example.com/ HTTP/1.1", takes precedence
+	if i := strings.Index(info.Path, "://"); i > 0 {
+		hostPath := info.Path[i+3:]
+		info.Path = "/"
+		if j := strings.IndexByte(hostPath, '/'); j >= 0 {
+			hostPath, info.Path = hostPath[:j], hostPath[j:]
+		}
+		info.Host = stripPort(hostPath)
+		return info, nil
+	}
+
+	for _, line := range lines[1:] {
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			return RequestInfo{}, ErrNotHTTP
+		}
+		if strings.EqualFold(line[:colon], "Host") {
+			info.Host = stripPort(strings.TrimSpace(line[colon+1:]))
+			break
+		}
+	}
+	return info, nil
+}
+
+// hasControl returns true if s has a control character, other than a tab if allowed as in header fields.
+func hasControl(s string, allowTab bool) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < ' ' && !(allowTab && c == '\t')) || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+func stripPort(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport // no port
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == ':') {
+			return "" // not a hostname or an IP, which can't be trusted in a redirect
+		}
+	}
+	return host
+}
@@ -0,0 +1,79 @@
+package http
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/internal/logger"
+)
+
+// Rule type
+const (
+	RuleHOST     uint8 = iota // "HOST example.com", or "HOST *.example.com" for any subdomain
+	RuleCATCHALL              // "CATCHALL", any HTTP/1.x request
+)
+
+type Rule struct {
+	Type     uint8
+	Contents string
+	RuleName config.Rule
+}
+
+func ParseRule(rule config.Rule) (Rule, error) {
+	ruleParts := strings.Split(string(rule), " ")
+	switch {
+	case ruleParts[0] == "HOST" && len(ruleParts) == 2:
+		return Rule{
+			Type:     RuleHOST,
+			Contents: strings.ToLower(ruleParts[1]),
+			RuleName: rule,
+		}, nil
+	case ruleParts[0] == "CATCHALL" && len(ruleParts) == 1:
+		return Rule{
+			Type:     RuleCATCHALL,
+			RuleName: rule,
+		}, nil
+	default:
+		logger.Errorf("Invaild rule: %s", rule)
+		return Rule{}, fmt.Errorf("invalid rule: %s", rule)
+	}
+}
+
+// ParseRules parses all rules, with the CATCHALL rule last.
+func ParseRules(rules []config.Rule) ([]Rule, error) {
+	var catchAllRule Rule
+
+	parsedRules := []Rule{}
+	for _, rule := range rules {
+		parsedRule, err := ParseRule(rule)
+		if err != nil {
+			return []Rule{}, err
+		}
+		if parsedRule.Type == RuleCATCHALL {
+			catchAllRule = parsedRule
+		} else {
+			parsedRules = append(parsedRules, parsedRule)
+		}
+	}
+
+	if catchAllRule.RuleName != "" {
+		parsedRules = append(parsedRules, catchAllRule)
+	}
+
+	return parsedRules, nil
+}
+
+func (r *Rule) Match(info RequestInfo) bool {
+	switch r.Type {
+	case RuleHOST:
+		if strings.HasPrefix(r.Contents, "*.") {
+			return strings.HasSuffix(info.Host, r.Contents[1:])
+		}
+		return info.Host == r.Contents
+	case RuleCATCHALL:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,99 @@
+package http_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/protocol"
+	"github.com/gaukas/passthru/protocol/http"
+)
+
+func TestParseRequestHeader(t *testing.T) {
+	for name, tc := range map[string]struct {
+		data string
+		info http.RequestInfo
+		err  error
+	}{
+		"host":     {"GET /a?b=c HTTP/1.1\r\nUser-Agent: test\r\nhost: Example.com:80\r\n\r\n", http.RequestInfo{Method: "GET", Path: "/a?b=c", Proto: "HTTP/1.1", Host: "example.com"}, nil},
+		"absolute": {"GET http://example.com:8080/a HTTP/1.1\r\nHost: other.com\r\n\r\n", http.RequestInfo{Method: "GET", Path: "/a", Proto: "HTTP/1.1", Host: "example.com"}, nil},
+		"ipv6":     {"HEAD / HTTP/1.0\r\nHost: [2001:db8::1]:80\r\n\r\n", http.RequestInfo{Method: "HEAD", Path: "/", Proto: "HTTP/1.0", Host: "2001:db8::1"}, nil},
+		"bad host": {"GET / HTTP/1.1\r\nHost: evil.com/x\r\n\r\n", http.RequestInfo{Method: "GET", Path: "/", Proto: "HTTP/1.1"}, nil},
+		"partial":  {"GET / HTTP/1.1\r\nHost: exa", http.RequestInfo{}, protocol.ErrNotEnoughData},
+		"tls":      {"\x16\x03\x01\x02\x00\x01", http.RequestInfo{}, http.ErrNotHTTP},
+		"http2":    {"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", http.RequestInfo{}, http.ErrNotHTTP},
+		"bare LF":  {"GET /a\nSet-Cookie:x HTTP/1.1\r\nHost: example.com\r\n\r\n", http.RequestInfo{}, http.ErrNotHTTP},
+		"bare CR":  {"GET /a\rSet-Cookie:x HTTP/1.1\r\nHost: example.com\r\n\r\n", http.RequestInfo{}, http.ErrNotHTTP},
+		"control":  {"GET /a\x00 HTTP/1.1\r\nHost: example.com\r\n\r\n", http.RequestInfo{}, http.ErrNotHTTP},
+		"header":   {"GET / HTTP/1.1\r\nHost: example.com\nX: y\r\n\r\n", http.RequestInfo{}, http.ErrNotHTTP},
+	} {
+		t.Run(name, func(t *testing.T) {
+			info, err := http.ParseRequestHeader([]byte(tc.data))
+			if err != tc.err {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if info != tc.info {
+				t.Errorf("expected %+v, got %+v", tc.info, info)
+			}
+		})
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	httpProtocol := http.Protocol{}
+	err := httpProtocol.ApplyRules([]config.Rule{"CATCHALL", "HOST example.com", "HOST *.example.org"})
+	if err != nil {
+		t.Fatalf("Error applying rules: %s", err)
+	}
+
+	for data, want := range map[string]config.Rule{
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n":     "HOST example.com",
+		"GET / HTTP/1.1\r\nHost: www.example.org\r\n\r\n": "HOST *.example.org",
+		"GET / HTTP/1.1\r\nHost: example.net\r\n\r\n":     "CATCHALL",
+	} {
+		cBuf := protocol.NewConnBuf()
+		cBuf.Write([]byte(data))
+		rule, err := httpProtocol.Identify(context.Background(), cBuf)
+		if err != nil {
+			t.Errorf("Error identifying rule: %s", err)
+		}
+		if rule != want {
+			t.Errorf("Wrong rule identified: %s, expected %s", rule, want)
+		}
+	}
+
+	cBuf := protocol.NewConnBuf()
+	cBuf.Write([]byte("GET /path HTTP/1.1\r\n"))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cBuf.Write([]byte("Host: example.com\r\n\r\n"))
+	}()
+	rule, err := httpProtocol.Identify(context.Background(), cBuf)
+	if err != nil || rule != "HOST example.com" {
+		t.Errorf("Wrong rule identified: %s, %v", rule, err)
+	}
+	if attributes := cBuf.Attributes(); attributes["host"] != "example.com" || attributes["path"] != "/path" || attributes["method"] != "GET" {
+		t.Errorf("unexpected attributes: %v", attributes)
+	}
+
+	if err := httpProtocol.ApplyRules([]config.Rule{"HOST"}); err == nil {
+		t.Errorf("HOST without a host should be rejected")
+	}
+}
+
+func TestIdentifyHeaderTooLarge(t *testing.T) {
+	httpProtocol := http.Protocol{}
+	httpProtocol.ApplyRules([]config.Rule{"CATCHALL"})
+
+	cBuf := protocol.NewConnBuf()
+	cBuf.Write([]byte("GET / HTTP/1.1\r\n"))
+	for i := 0; i < http.MaxHeaderLen/16; i++ {
+		cBuf.Write([]byte("X-Padding: 1234\r\n"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := httpProtocol.Identify(ctx, cBuf); err != http.ErrHeaderTooLarge {
+		t.Errorf("expected %v, got %v", http.ErrHeaderTooLarge, err)
+	}
+}
@@ -2,10 +2,15 @@ package protocol
 
 import (
 	"context"
+	"errors"
 
 	"github.com/gaukas/passthru/config"
 )
 
+// ErrNoRuleMatched is returned by Identify when the protocol is identified but none of its rules match,
+// as opposed to the connection not being of the protocol at all.
+var ErrNoRuleMatched = errors.New("no rule matched")
+
 // Protocol is the interface for protocol identification.
 type Protocol interface {
 	// Name prints the name of the protocol, like "TLS", which is going to be used as a key in the ProtocolGroup
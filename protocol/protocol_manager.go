@@ -2,17 +2,24 @@ package protocol
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"sync"
 
 	"github.com/gaukas/passthru/config"
 	"github.com/gaukas/passthru/internal/logger"
 )
 
+var (
+	ErrActionNotSupported = errors.New("action is not supported by the protocol")
+	ErrUnidentified       = errors.New("no protocol identified the connection")
+)
+
 type ProtocolManager struct {
 	protocols     map[config.Protocol]Protocol
 	protocolGroup config.ProtocolGroup
 	catchAll      config.Action
+	hasCatchAll   bool
+	fallback      *config.Action // taken when no protocol identifies the connection
 }
 
 func NewProtocolManager() *ProtocolManager {
@@ -41,19 +48,40 @@ LOOP_PG:
 				if rule != "CATCHALL" {
 					return fmt.Errorf("the CATCHALL protocol must ONLY have CATCHALL rule")
 				}
+				if err := validateAction(protocol, action); err != nil {
+					return err
+				}
 				pm.catchAll = action
+				pm.hasCatchAll = true
 				continue LOOP_PG
 			}
 			return fmt.Errorf("the CATCHALL protocol must have CATCHALL rule")
 		} // When not set, CATCHALL will be REJECT
+		if protocol == "FALLBACK" { // if FALLBACK, save it in fallback.
+			for rule, action := range filter {
+				if rule != "FALLBACK" {
+					return fmt.Errorf("the FALLBACK protocol must ONLY have FALLBACK rule")
+				}
+				if err := validateAction(protocol, action); err != nil {
+					return err
+				}
+				action := action
+				pm.fallback = &action
+				continue LOOP_PG
+			}
+			return fmt.Errorf("the FALLBACK protocol must have FALLBACK rule")
+		} // When not set, there is no fallback
 
 		p := pm.GetProtocol(protocol)
 		if p == nil {
 			return fmt.Errorf("unknown protocol: %s", protocol)
 		}
 		rules := []config.Rule{}
-		for rule := range filter {
+		for rule, action := range filter {
 			logger.Debugf("Importing rule %s", rule)
+			if err := validateAction(protocol, action); err != nil {
+				return err
+			}
 			rules = append(rules, rule)
 		}
 		err := p.ApplyRules(rules)
@@ -68,54 +96,112 @@ LOOP_PG:
 	return nil
 }
 
+// validateAction checks the action, and that the protocol it is taken for supports it:
+// HTTP_REDIRECT needs the request of the HTTP protocol, REJECT_TLS_ALERT the ClientHello of the TLS protocol.
+func validateAction(protocol config.Protocol, action config.Action) error {
+	if err := action.Validate(); err != nil {
+		return err
+	}
+	if action.Action == config.ACTION_HTTP_REDIRECT && protocol != "HTTP" {
+		logger.Errorf("%v: HTTP_REDIRECT for %s", ErrActionNotSupported, protocol)
+		return fmt.Errorf("%w: HTTP_REDIRECT for %s", ErrActionNotSupported, protocol)
+	}
+	if action.Action == config.ACTION_REJECT_TLS_ALERT && protocol != "TLS" {
+		logger.Errorf("%v: REJECT_TLS_ALERT for %s", ErrActionNotSupported, protocol)
+		return fmt.Errorf("%w: REJECT_TLS_ALERT for %s", ErrActionNotSupported, protocol)
+	}
+	return nil
+}
+
+// FindAction returns the action for the connection: of the rule a protocol identified it with,
+// or of CATCHALL if it is identified but no rule matches. If no protocol identifies it in time,
+// or any gives up with ErrBufferFull, the FALLBACK action is returned if there is one.
+// Otherwise, such a connection is rejected with an error, as is a rule miss without CATCHALL.
+// context.Canceled is returned together with the CATCHALL action if ctx is cancelled.
 func (pm *ProtocolManager) FindAction(ctx context.Context, cBuf *ConnBuf) (config.Action, error) {
-	chanRule := make(chan config.Rule)
-	chanProtocol := make(chan config.Protocol)
+	type result struct {
+		protocolName config.Protocol
+		rule         config.Rule
+		err          error
+	}
+	results := make(chan result, len(pm.protocols))
 	subctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	wg := &sync.WaitGroup{}
-
 	for pName, p := range pm.protocols {
-		wg.Add(1)
 		go func(protocolName config.Protocol, protocol Protocol) {
-			defer wg.Done()
 			rule, err := protocol.Identify(subctx, cBuf)
-			if err != nil {
-				return
-			}
-			chanRule <- rule
-			chanProtocol <- protocolName
+			results <- result{protocolName, rule, err}
 		}(pName, p)
 	}
 
-	// wait for all goroutines to finish, then cancel the context
-	go func() {
-		wg.Wait()
-		cancel()
-	}()
-
-	select {
-	case rule := <-chanRule:
+	noRuleMatched, bufferFull := false, false
+	for pending := len(pm.protocols); pending > 0; pending-- {
 		select {
-		case protocolName := <-chanProtocol:
+		case r := <-results:
+			if errors.Is(r.err, ErrNoRuleMatched) {
+				noRuleMatched = true
+			}
+			if errors.Is(r.err, ErrBufferFull) {
+				bufferFull = true
+			}
+			if r.err != nil {
+				logger.Debugf("Protocol %s: %v", r.protocolName, r.err)
+				continue
+			}
+
 			// look for the rule in the protocol group
-			filter, ok := pm.protocolGroup[protocolName]
+			filter, ok := pm.protocolGroup[r.protocolName]
 			if !ok {
-				return config.Action{}, fmt.Errorf("unknown protocol: %s", protocolName)
+				return config.Action{}, fmt.Errorf("unknown protocol: %s", r.protocolName)
 			}
 
-			action, ok := filter[rule]
+			action, ok := filter[r.rule]
 			if !ok {
-				return config.Action{}, fmt.Errorf("unknown rule: %s", rule)
+				return config.Action{}, fmt.Errorf("unknown rule: %s", r.rule)
 			}
 
-			logger.Debugf("Found action %s for protocol %s and rule %s", action, protocolName, rule)
+			logger.Debugf("Found action %s for protocol %s and rule %s", action, r.protocolName, r.rule)
+			setMatched(cBuf, r.protocolName, r.rule)
 			return action, nil
-		case <-ctx.Done(): // CATCHALL
-			return pm.catchAll, ctx.Err()
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return pm.fallbackAction(cBuf, "timeout", ctx.Err())
+			}
+			setMatched(cBuf, "CATCHALL", "CATCHALL")
+			return pm.catchAll, ctx.Err() // CATCHALL
 		}
-	case <-ctx.Done():
-		return pm.catchAll, ctx.Err()
 	}
+
+	if noRuleMatched && pm.hasCatchAll {
+		setMatched(cBuf, "CATCHALL", "CATCHALL")
+		return pm.catchAll, nil
+	}
+	if noRuleMatched {
+		return pm.fallbackAction(cBuf, "no_rule_matched", ErrNoRuleMatched)
+	}
+	if bufferFull {
+		return pm.fallbackAction(cBuf, "buffer_full", ErrBufferFull)
+	}
+	return pm.fallbackAction(cBuf, "unidentified", ErrUnidentified)
+}
+
+// fallbackAction returns the FALLBACK action if there is one, recording the reason as
+// the "fallback" attribute. Otherwise it returns the CATCHALL action with err.
+func (pm *ProtocolManager) fallbackAction(cBuf *ConnBuf, reason string, err error) (config.Action, error) {
+	if pm.fallback == nil {
+		setMatched(cBuf, "CATCHALL", "CATCHALL")
+		return pm.catchAll, err
+	}
+	logger.Debugf("Falling back for %v: %s", cBuf.RemoteAddr(), reason)
+	cBuf.SetAttribute("fallback", reason)
+	setMatched(cBuf, "FALLBACK", "FALLBACK")
+	return *pm.fallback, nil
+}
+
+// setMatched records the protocol and the rule the action is taken for, as the "protocol"
+// and "rule" attributes, e.g. for the access log or a capture.
+func setMatched(cBuf *ConnBuf, protocolName config.Protocol, rule config.Rule) {
+	cBuf.SetAttribute("protocol", protocolName)
+	cBuf.SetAttribute("rule", rule)
 }
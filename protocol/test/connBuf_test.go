@@ -1,8 +1,10 @@
 package protocol_test
 
 import (
+	"bytes"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/gaukas/passthru/protocol"
 )
@@ -141,3 +143,33 @@ func testReadEmptyBufAfterClose(t *testing.T) {
 		t.Errorf("Wrong number of bytes read: %d", n)
 	}
 }
+
+func TestConnBufLimit(t *testing.T) {
+	cBuf := protocol.NewConnBuf()
+	cBuf.SetLimit(4)
+
+	cBuf.Write([]byte("test"))
+	select {
+	case <-cBuf.Full():
+	default:
+		t.Fatalf("expected the buffer to be full")
+	}
+
+	written := make(chan struct{})
+	go func() {
+		cBuf.Write([]byte("more"))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatalf("expected the write to block on a full buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	downstream := &bytes.Buffer{}
+	cBuf.SetDownstream(downstream)
+	<-written
+	if downstream.String() != "testmore" {
+		t.Errorf("expected every byte downstream, got %q", downstream.String())
+	}
+}
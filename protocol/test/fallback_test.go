@@ -0,0 +1,155 @@
+package protocol_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/protocol"
+)
+
+// LineProtocol identifies lines starting with "test", and matches "test ok".
+type LineProtocol struct {
+}
+
+func (p *LineProtocol) Name() config.Protocol {
+	return config.Protocol("line")
+}
+
+func (p *LineProtocol) Clone() protocol.Protocol {
+	return &LineProtocol{}
+}
+
+func (p *LineProtocol) ApplyRules(rules []config.Rule) error {
+	return nil
+}
+
+func (p *LineProtocol) Identify(ctx context.Context, cBuf *protocol.ConnBuf) (config.Rule, error) {
+	for ctx.Err() == nil {
+		n := cBuf.Len()
+		buf := make([]byte, n)
+		if err := cBuf.Peek(buf, n); err != nil {
+			return "", err
+		}
+		if n >= 4 && !bytes.HasPrefix(buf, []byte("test")) {
+			return "", errors.New("not a test line")
+		}
+		if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+			if string(buf[:i]) == "test ok" {
+				return "test ok", nil
+			}
+			return "", protocol.ErrNoRuleMatched
+		}
+		select {
+		case <-cBuf.Full():
+			return "", protocol.ErrBufferFull
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return "", ctx.Err()
+}
+
+func newLineProtocolManager(t *testing.T, catchAll bool) *protocol.ProtocolManager {
+	pg := config.ProtocolGroup{
+		"line": config.Filter{
+			"test ok": config.Action{Action: config.ACTION_FORWARD, ToAddr: "127.0.0.1:8001"},
+		},
+		"FALLBACK": config.Filter{
+			"FALLBACK": config.Action{Action: config.ACTION_FORWARD, ToAddr: "127.0.0.1:8443"},
+		},
+	}
+	if catchAll {
+		pg["CATCHALL"] = config.Filter{
+			"CATCHALL": config.Action{Action: config.ACTION_FORWARD, ToAddr: "127.0.0.1:8002"},
+		}
+	}
+
+	pm := protocol.NewProtocolManager()
+	pm.RegisterProtocol(&LineProtocol{})
+	if err := pm.ImportProtocolGroup(pg); err != nil {
+		t.Fatalf("Error importing protocol group: %s", err)
+	}
+	return pm
+}
+
+func TestFindActionFallback(t *testing.T) {
+	for name, tc := range map[string]struct {
+		catchAll bool
+		data     string
+		limit    int
+		toAddr   string
+		reason   string
+	}{
+		"matched":                  {false, "test ok\n", 0, "127.0.0.1:8001", ""},
+		"no rule matched":          {false, "test no\n", 0, "127.0.0.1:8443", "no_rule_matched"},
+		"no rule matched CATCHALL": {true, "test no\n", 0, "127.0.0.1:8002", ""},
+		"unidentified":             {true, "hello\n", 0, "127.0.0.1:8443", "unidentified"},
+		"timeout":                  {true, "te", 0, "127.0.0.1:8443", "timeout"},
+		"buffer full":              {true, "test without an end", 8, "127.0.0.1:8443", "buffer_full"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			pm := newLineProtocolManager(t, tc.catchAll)
+			cBuf := protocol.NewConnBuf()
+			cBuf.SetLimit(tc.limit)
+			go cBuf.Write([]byte(tc.data))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			action, err := pm.FindAction(ctx, cBuf)
+			if err != nil {
+				t.Fatalf("Error finding action: %s", err)
+			}
+			if action.ToAddr != tc.toAddr {
+				t.Errorf("expected action to %s, got %s", tc.toAddr, action.ToAddr)
+			}
+			if reason := cBuf.Attributes()["fallback"]; reason != tc.reason {
+				t.Errorf("expected fallback reason %q, got %q", tc.reason, reason)
+			}
+			cBuf.Close()
+		})
+	}
+}
+
+func TestFindActionWithoutFallback(t *testing.T) {
+	pm := protocol.NewProtocolManager()
+	pm.RegisterProtocol(&LineProtocol{})
+	err := pm.ImportProtocolGroup(config.ProtocolGroup{
+		"line": config.Filter{"test ok": config.Action{Action: config.ACTION_FORWARD, ToAddr: "127.0.0.1:8001"}},
+	})
+	if err != nil {
+		t.Fatalf("Error importing protocol group: %s", err)
+	}
+
+	cBuf := protocol.NewConnBuf()
+	cBuf.Write([]byte("hello\n"))
+	if _, err := pm.FindAction(context.Background(), cBuf); err != protocol.ErrUnidentified {
+		t.Errorf("expected %v without fallback, got %v", protocol.ErrUnidentified, err)
+	}
+
+	cBuf = protocol.NewConnBuf()
+	cBuf.Write([]byte("test no\n"))
+	if _, err := pm.FindAction(context.Background(), cBuf); err != protocol.ErrNoRuleMatched {
+		t.Errorf("expected %v without fallback, got %v", protocol.ErrNoRuleMatched, err)
+	}
+
+	cBuf = protocol.NewConnBuf()
+	cBuf.Write([]byte("te"))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := pm.FindAction(ctx, cBuf); err != context.DeadlineExceeded {
+		t.Errorf("expected the timeout without fallback, got %v", err)
+	}
+}
+
+func TestImportFallbackInvalid(t *testing.T) {
+	pm := protocol.NewProtocolManager()
+	err := pm.ImportProtocolGroup(config.ProtocolGroup{
+		"FALLBACK": config.Filter{"CATCHALL": config.Action{Action: config.ACTION_REJECT}},
+	})
+	if err == nil {
+		t.Errorf("FALLBACK with a rule other than FALLBACK should be rejected")
+	}
+}
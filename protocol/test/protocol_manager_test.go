@@ -105,3 +105,22 @@ func testFindAction(t *testing.T) {
 		t.Errorf("Error finding action: %s", err)
 	}
 }
+
+func TestImportUnsupportedAction(t *testing.T) {
+	redirect := config.Action{Action: config.ACTION_HTTP_REDIRECT}
+	alert := config.Action{Action: config.ACTION_REJECT_TLS_ALERT}
+	for _, pg := range []config.ProtocolGroup{
+		{"dummy": config.Filter{"test": redirect}},
+		{"CATCHALL": config.Filter{"CATCHALL": redirect}},
+		{"FALLBACK": config.Filter{"FALLBACK": redirect}},
+		{"dummy": config.Filter{"test": alert}},
+		{"CATCHALL": config.Filter{"CATCHALL": alert}},
+		{"FALLBACK": config.Filter{"FALLBACK": alert}},
+	} {
+		pm := protocol.NewProtocolManager()
+		pm.RegisterProtocol(&DummyProtocol{})
+		if err := pm.ImportProtocolGroup(pg); !errors.Is(err, protocol.ErrActionNotSupported) {
+			t.Errorf("%v: expected %v, got %v", pg, protocol.ErrActionNotSupported, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package tls
+
+import (
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/protocol"
+)
+
+const (
+	recordTypeAlert byte = 0x15
+	alertLevelFatal byte = 2
+)
+
+// Alert descriptions, RFC 8446 section 6
+const (
+	AlertHandshakeFailure byte = 40
+	AlertAccessDenied     byte = 49
+	AlertUnrecognizedName byte = 112
+)
+
+var alertNames = map[config.Alert]byte{
+	config.ALERT_HANDSHAKE_FAILURE: AlertHandshakeFailure,
+	config.ALERT_ACCESS_DENIED:     AlertAccessDenied,
+	config.ALERT_UNRECOGNIZED_NAME: AlertUnrecognizedName,
+}
+
+// AlertDescription returns the description of the alert by its name in the config,
+// handshake_failure if the name is empty or unknown.
+func AlertDescription(alert config.Alert) byte {
+	if description, ok := alertNames[alert]; ok {
+		return description
+	}
+	return AlertHandshakeFailure
+}
+
+// AlertRecord returns a plaintext TLS record carrying a fatal alert.
+func AlertRecord(version uint16, description byte) []byte {
+	return []byte{recordTypeAlert, byte(version >> 8), byte(version), 0x00, 0x02, alertLevelFatal, description}
+}
+
+// RecordVersion returns the version in the header of the first record the client sent,
+// which is usually TLS 1.0 or TLS 1.2 even for TLS 1.3, or TLS 1.0 if it isn't a TLS record.
+func RecordVersion(cBuf *protocol.ConnBuf) uint16 {
+	header := make([]byte, recordHeaderLen)
+	if err := cBuf.Peek(header, recordHeaderLen); err != nil || header[0] != recordTypeHandshake || header[1] != 0x03 {
+		return 0x0301
+	}
+	return uint16(header[1])<<8 | uint16(header[2])
+}
@@ -2,9 +2,7 @@ package tls
 
 import (
 	"context"
-	"encoding/binary"
 	"errors"
-	"io"
 	"time"
 
 	"github.com/gaukas/passthru/protocol"
@@ -12,18 +10,59 @@ import (
 )
 
 type ConnInfo struct {
-	SNI  string
-	ALPN string
+	SNI   string   // with ECH, this is the outer SNI, i.e. the public name of the ECH config
+	ALPN  string   // the first ALPN protocol offered, kept for compatibility
+	ALPNs []string // all ALPN protocols offered, in the client's order of preference
+
+	Extensions []uint16 // IDs of all extensions, in the order they appear on the wire
+
+	LegacyVersion       uint16   // version in the ClientHello itself, capped at TLS 1.2
+	SupportedVersions   []uint16 // from the supported_versions extension, if any
+	CipherSuites        []uint16
+	SupportedGroups     []uint16
+	SignatureAlgorithms []uint16
+	SessionTicket       bool // session_ticket extension is present
+	PSK                 bool // pre_shared_key extension is present
+
+	ECH           bool   // an outer encrypted_client_hello extension is present, which may also be a GREASE one
+	ECHPublicName string // the outer SNI, set only if ECH is present
+
+	JA3 string // MD5 hash of the JA3 fingerprint
+	JA4 string
+}
+
+// MaxVersion returns the highest TLS version offered by the client, ignoring GREASE values.
+func (ci *ConnInfo) MaxVersion() uint16 {
+	maxVersion := ci.LegacyVersion
+	for _, v := range ci.SupportedVersions {
+		if !isGREASE(v) && v > maxVersion {
+			maxVersion = v
+		}
+	}
+	return maxVersion
+}
+
+// OffersALPN returns true if the client offers the ALPN protocol.
+func (ci *ConnInfo) OffersALPN(alpn string) bool {
+	for _, offered := range ci.ALPNs {
+		if offered == alpn {
+			return true
+		}
+	}
+	return false
 }
 
+// ParseClientHello waits until a complete ClientHello, possibly fragmented across
+// multiple TLS records and TCP segments, is buffered in cbuf and then parses it.
 // Check https://github.com/refraction-networking/utls/blob/2179f286686bdd60b90151993024fb9cfc21420b/conn.go#L991
 func ParseClientHello(ctx context.Context, cbuf *protocol.ConnBuf) (ConnInfo, error) {
+	need := recordHeaderLen
 	for ctx.Err() == nil {
-		// peek first 5 bytes
-		buf := make([]byte, 5)
-		err := cbuf.Peek(buf, 5)
+		// peek as many bytes as needed for the next record
+		buf := make([]byte, need)
+		err := cbuf.Peek(buf, need)
 		if err != nil {
-			if err == io.EOF {
+			if err != protocol.ErrNotEnoughData { // EOF or ErrBufferFull
 				return ConnInfo{}, err
 			} else {
 				time.Sleep(20 * time.Millisecond)
@@ -31,41 +70,64 @@ func ParseClientHello(ctx context.Context, cbuf *protocol.ConnBuf) (ConnInfo, er
 			}
 		}
 
-		if buf[0] != 0x16 {
-			return ConnInfo{}, errors.New("not a TLS connection")
-		}
-		// parse length
-		length := binary.BigEndian.Uint16(buf[3:])
-		// peek the rest of the message
-		buf = make([]byte, length+5)
-		err = cbuf.Peek(buf, int(length+5))
-		if err != nil {
-			if err == protocol.ErrNotEnoughData {
-				continue
-			} else {
-				return ConnInfo{}, err
-			}
+		var msg []byte
+		msg, need, err = ReassembleHandshake(buf)
+		if err == protocol.ErrNotEnoughData {
+			continue
+		} else if err != nil {
+			return ConnInfo{}, err
 		}
 
-		// check if it's a client hello
-		if buf[5] != 0x01 {
-			return ConnInfo{}, errors.New("not start with a client hello")
-		}
+		return ParseClientHelloMsg(msg)
+	}
 
-		clientHello := tls.UnmarshalClientHello(buf[5:]) // drop the first 5 bytes as TLS record header
-		if clientHello == nil {
-			return ConnInfo{}, errors.New("failed to parse client hello")
-		}
+	return ConnInfo{}, ctx.Err()
+}
 
-		ci := ConnInfo{
-			SNI: clientHello.ServerName,
-		}
-		if len(clientHello.AlpnProtocols) > 0 {
-			ci.ALPN = clientHello.AlpnProtocols[0]
-		}
+// ParseClientHelloMsg parses a complete ClientHello handshake message, including its 4-byte header.
+func ParseClientHelloMsg(msg []byte) (ConnInfo, error) {
+	clientHello := tls.UnmarshalClientHello(msg)
+	if clientHello == nil {
+		return ConnInfo{}, errors.New("failed to parse client hello")
+	}
 
-		return ci, nil
+	extensions, extensionData, err := parseExtensions(msg)
+	if err != nil {
+		return ConnInfo{}, err
 	}
 
-	return ConnInfo{}, ctx.Err()
+	ci := ConnInfo{
+		SNI:               clientHello.ServerName,
+		Extensions:        extensions,
+		LegacyVersion:     clientHello.Vers,
+		SupportedVersions: clientHello.SupportedVersions,
+		CipherSuites:      clientHello.CipherSuites,
+	}
+	for _, curve := range clientHello.SupportedCurves {
+		ci.SupportedGroups = append(ci.SupportedGroups, uint16(curve))
+	}
+	for _, sigAlg := range clientHello.SupportedSignatureAlgorithms {
+		ci.SignatureAlgorithms = append(ci.SignatureAlgorithms, uint16(sigAlg))
+	}
+	for _, ext := range extensions {
+		switch ext {
+		case extensionSessionTicket:
+			ci.SessionTicket = true
+		case extensionPreSharedKey:
+			ci.PSK = true
+		}
+	}
+	// GREASE ECH is indistinguishable from a real outer ECH, so it is reported too
+	if ech, ok := extensionData[extensionECH]; ok && len(ech) > 0 && ech[0] == 0 { // ECHClientHelloType outer(0)
+		ci.ECH = true
+		ci.ECHPublicName = clientHello.ServerName
+	}
+	if len(clientHello.AlpnProtocols) > 0 {
+		ci.ALPN = clientHello.AlpnProtocols[0]
+		ci.ALPNs = clientHello.AlpnProtocols
+	}
+	_, ci.JA3 = JA3(clientHello, extensions)
+	ci.JA4 = JA4(clientHello, extensions)
+
+	return ci, nil
 }
@@ -0,0 +1,229 @@
+package tls
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+const (
+	extensionServerName    uint16 = 0x0000
+	extensionALPN          uint16 = 0x0010
+	extensionSessionTicket uint16 = 0x0023
+	extensionPreSharedKey  uint16 = 0x0029
+	extensionECH           uint16 = 0xfe0d
+)
+
+// parseExtensions walks the extensions of a ClientHello handshake message
+// and returns their IDs in the order they appear on the wire, and the data of each.
+func parseExtensions(handshake []byte) ([]uint16, map[uint16][]byte, error) {
+	errMalformed := errors.New("malformed client hello")
+
+	// message type + uint24 length, version, random
+	pos := 4 + 2 + 32
+	if len(handshake) < pos+1 {
+		return nil, nil, errMalformed
+	}
+	pos += 1 + int(handshake[pos]) // session id
+	if len(handshake) < pos+2 {
+		return nil, nil, errMalformed
+	}
+	pos += 2 + int(binary.BigEndian.Uint16(handshake[pos:])) // cipher suites
+	if len(handshake) < pos+1 {
+		return nil, nil, errMalformed
+	}
+	pos += 1 + int(handshake[pos]) // compression methods
+	if len(handshake) == pos {
+		return []uint16{}, map[uint16][]byte{}, nil // no extensions at all
+	}
+	if len(handshake) < pos+2 {
+		return nil, nil, errMalformed
+	}
+	end := pos + 2 + int(binary.BigEndian.Uint16(handshake[pos:]))
+	if len(handshake) < end {
+		return nil, nil, errMalformed
+	}
+	pos += 2
+
+	extensions := []uint16{}
+	data := map[uint16][]byte{}
+	for pos < end {
+		if end < pos+4 {
+			return nil, nil, errMalformed
+		}
+		id := binary.BigEndian.Uint16(handshake[pos:])
+		length := int(binary.BigEndian.Uint16(handshake[pos+2:]))
+		if end < pos+4+length {
+			return nil, nil, errMalformed
+		}
+		extensions = append(extensions, id)
+		data[id] = handshake[pos+4 : pos+4+length]
+		pos += 4 + length
+	}
+	return extensions, data, nil
+}
+
+// isGREASE checks if the value is one of the reserved GREASE values (RFC 8701), like 0x0a0a.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// JA3 computes the JA3 fingerprint of a ClientHello, returning the full string and its MD5 hash.
+// See https://github.com/salesforce/ja3
+func JA3(clientHello *tls.PubClientHelloMsg, extensions []uint16) (string, string) {
+	curves := make([]uint16, 0, len(clientHello.SupportedCurves))
+	for _, curve := range clientHello.SupportedCurves {
+		curves = append(curves, uint16(curve))
+	}
+	points := make([]uint16, 0, len(clientHello.SupportedPoints))
+	for _, point := range clientHello.SupportedPoints {
+		points = append(points, uint16(point))
+	}
+
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(clientHello.Vers)),
+		joinDecimal(clientHello.CipherSuites),
+		joinDecimal(extensions),
+		joinDecimal(curves),
+		joinDecimal(points),
+	}, ",")
+
+	hash := md5.Sum([]byte(ja3))
+	return ja3, hex.EncodeToString(hash[:])
+}
+
+// JA4 computes the JA4 fingerprint of a ClientHello received over TCP.
+// See https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+func JA4(clientHello *tls.PubClientHelloMsg, extensions []uint16) string {
+	version := clientHello.Vers
+	for _, v := range clientHello.SupportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+
+	sni := "i"
+	for _, ext := range extensions {
+		if ext == extensionServerName {
+			sni = "d"
+		}
+	}
+
+	ciphers := filterGREASE(clientHello.CipherSuites)
+	exts := filterGREASE(extensions)
+
+	alpn := "00"
+	if len(clientHello.AlpnProtocols) > 0 && len(clientHello.AlpnProtocols[0]) > 0 {
+		alpn = ja4ALPN(clientHello.AlpnProtocols[0])
+	}
+
+	ja4a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(version), sni, min99(len(ciphers)), min99(len(exts)), alpn)
+
+	sortedCiphers := append([]uint16{}, ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+	ja4b := ja4Hash(joinHex(sortedCiphers))
+
+	sortedExts := []uint16{}
+	for _, ext := range exts {
+		if ext != extensionServerName && ext != extensionALPN {
+			sortedExts = append(sortedExts, ext)
+		}
+	}
+	sort.Slice(sortedExts, func(i, j int) bool { return sortedExts[i] < sortedExts[j] })
+	sigAlgs := []uint16{}
+	for _, sigAlg := range clientHello.SupportedSignatureAlgorithms {
+		if !isGREASE(uint16(sigAlg)) {
+			sigAlgs = append(sigAlgs, uint16(sigAlg))
+		}
+	}
+	ja4c := joinHex(sortedExts)
+	if len(sigAlgs) > 0 {
+		ja4c += "_" + joinHex(sigAlgs)
+	}
+	if len(sortedExts) == 0 {
+		ja4c = ""
+	}
+
+	return ja4a + "_" + ja4b + "_" + ja4Hash(ja4c)
+}
+
+func ja4Version(version uint16) string {
+	switch version {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the first and last characters of the ALPN value,
+// or the first and last hex digits if either isn't alphanumeric.
+func ja4ALPN(alpn string) string {
+	first, last := alpn[0], alpn[len(alpn)-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+	firstHex, lastHex := hex.EncodeToString([]byte{first}), hex.EncodeToString([]byte{last})
+	return firstHex[:1] + lastHex[1:]
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	hash := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(hash[:])[:12]
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+func filterGREASE(values []uint16) []uint16 {
+	filtered := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
+func joinDecimal(values []uint16) string {
+	parts := []string{}
+	for _, v := range filterGREASE(values) {
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		parts = append(parts, fmt.Sprintf("%04x", v))
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,112 @@
+package tls
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Names accepted in rules in addition to numeric IDs, like "GROUP x25519" or "EXTENSION 0x002b".
+
+var versionNames = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var groupNames = map[string]uint16{
+	"secp256r1":             23,
+	"secp384r1":             24,
+	"secp521r1":             25,
+	"x25519":                29,
+	"x448":                  30,
+	"ffdhe2048":             256,
+	"ffdhe3072":             257,
+	"ffdhe4096":             258,
+	"ffdhe6144":             259,
+	"ffdhe8192":             260,
+	"x25519mlkem768":        0x11ec,
+	"x25519kyber768draft00": 0x6399,
+}
+
+var extensionNames = map[string]uint16{
+	"server_name":            0,
+	"status_request":         5,
+	"supported_groups":       10,
+	"ec_point_formats":       11,
+	"signature_algorithms":   13,
+	"alpn":                   16,
+	"sct":                    18,
+	"padding":                21,
+	"extended_master_secret": 23,
+	"compress_certificate":   27,
+	"session_ticket":         35,
+	"pre_shared_key":         41,
+	"early_data":             42,
+	"supported_versions":     43,
+	"cookie":                 44,
+	"psk_key_exchange_modes": 45,
+	"key_share":              51,
+	"encrypted_client_hello": 0xfe0d,
+	"renegotiation_info":     0xff01,
+}
+
+var cipherSuiteNames = func() map[string]uint16 {
+	names := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		names[strings.ToLower(suite.Name)] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		names[strings.ToLower(suite.Name)] = suite.ID
+	}
+	return names
+}()
+
+// parseID parses an ID either by its name (case-insensitive) or as a number, like "0x1301" or "4865".
+func parseID(s string, names map[string]uint16) (uint16, error) {
+	if id, ok := names[strings.ToLower(s)]; ok {
+		return id, nil
+	}
+	id, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown ID: %s", s)
+	}
+	return uint16(id), nil
+}
+
+// parseVersion parses a TLS version by its name, like "1.3", or its ID from 0x0301 to 0x0304,
+// so that a typo like "5" is not taken for a version no client offers.
+func parseVersion(s string) (uint16, error) {
+	version, err := parseID(s, versionNames)
+	if err != nil || version < tls.VersionTLS10 || version > tls.VersionTLS13 {
+		return 0, fmt.Errorf("unknown TLS version: %s", s)
+	}
+	return version, nil
+}
+
+// parseIDList parses a comma-separated list of IDs.
+func parseIDList(s string, names map[string]uint16) ([]uint16, error) {
+	ids := []uint16{}
+	for _, part := range strings.Split(s, ",") {
+		id, err := parseID(part, names)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func containsAny(offered []uint16, ids []uint16) bool {
+	for _, o := range offered {
+		for _, id := range ids {
+			if o == id {
+				return true
+			}
+		}
+	}
+	return false
+}
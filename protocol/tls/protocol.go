@@ -2,7 +2,6 @@ package tls
 
 import (
 	"context"
-	"errors"
 
 	"github.com/gaukas/passthru/config"
 	"github.com/gaukas/passthru/protocol"
@@ -43,21 +42,19 @@ func (p *Protocol) Identify(ctx context.Context, cBuf *protocol.ConnBuf) (config
 		return "", err
 	}
 
+	remoteAddr := cBuf.RemoteAddr()
+	logger.Debugf("TLS ClientHello from %v: SNI=%q ALPN=%v ECH=%v JA3=%s JA4=%s", remoteAddr, connInfo.SNI, connInfo.ALPNs, connInfo.ECH, connInfo.JA3, connInfo.JA4)
+
 	// identify rule by the original order
 	for _, rule := range p.rules {
-		switch rule.Type {
-		case RuleSNI:
-			if connInfo.SNI == rule.Contents {
-				return rule.RuleName, nil
-			}
-		case RuleALPN:
-			if connInfo.ALPN == rule.Contents {
-				return rule.RuleName, nil
-			}
-		case RuleCATCHALL:
+		if rule.Match(connInfo, remoteAddr) {
+			cBuf.SetAttribute("sni", connInfo.SNI)
+			cBuf.SetAttribute("alpn", connInfo.ALPN)
+			cBuf.SetAttribute("ja3", connInfo.JA3)
+			cBuf.SetAttribute("ja4", connInfo.JA4)
 			return rule.RuleName, nil
 		}
 	}
         logger.Debugf("No rule matched!!")
-	return "", errors.New("no rule matched")
+	return "", protocol.ErrNoRuleMatched
 }
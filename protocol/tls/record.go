@@ -0,0 +1,78 @@
+package tls
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/gaukas/passthru/protocol"
+)
+
+const (
+	recordTypeHandshake      byte = 0x16
+	handshakeTypeClientHello byte = 0x01
+
+	recordHeaderLen    = 5
+	handshakeHeaderLen = 4
+	maxRecordLen       = 1<<14 + 2048 // maximum TLSCiphertext length, plaintext records are even shorter
+)
+
+var (
+	// MaxClientHelloSize bounds the size of a ClientHello to be reassembled from multiple records.
+	MaxClientHelloSize = 64 * 1024
+
+	ErrNotTLS              = errors.New("not a TLS connection")
+	ErrNotClientHello      = errors.New("not start with a client hello")
+	ErrClientHelloTooLarge = errors.New("client hello too large")
+	ErrMalformedRecord     = errors.New("malformed TLS record")
+)
+
+// ReassembleHandshake concatenates the handshake fragments carried by the TLS records
+// at the beginning of data until the first handshake message, which must be a ClientHello,
+// is complete, and returns the message including its 4-byte header.
+//
+// If data doesn't contain enough records yet, protocol.ErrNotEnoughData is returned
+// together with the total number of bytes needed to make progress.
+func ReassembleHandshake(data []byte) (msg []byte, need int, err error) {
+	pos := 0
+	for {
+		if len(data) < pos+recordHeaderLen {
+			return nil, pos + recordHeaderLen, protocol.ErrNotEnoughData
+		}
+
+		header := data[pos : pos+recordHeaderLen]
+		if header[0] != recordTypeHandshake {
+			if pos == 0 {
+				return nil, 0, ErrNotTLS
+			}
+			return nil, 0, ErrMalformedRecord // e.g. a ChangeCipherSpec in the middle of a ClientHello
+		}
+		if header[1] != 0x03 {
+			return nil, 0, ErrNotTLS
+		}
+		length := int(binary.BigEndian.Uint16(header[3:]))
+		if length == 0 || length > maxRecordLen {
+			return nil, 0, ErrMalformedRecord
+		}
+
+		if len(data) < pos+recordHeaderLen+length {
+			return nil, pos + recordHeaderLen + length, protocol.ErrNotEnoughData
+		}
+		msg = append(msg, data[pos+recordHeaderLen:pos+recordHeaderLen+length]...)
+		pos += recordHeaderLen + length
+
+		if msg[0] != handshakeTypeClientHello {
+			return nil, 0, ErrNotClientHello
+		}
+		if len(msg) < handshakeHeaderLen {
+			continue // header itself is fragmented
+		}
+
+		msgLen := handshakeHeaderLen + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+		if msgLen > MaxClientHelloSize {
+			return nil, 0, ErrClientHelloTooLarge
+		}
+		if len(msg) >= msgLen {
+			return msg[:msgLen], 0, nil
+		}
+	}
+}
@@ -2,59 +2,113 @@ package tls
 
 import (
 	"fmt"
+	"net"
+	"sort"
 	"strings"
 
 	"github.com/gaukas/passthru/config"
-        "github.com/gaukas/passthru/internal/logger"
+	"github.com/gaukas/passthru/internal/logger"
+	"github.com/gaukas/passthru/protocol"
 )
 
 func ValidateRule(rule string) error {
 	// split into parts delimited by space
 	ruleParts := strings.Split(rule, " ")
-	if len(ruleParts) > 2 || len(ruleParts) < 1 {
-                logger.Errorf("Invaild rule: %s", rule)
+	if len(ruleParts) > 4 || len(ruleParts) < 1 {
+		logger.Errorf("Invaild rule: %s", rule)
+		return fmt.Errorf("invalid rule: %s", rule)
+	}
+
+	// a rule may be restricted to certain clients, like "SNI example.com SRC 10.0.0.0/8"
+	ruleParts, sourceParts := splitSource(ruleParts)
+	if sourceParts != nil && (isSourceRule(ruleParts[0]) || ruleParts[0] == "CATCHALL") {
+		logger.Errorf("Invaild rule: %s", rule)
 		return fmt.Errorf("invalid rule: %s", rule)
 	}
 
 	// validate rule
 	switch ruleParts[0] {
-	case "SNI":
+	case "SNI", "ALPN", "ALPN_ANY", "ALPN_ALL", "ALPN_FIRST", "JA3", "JA4", "SRC", "SRC_FILE",
+		"TLS_MIN_VERSION", "CIPHER", "EXTENSION", "GROUP", "ECH_PUBLIC_NAME":
 		if len(ruleParts) != 2 {
-                        logger.Errorf("Invaild rule: %s", rule)
+			logger.Errorf("Invaild rule: %s", rule)
 			return fmt.Errorf("invalid rule: %s", rule)
 		}
-	case "ALPN":
-		if len(ruleParts) != 2 {
-                        logger.Errorf("Invaild rule: %s", rule)
+	case "ECH":
+		if len(ruleParts) != 2 || (ruleParts[1] != "yes" && ruleParts[1] != "no") {
+			logger.Errorf("Invaild rule: %s", rule)
 			return fmt.Errorf("invalid rule: %s", rule)
 		}
-	case "CATCHALL":
+	case "ALPN_NONE", "NO_SNI", "SNI_IP", "CATCHALL":
 		if len(ruleParts) != 1 {
-                        logger.Errorf("Invaild rule: %s", rule)
+			logger.Errorf("Invaild rule: %s", rule)
 			return fmt.Errorf("invalid rule: %s", rule)
 		}
 	default:
-                logger.Errorf("Invaild rule: %s", rule)
+		logger.Errorf("Invaild rule: %s", rule)
 		return fmt.Errorf("invalid rule: %s", rule)
 	}
 
 	return nil
 }
 
+// splitSource splits the trailing "SRC <cidrs>" or "SRC_FILE <path>" from the rule parts, if any.
+func splitSource(ruleParts []string) (base []string, source []string) {
+	if len(ruleParts) > 2 && isSourceRule(ruleParts[len(ruleParts)-2]) {
+		return ruleParts[:len(ruleParts)-2], ruleParts[len(ruleParts)-2:]
+	}
+	return ruleParts, nil
+}
+
+func isSourceRule(ruleType string) bool {
+	return ruleType == "SRC" || ruleType == "SRC_FILE"
+}
+
 // Rule type
 const (
-	RuleSNI uint8 = iota
-	RuleALPN
+	RuleSNI  uint8 = iota
+	RuleALPN       // "ALPN h2" or "ALPN_FIRST h2", the first ALPN protocol offered must be h2
 	RuleCATCHALL
+	RuleSRC       // "SRC 10.0.0.0/8" or "SRC_FILE /path/to/cidrs.txt"
+	RuleEXPR      // "SNI example.com AND NOT ALPN h2"
+	RuleALPN_ANY  // "ALPN_ANY h2", h2 must be offered
+	RuleALPN_ALL  // "ALPN_ALL h2,http/1.1", every listed protocol must be offered
+	RuleALPN_NONE // "ALPN_NONE", no ALPN extension
+	RuleJA3       // "JA3 <md5>"
+	RuleJA4       // "JA4 t13d1516h2_8daaf6152771_e5627efa2ab1"
+
+	RuleTLS_MIN_VERSION // "TLS_MIN_VERSION 1.3", the highest version offered must be at least TLS 1.3
+	RuleCIPHER          // "CIPHER 0x1301,TLS_CHACHA20_POLY1305_SHA256", any of the cipher suites is offered
+	RuleEXTENSION       // "EXTENSION key_share,0xfe0d", any of the extensions is present
+	RuleGROUP           // "GROUP x25519,secp256r1", any of the groups is supported
+
+	RuleECH             // "ECH yes" or "ECH no"
+	RuleECH_PUBLIC_NAME // "ECH_PUBLIC_NAME cover.example.com", ECH is present with the public name
+
+	RuleNO_SNI // "NO_SNI", no server_name at all, e.g. the client is connecting by IP
+	RuleSNI_IP // "SNI_IP", the server_name is an IP literal, which is not allowed by RFC 6066
 )
 
 type Rule struct {
 	Type     uint8
 	Contents string
+	Values   []string // Contents split by comma, for rules taking a list
+	IDs      []uint16 // Contents parsed as IDs, for rules on versions, cipher suites, extensions and groups
 	RuleName config.Rule
+
+	// Source, if set, restricts the rule to clients whose remote address is in the list.
+	Source *protocol.CIDRList
+
+	// Expr and Terms are set for RuleEXPR, with each term of the expression parsed as a Rule.
+	Expr  *config.RuleExpr
+	Terms map[config.Rule]Rule
 }
 
 func ParseRule(rule config.Rule) (Rule, error) {
+	if config.IsRuleExpr(rule) {
+		return parseRuleExpr(rule)
+	}
+
 	// validate rule
 	err := ValidateRule(rule)
 	if err != nil {
@@ -64,6 +118,16 @@ func ParseRule(rule config.Rule) (Rule, error) {
 	// split into parts delimited by space
 	ruleParts := strings.Split(rule, " ")
 
+	var source *protocol.CIDRList
+	ruleParts, sourceParts := splitSource(ruleParts)
+	if sourceParts != nil {
+		source, err = parseSource(sourceParts[0], sourceParts[1])
+		if err != nil {
+			logger.Errorf("Invaild rule: %s: %v", rule, err)
+			return Rule{}, fmt.Errorf("invalid rule: %s: %w", rule, err)
+		}
+	}
+
 	// parse rule
 	switch ruleParts[0] {
 	case "SNI":
@@ -71,12 +135,100 @@ func ParseRule(rule config.Rule) (Rule, error) {
 			Type:     RuleSNI,
 			Contents: ruleParts[1],
 			RuleName: rule,
+			Source:   source,
 		}, nil
-	case "ALPN":
+	case "ALPN", "ALPN_FIRST":
 		return Rule{
 			Type:     RuleALPN,
 			Contents: ruleParts[1],
 			RuleName: rule,
+			Source:   source,
+		}, nil
+	case "ALPN_ANY":
+		return Rule{
+			Type:     RuleALPN_ANY,
+			Contents: ruleParts[1],
+			RuleName: rule,
+			Source:   source,
+		}, nil
+	case "ALPN_ALL":
+		return Rule{
+			Type:     RuleALPN_ALL,
+			Contents: ruleParts[1],
+			Values:   strings.Split(ruleParts[1], ","),
+			RuleName: rule,
+			Source:   source,
+		}, nil
+	case "ALPN_NONE":
+		return Rule{
+			Type:     RuleALPN_NONE,
+			RuleName: rule,
+			Source:   source,
+		}, nil
+	case "JA3":
+		return Rule{
+			Type:     RuleJA3,
+			Contents: strings.ToLower(ruleParts[1]),
+			RuleName: rule,
+			Source:   source,
+		}, nil
+	case "JA4":
+		return Rule{
+			Type:     RuleJA4,
+			Contents: ruleParts[1],
+			RuleName: rule,
+			Source:   source,
+		}, nil
+	case "TLS_MIN_VERSION", "CIPHER", "EXTENSION", "GROUP":
+		ruleType, ids, err := parseIDRule(ruleParts[0], ruleParts[1])
+		if err != nil {
+			logger.Errorf("Invaild rule: %s: %v", rule, err)
+			return Rule{}, fmt.Errorf("invalid rule: %s: %w", rule, err)
+		}
+		return Rule{
+			Type:     ruleType,
+			Contents: ruleParts[1],
+			IDs:      ids,
+			RuleName: rule,
+			Source:   source,
+		}, nil
+	case "NO_SNI":
+		return Rule{
+			Type:     RuleNO_SNI,
+			RuleName: rule,
+			Source:   source,
+		}, nil
+	case "SNI_IP":
+		return Rule{
+			Type:     RuleSNI_IP,
+			RuleName: rule,
+			Source:   source,
+		}, nil
+	case "ECH":
+		return Rule{
+			Type:     RuleECH,
+			Contents: ruleParts[1],
+			RuleName: rule,
+			Source:   source,
+		}, nil
+	case "ECH_PUBLIC_NAME":
+		return Rule{
+			Type:     RuleECH_PUBLIC_NAME,
+			Contents: ruleParts[1],
+			RuleName: rule,
+			Source:   source,
+		}, nil
+	case "SRC", "SRC_FILE":
+		source, err = parseSource(ruleParts[0], ruleParts[1])
+		if err != nil {
+			logger.Errorf("Invaild rule: %s: %v", rule, err)
+			return Rule{}, fmt.Errorf("invalid rule: %s: %w", rule, err)
+		}
+		return Rule{
+			Type:     RuleSRC,
+			Contents: ruleParts[1],
+			RuleName: rule,
+			Source:   source,
 		}, nil
 	case "CATCHALL":
 		return Rule{
@@ -84,11 +236,122 @@ func ParseRule(rule config.Rule) (Rule, error) {
 			RuleName: rule,
 		}, nil
 	default:
-                logger.Errorf("Invaild rule: %s", rule)
+		logger.Errorf("Invaild rule: %s", rule)
 		return Rule{}, fmt.Errorf("invalid rule: %s", rule)
 	}
 }
 
+func parseIDRule(ruleType, contents string) (uint8, []uint16, error) {
+	switch ruleType {
+	case "TLS_MIN_VERSION":
+		version, err := parseVersion(contents)
+		return RuleTLS_MIN_VERSION, []uint16{version}, err
+	case "CIPHER":
+		ids, err := parseIDList(contents, cipherSuiteNames)
+		return RuleCIPHER, ids, err
+	case "EXTENSION":
+		ids, err := parseIDList(contents, extensionNames)
+		return RuleEXTENSION, ids, err
+	default: // "GROUP"
+		ids, err := parseIDList(contents, groupNames)
+		return RuleGROUP, ids, err
+	}
+}
+
+func parseRuleExpr(rule config.Rule) (Rule, error) {
+	expr, err := config.ParseRuleExpr(rule)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	terms := map[config.Rule]Rule{}
+	for _, term := range expr.Terms() {
+		parsedTerm, err := ParseRule(term)
+		if err != nil {
+			return Rule{}, fmt.Errorf("%w %q: %v", config.ErrInvalidRuleExpr, rule, err)
+		}
+		if parsedTerm.Type == RuleCATCHALL {
+			logger.Errorf("Invaild rule: %s: CATCHALL can't be used in an expression", rule)
+			return Rule{}, fmt.Errorf("%w %q: CATCHALL can't be used in an expression", config.ErrInvalidRuleExpr, rule)
+		}
+		terms[term] = parsedTerm
+	}
+
+	return Rule{
+		Type:     RuleEXPR,
+		RuleName: rule,
+		Expr:     expr,
+		Terms:    terms,
+	}, nil
+}
+
+// Match checks whether the rule matches the connection.
+func (r *Rule) Match(connInfo ConnInfo, remoteAddr net.Addr) bool {
+	if r.Source != nil && !r.Source.Contains(remoteAddr) {
+		return false
+	}
+
+	switch r.Type {
+	case RuleSNI:
+		return connInfo.SNI == r.Contents
+	case RuleALPN:
+		return connInfo.ALPN == r.Contents
+	case RuleALPN_ANY:
+		return connInfo.OffersALPN(r.Contents)
+	case RuleALPN_ALL:
+		for _, alpn := range r.Values {
+			if !connInfo.OffersALPN(alpn) {
+				return false
+			}
+		}
+		return true
+	case RuleALPN_NONE:
+		return len(connInfo.ALPNs) == 0
+	case RuleJA3:
+		return connInfo.JA3 == r.Contents
+	case RuleJA4:
+		return connInfo.JA4 == r.Contents
+	case RuleTLS_MIN_VERSION:
+		return connInfo.MaxVersion() >= r.IDs[0]
+	case RuleCIPHER:
+		return containsAny(connInfo.CipherSuites, r.IDs)
+	case RuleEXTENSION:
+		return containsAny(connInfo.Extensions, r.IDs)
+	case RuleGROUP:
+		return containsAny(connInfo.SupportedGroups, r.IDs)
+	case RuleNO_SNI:
+		return connInfo.SNI == ""
+	case RuleSNI_IP:
+		return net.ParseIP(strings.Trim(connInfo.SNI, "[]")) != nil
+	case RuleECH:
+		return connInfo.ECH == (r.Contents == "yes")
+	case RuleECH_PUBLIC_NAME:
+		return connInfo.ECH && connInfo.ECHPublicName == r.Contents
+	case RuleSRC:
+		return true // source already checked above
+	case RuleEXPR:
+		return r.Expr.Eval(func(term config.Rule) bool {
+			termRule := r.Terms[term]
+			return termRule.Match(connInfo, remoteAddr)
+		})
+	case RuleCATCHALL:
+		return true
+	default:
+		return false
+	}
+}
+
+func parseSource(sourceType, contents string) (*protocol.CIDRList, error) {
+	if sourceType == "SRC_FILE" {
+		return protocol.LoadCIDRFile(contents)
+	}
+	return protocol.ParseCIDRList(contents)
+}
+
+// ParseRules parses the rules and sorts them in the order they should be tried:
+// expressions and rules restricted by source address come first, then source-only rules,
+// then the rest, and the CATCHALL rule is always the last. Within each of them, rules with
+// more terms are tried first, then by ruleTypeOrder, then in the lexical order of their text.
 func ParseRules(rules []config.Rule) ([]Rule, error) {
 	var catchAllRule Rule
 
@@ -105,9 +368,68 @@ func ParseRules(rules []config.Rule) ([]Rule, error) {
 		}
 	}
 
+	// rules come from a map, so ties are broken by the rule itself for the order to be the same every time
+	sort.Slice(parsedRules, func(i, j int) bool {
+		a, b := parsedRules[i], parsedRules[j]
+		if rulePriority(a) != rulePriority(b) {
+			return rulePriority(a) < rulePriority(b)
+		}
+		if ruleSpecificity(a) != ruleSpecificity(b) {
+			return ruleSpecificity(a) > ruleSpecificity(b)
+		}
+		if ruleTypeOrder[a.Type] != ruleTypeOrder[b.Type] {
+			return ruleTypeOrder[a.Type] < ruleTypeOrder[b.Type]
+		}
+		return a.RuleName < b.RuleName
+	})
+
 	if catchAllRule.RuleName != "" {
 		parsedRules = append(parsedRules, catchAllRule)
 	}
 
 	return parsedRules, nil
 }
+
+// ruleTypeOrder ranks the types of rules with as many terms: the server name first, then fingerprints,
+// ALPN and the other attributes of the ClientHello, which many more clients have in common.
+var ruleTypeOrder = map[uint8]int{
+	RuleSNI:             0,
+	RuleECH_PUBLIC_NAME: 0,
+	RuleNO_SNI:          1,
+	RuleSNI_IP:          1,
+	RuleJA4:             2,
+	RuleJA3:             2,
+	RuleALPN:            3,
+	RuleALPN_ALL:        3,
+	RuleALPN_ANY:        4,
+	RuleALPN_NONE:       4,
+	RuleCIPHER:          5,
+	RuleEXTENSION:       5,
+	RuleGROUP:           5,
+	RuleTLS_MIN_VERSION: 5,
+	RuleECH:             5,
+}
+
+// ruleSpecificity returns the number of terms the rule has to match, e.g. 2 for "SNI example.com SRC 10.0.0.0/8".
+func ruleSpecificity(rule Rule) int {
+	switch {
+	case rule.Type == RuleEXPR:
+		return len(rule.Expr.Terms())
+	case rule.Source != nil && rule.Type != RuleSRC:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// rulePriority returns a lower value for rules that should be tried first.
+func rulePriority(rule Rule) int {
+	switch {
+	case rule.Type == RuleEXPR, rule.Source != nil && rule.Type != RuleSRC: // e.g. "SNI example.com SRC 10.0.0.0/8"
+		return 0
+	case rule.Type == RuleSRC:
+		return 1
+	default:
+		return 2
+	}
+}
@@ -0,0 +1,34 @@
+package tls_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/protocol"
+	"github.com/gaukas/passthru/protocol/tls"
+)
+
+func TestAlertRecord(t *testing.T) {
+	cBuf := protocol.NewConnBuf()
+	cBuf.Write(CH_cloudflare_dns_com)
+	version := tls.RecordVersion(cBuf)
+	if want := uint16(CH_cloudflare_dns_com[1])<<8 | uint16(CH_cloudflare_dns_com[2]); version != want {
+		t.Errorf("expected record version %#04x, got %#04x", want, version)
+	}
+
+	record := tls.AlertRecord(version, tls.AlertDescription(config.ALERT_UNRECOGNIZED_NAME))
+	if want := []byte{0x15, CH_cloudflare_dns_com[1], CH_cloudflare_dns_com[2], 0x00, 0x02, 0x02, 112}; !bytes.Equal(record, want) {
+		t.Errorf("expected %x, got %x", want, record)
+	}
+
+	if tls.AlertDescription("") != tls.AlertHandshakeFailure {
+		t.Errorf("handshake_failure should be the default")
+	}
+
+	cBuf = protocol.NewConnBuf()
+	cBuf.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	if version := tls.RecordVersion(cBuf); version != 0x0301 {
+		t.Errorf("expected TLS 1.0 for non-TLS data, got %#04x", version)
+	}
+}
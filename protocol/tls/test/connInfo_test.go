@@ -86,3 +86,89 @@ func TestParseClientHello(t *testing.T) {
 		t.Fatalf("ALPN mismatch: %v", connInfo.ALPN)
 	}
 }
+
+func TestParseClientHelloALPNs(t *testing.T) {
+	ctx := context.Background()
+	cBuf := protocol.NewConnBuf()
+	cBuf.Write(sampleClientHello)
+
+	connInfo, err := tls.ParseClientHello(ctx, cBuf)
+	if err != nil {
+		t.Fatalf("ParseClientHello failed: %v", err)
+	}
+
+	expected := []string{"hq", "h2c", "h2", "spdy/3", "spdy/2", "spdy/1", "http/1.1", "http/1.0", "http/0.9"}
+	if len(connInfo.ALPNs) != len(expected) {
+		t.Fatalf("ALPN list mismatch: %v", connInfo.ALPNs)
+	}
+	for i := range expected {
+		if connInfo.ALPNs[i] != expected[i] {
+			t.Fatalf("ALPN list mismatch: %v", connInfo.ALPNs)
+		}
+	}
+
+	cBuf = protocol.NewConnBuf()
+	cBuf.Write(CH_no_alpn)
+	connInfo, err = tls.ParseClientHello(ctx, cBuf)
+	if err != nil {
+		t.Fatalf("ParseClientHello failed: %v", err)
+	}
+	if connInfo.ALPN != "" || len(connInfo.ALPNs) != 0 {
+		t.Fatalf("ALPN should be empty: %v", connInfo.ALPNs)
+	}
+}
+
+func TestParseClientHelloAttributes(t *testing.T) {
+	cBuf := protocol.NewConnBuf()
+	cBuf.Write(sampleClientHello)
+
+	connInfo, err := tls.ParseClientHello(context.Background(), cBuf)
+	if err != nil {
+		t.Fatalf("ParseClientHello failed: %v", err)
+	}
+
+	if connInfo.LegacyVersion != 0x0303 || connInfo.MaxVersion() != 0x0304 {
+		t.Errorf("version mismatch: %x/%x", connInfo.LegacyVersion, connInfo.MaxVersion())
+	}
+	if len(connInfo.CipherSuites) != 70 || connInfo.CipherSuites[0] != 0x1a1a {
+		t.Errorf("cipher suites mismatch: %v", connInfo.CipherSuites)
+	}
+	if len(connInfo.SupportedGroups) != 4 || connInfo.SupportedGroups[0] != 29 {
+		t.Errorf("supported groups mismatch: %v", connInfo.SupportedGroups)
+	}
+	if len(connInfo.SignatureAlgorithms) != 9 || connInfo.SignatureAlgorithms[0] != 0x0403 {
+		t.Errorf("signature algorithms mismatch: %v", connInfo.SignatureAlgorithms)
+	}
+	if len(connInfo.Extensions) != 13 || connInfo.Extensions[0] != 0x3a3a {
+		t.Errorf("extensions mismatch: %v", connInfo.Extensions)
+	}
+	if !connInfo.SessionTicket || connInfo.PSK {
+		t.Errorf("session ticket/PSK mismatch: %v/%v", connInfo.SessionTicket, connInfo.PSK)
+	}
+}
+
+func TestParseClientHelloECH(t *testing.T) {
+	cBuf := protocol.NewConnBuf()
+	cBuf.Write(CH_ech)
+
+	connInfo, err := tls.ParseClientHello(context.Background(), cBuf)
+	if err != nil {
+		t.Fatalf("ParseClientHello failed: %v", err)
+	}
+	if !connInfo.ECH {
+		t.Errorf("ECH should be present")
+	}
+	if connInfo.SNI != "cover.example.com" || connInfo.ECHPublicName != "cover.example.com" {
+		t.Errorf("outer SNI mismatch: %v/%v", connInfo.SNI, connInfo.ECHPublicName)
+	}
+
+	cBuf = protocol.NewConnBuf()
+	cBuf.Write(sampleClientHello)
+	connInfo, err = tls.ParseClientHello(context.Background(), cBuf)
+	if err != nil {
+		t.Fatalf("ParseClientHello failed: %v", err)
+	}
+	if connInfo.ECH || connInfo.ECHPublicName != "" {
+		t.Errorf("ECH should not be present")
+	}
+}
@@ -0,0 +1,67 @@
+package tls_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/protocol"
+	"github.com/gaukas/passthru/protocol/tls"
+)
+
+func TestFingerprint(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		clientHello []byte
+		ja3         string
+		ja4         string
+	}{
+		{"cloudflare-dns.com", CH_cloudflare_dns_com, "46f5131e766d248db0248a86c494b71c", "t13d2013h2_2b729b4bf6f3_2e4f304f1f45"},
+		{"h2,http/1.1", CH_alpn_h2_http11, "95b6f6d62c2c0f5258859e829e0055f5", "t13d1312h2_f57a46bbacb6_a089bac06eae"},
+		{"GREASE", sampleClientHello, "7f9ae904ef5a8d37a4028ce5c57bc099", "t13d6912hq_ea0618708e31_1da015a32102"},
+	} {
+		cBuf := protocol.NewConnBuf()
+		cBuf.Write(tc.clientHello)
+		connInfo, err := tls.ParseClientHello(context.Background(), cBuf)
+		if err != nil {
+			t.Fatalf("ParseClientHello failed for %s: %v", tc.name, err)
+		}
+		if connInfo.JA3 != tc.ja3 {
+			t.Errorf("JA3 mismatch for %s: %s", tc.name, connInfo.JA3)
+		}
+		if connInfo.JA4 != tc.ja4 {
+			t.Errorf("JA4 mismatch for %s: %s", tc.name, connInfo.JA4)
+		}
+	}
+}
+
+func TestFingerprintRules(t *testing.T) {
+	p := tls.Protocol{}
+	err := p.ApplyRules([]config.Rule{
+		"JA3 46F5131E766D248DB0248A86C494B71C",
+		"JA4 t13d1312h2_f57a46bbacb6_a089bac06eae",
+		"CATCHALL",
+	})
+	if err != nil {
+		t.Fatalf("Error applying rules: %s", err)
+	}
+
+	for _, tc := range []struct {
+		clientHello []byte
+		rule        config.Rule
+	}{
+		{CH_cloudflare_dns_com, "JA3 46F5131E766D248DB0248A86C494B71C"},
+		{CH_alpn_h2_http11, "JA4 t13d1312h2_f57a46bbacb6_a089bac06eae"},
+		{sampleClientHello, "CATCHALL"},
+	} {
+		cBuf := protocol.NewConnBuf()
+		cBuf.Write(tc.clientHello)
+		rule, err := p.Identify(context.Background(), cBuf)
+		if err != nil {
+			t.Errorf("Error identifying rule: %s", err)
+		}
+		if rule != tc.rule {
+			t.Errorf("Wrong rule identified: %s", rule)
+		}
+	}
+}
@@ -111,3 +111,26 @@ func testIdentifyWithNotEnoughData(t *testing.T) {
 		t.Errorf("should have returned empty rule")
 	}
 }
+
+func TestIdentifyAttributes(t *testing.T) {
+	p := tls.Protocol{}
+	err := p.ApplyRules([]config.Rule{"CATCHALL"})
+	if err != nil {
+		t.Fatalf("Error applying rules: %s", err)
+	}
+
+	cBuf := protocol.NewConnBuf()
+	cBuf.Write(CH_alpn_h2_http11)
+	_, err = p.Identify(context.Background(), cBuf)
+	if err != nil {
+		t.Fatalf("Error identifying rule: %s", err)
+	}
+
+	attributes := cBuf.Attributes()
+	if attributes["sni"] != "alpn.example.com" {
+		t.Errorf("sni attribute mismatch: %s", attributes["sni"])
+	}
+	if attributes["alpn"] != "h2" {
+		t.Errorf("alpn attribute mismatch: %s", attributes["alpn"])
+	}
+}
@@ -0,0 +1,163 @@
+package tls_test
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/gaukas/passthru/protocol"
+	"github.com/gaukas/passthru/protocol/tls"
+)
+
+// fragment splits the ClientHello carried in a single TLS record into records of at most size bytes.
+func fragment(clientHello []byte, size int) []byte {
+	header, handshake := clientHello[:5], clientHello[5:]
+	records := []byte{}
+	for len(handshake) > 0 {
+		n := size
+		if n > len(handshake) {
+			n = len(handshake)
+		}
+		records = append(records, header[0], header[1], header[2], byte(n>>8), byte(n))
+		records = append(records, handshake[:n]...)
+		handshake = handshake[n:]
+	}
+	return records
+}
+
+// withPadding returns the handshake message of the ClientHello with a padding extension
+// of n bytes appended, making it as large as needed for the test.
+func withPadding(clientHello []byte, n int) []byte {
+	handshake := append([]byte{}, clientHello[5:]...)
+
+	// locate the extensions length
+	pos := 4 + 2 + 32
+	pos += 1 + int(handshake[pos])
+	pos += 2 + int(binary.BigEndian.Uint16(handshake[pos:]))
+	pos += 1 + int(handshake[pos])
+
+	handshake = append(handshake, 0x00, 0x15, byte(n>>8), byte(n))
+	handshake = append(handshake, make([]byte, n)...)
+
+	extLen := int(binary.BigEndian.Uint16(handshake[pos:])) + 4 + n
+	binary.BigEndian.PutUint16(handshake[pos:], uint16(extLen))
+	msgLen := len(handshake) - 4
+	handshake[1], handshake[2], handshake[3] = byte(msgLen>>16), byte(msgLen>>8), byte(msgLen)
+	return handshake
+}
+
+// toRecords wraps a handshake message into TLS records of at most size bytes.
+func toRecords(handshake []byte, size int) []byte {
+	record := append([]byte{0x16, 0x03, 0x01, 0x00, 0x00}, handshake...)
+	return fragment(record, size)
+}
+
+func TestParseFragmentedClientHello(t *testing.T) {
+	for _, size := range []int{1, 3, 4, 7, 100, 512} {
+		cBuf := protocol.NewConnBuf()
+		cBuf.Write(fragment(CH_cloudflare_dns_com, size))
+
+		connInfo, err := tls.ParseClientHello(context.Background(), cBuf)
+		if err != nil {
+			t.Fatalf("ParseClientHello failed for %d-byte records: %v", size, err)
+		}
+		if connInfo.SNI != "cloudflare-dns.com" {
+			t.Errorf("SNI mismatch for %d-byte records: %v", size, connInfo.SNI)
+		}
+		if connInfo.JA3 != "46f5131e766d248db0248a86c494b71c" {
+			t.Errorf("JA3 mismatch for %d-byte records: %v", size, connInfo.JA3)
+		}
+	}
+}
+
+func TestParseLargeClientHello(t *testing.T) {
+	handshake := withPadding(CH_alpn_h2_http11, 20000) // larger than a single record can carry
+	cBuf := protocol.NewConnBuf()
+	cBuf.Write(toRecords(handshake, 1<<14))
+
+	connInfo, err := tls.ParseClientHello(context.Background(), cBuf)
+	if err != nil {
+		t.Fatalf("ParseClientHello failed: %v", err)
+	}
+	if connInfo.SNI != "alpn.example.com" {
+		t.Errorf("SNI mismatch: %v", connInfo.SNI)
+	}
+}
+
+func TestParseClientHelloInSegments(t *testing.T) {
+	records := fragment(CH_quad9, 200)
+	cBuf := protocol.NewConnBuf()
+
+	// deliver the records in TCP-segment-like chunks not aligned with record boundaries
+	go func() {
+		for len(records) > 0 {
+			n := 37
+			if n > len(records) {
+				n = len(records)
+			}
+			cBuf.Write(records[:n])
+			records = records[n:]
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	connInfo, err := tls.ParseClientHello(ctx, cBuf)
+	if err != nil {
+		t.Fatalf("ParseClientHello failed: %v", err)
+	}
+	if connInfo.SNI != "dns.quad9.net" {
+		t.Errorf("SNI mismatch: %v", connInfo.SNI)
+	}
+}
+
+func TestReassembleHandshakeErrors(t *testing.T) {
+	tooLarge := toRecords(withPadding(CH_alpn_h2_http11, 20000), 1<<14)
+	tooLarge[5+1] = 0x10 // claim a 1MB handshake message
+
+	interleaved := fragment(CH_cloudflare_dns_com, 100)
+	interleaved = append(interleaved[:105:105], append([]byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01}, interleaved[105:]...)...)
+
+	for name, tc := range map[string]struct {
+		data []byte
+		err  error
+	}{
+		"not TLS":        {[]byte("GET / HTTP/1.1\r\n"), tls.ErrNotTLS},
+		"not hello":      {[]byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00}, tls.ErrNotClientHello},
+		"empty record":   {[]byte{0x16, 0x03, 0x01, 0x00, 0x00}, tls.ErrMalformedRecord},
+		"interleaved":    {interleaved, tls.ErrMalformedRecord},
+		"too large":      {tooLarge, tls.ErrClientHelloTooLarge},
+		"partial header": {CH_cloudflare_dns_com[:3], protocol.ErrNotEnoughData},
+		"partial record": {CH_cloudflare_dns_com[:100], protocol.ErrNotEnoughData},
+	} {
+		_, _, err := tls.ReassembleHandshake(tc.data)
+		if err != tc.err {
+			t.Errorf("%s: expected %v, got %v", name, tc.err, err)
+		}
+	}
+}
+
+func FuzzReassembleHandshake(f *testing.F) {
+	for _, clientHello := range [][]byte{CH_cloudflare_dns_com, CH_quad9, CH_alpn_h2, CH_no_alpn, CH_tls12, CH_ech, sampleClientHello} {
+		f.Add(clientHello)
+		f.Add(fragment(clientHello, 1))
+		f.Add(fragment(clientHello, 64))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, need, err := tls.ReassembleHandshake(data)
+		switch err {
+		case nil:
+			if len(msg) < 4 || len(msg) > tls.MaxClientHelloSize {
+				t.Fatalf("invalid message length %d", len(msg))
+			}
+			tls.ParseClientHelloMsg(msg) // must not panic
+		case protocol.ErrNotEnoughData:
+			if need <= len(data) {
+				t.Fatalf("need %d bytes but already have %d", need, len(data))
+			}
+		}
+	})
+}
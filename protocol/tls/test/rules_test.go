@@ -0,0 +1,310 @@
+package tls_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gaukas/passthru/config"
+	"github.com/gaukas/passthru/protocol"
+	"github.com/gaukas/passthru/protocol/tls"
+)
+
+func TestSourceRules(t *testing.T) {
+	blockedFile := filepath.Join(t.TempDir(), "blocked.txt")
+	err := os.WriteFile(blockedFile, []byte("# known-bad ranges\n203.0.113.0/24\n\n2001:db8::/32\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write CIDR file: %v", err)
+	}
+
+	p := tls.Protocol{}
+	err = p.ApplyRules([]config.Rule{
+		"CATCHALL",
+		"SNI cloudflare-dns.com",
+		"SNI cloudflare-dns.com SRC 10.0.0.0/8,192.168.1.1",
+		"SRC_FILE " + blockedFile,
+	})
+	if err != nil {
+		t.Fatalf("Error applying rules: %s", err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr string
+		rule       config.Rule
+	}{
+		{"10.1.2.3:50000", "SNI cloudflare-dns.com SRC 10.0.0.0/8,192.168.1.1"},
+		{"192.168.1.1:50000", "SNI cloudflare-dns.com SRC 10.0.0.0/8,192.168.1.1"},
+		{"192.168.1.2:50000", "SNI cloudflare-dns.com"},
+		{"203.0.113.7:50000", config.Rule("SRC_FILE " + blockedFile)},
+		{"[2001:db8::1]:50000", config.Rule("SRC_FILE " + blockedFile)},
+	} {
+		addr, err := net.ResolveTCPAddr("tcp", tc.remoteAddr)
+		if err != nil {
+			t.Fatalf("failed to resolve %s: %v", tc.remoteAddr, err)
+		}
+
+		cBuf := protocol.NewConnBuf()
+		cBuf.SetRemoteAddr(addr)
+		cBuf.Write(CH_cloudflare_dns_com)
+		rule, err := p.Identify(context.Background(), cBuf)
+		if err != nil {
+			t.Errorf("Error identifying rule for %s: %s", tc.remoteAddr, err)
+		}
+		if rule != tc.rule {
+			t.Errorf("Wrong rule identified for %s: %s", tc.remoteAddr, rule)
+		}
+	}
+}
+
+func TestInvalidSourceRules(t *testing.T) {
+	for _, rule := range []config.Rule{
+		"SRC",
+		"SRC 10.0.0.0/33",
+		"SRC not-an-ip",
+		"SRC_FILE /nonexistent/passthru/cidrs.txt",
+		"CATCHALL SRC 10.0.0.0/8",
+		"SNI example.com ALPN h2",
+		"SRC 10.0.0.0/8 SRC 192.168.0.0/16",
+		"ALPN_NONE h2",
+		"ALPN_ANY",
+		"TLS_MIN_VERSION 1.4",
+		"TLS_MIN_VERSION 5",
+		"TLS_MIN_VERSION 0x0300",
+		"TLS_MIN_VERSION 0x0305",
+		"CIPHER TLS_NOT_A_SUITE",
+		"GROUP 70000",
+		"ECH maybe",
+		"ECH_PUBLIC_NAME",
+		"NO_SNI example.com",
+		"SNI_IP 1.1.1.1",
+	} {
+		_, err := tls.ParseRule(rule)
+		if err == nil {
+			t.Errorf("rule %q should be rejected", rule)
+		}
+	}
+}
+
+func TestExpressionRules(t *testing.T) {
+	p := tls.Protocol{}
+	err := p.ApplyRules([]config.Rule{
+		"CATCHALL",
+		"SNI cloudflare-dns.com",
+		"SNI cloudflare-dns.com AND NOT SRC 10.0.0.0/8",
+		"(SNI dns.quad9.net OR SNI dns.google) AND ALPN h2",
+	})
+	if err != nil {
+		t.Fatalf("Error applying rules: %s", err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr  string
+		clientHello []byte
+		rule        config.Rule
+	}{
+		{"192.168.1.1:50000", CH_cloudflare_dns_com, "SNI cloudflare-dns.com AND NOT SRC 10.0.0.0/8"},
+		{"10.1.2.3:50000", CH_cloudflare_dns_com, "SNI cloudflare-dns.com"},
+		{"10.1.2.3:50000", CH_quad9, "(SNI dns.quad9.net OR SNI dns.google) AND ALPN h2"},
+		{"10.1.2.3:50000", CH_catchall, "CATCHALL"},
+	} {
+		addr, err := net.ResolveTCPAddr("tcp", tc.remoteAddr)
+		if err != nil {
+			t.Fatalf("failed to resolve %s: %v", tc.remoteAddr, err)
+		}
+
+		cBuf := protocol.NewConnBuf()
+		cBuf.SetRemoteAddr(addr)
+		cBuf.Write(tc.clientHello)
+		rule, err := p.Identify(context.Background(), cBuf)
+		if err != nil {
+			t.Errorf("Error identifying rule for %s: %s", tc.remoteAddr, err)
+		}
+		if rule != tc.rule {
+			t.Errorf("Wrong rule identified for %s: %s", tc.remoteAddr, rule)
+		}
+	}
+}
+
+func TestInvalidExpressionRules(t *testing.T) {
+	for _, rule := range []config.Rule{
+		"SNI a.com AND",
+		"SNI a.com AND FOO bar",
+		"SNI a.com OR CATCHALL",
+		"(SNI a.com",
+	} {
+		err := (&tls.Protocol{}).ApplyRules([]config.Rule{rule})
+		if !errors.Is(err, config.ErrInvalidRuleExpr) {
+			t.Errorf("expected ErrInvalidRuleExpr for %q, got %v", rule, err)
+		}
+	}
+}
+
+func TestALPNRules(t *testing.T) {
+	for _, tc := range []struct {
+		rules       []config.Rule
+		clientHello []byte
+		rule        config.Rule
+	}{
+		{[]config.Rule{"ALPN http/1.1", "CATCHALL"}, CH_alpn_h2_http11, "CATCHALL"},
+		{[]config.Rule{"ALPN_ANY http/1.1", "CATCHALL"}, CH_alpn_h2_http11, "ALPN_ANY http/1.1"},
+		{[]config.Rule{"ALPN_FIRST h2", "CATCHALL"}, CH_alpn_h2_http11, "ALPN_FIRST h2"},
+		{[]config.Rule{"ALPN_FIRST http/1.1", "CATCHALL"}, CH_alpn_h2_http11, "CATCHALL"},
+		{[]config.Rule{"ALPN_ALL h2,http/1.1", "CATCHALL"}, CH_alpn_h2_http11, "ALPN_ALL h2,http/1.1"},
+		{[]config.Rule{"ALPN_ALL h2,h3", "CATCHALL"}, CH_alpn_h2_http11, "CATCHALL"},
+		{[]config.Rule{"ALPN_NONE", "CATCHALL"}, CH_alpn_h2_http11, "CATCHALL"},
+		{[]config.Rule{"ALPN_NONE", "CATCHALL"}, CH_no_alpn, "ALPN_NONE"},
+		{[]config.Rule{"ALPN_ANY h2", "CATCHALL"}, CH_no_alpn, "CATCHALL"},
+	} {
+		p := tls.Protocol{}
+		err := p.ApplyRules(tc.rules)
+		if err != nil {
+			t.Fatalf("Error applying rules: %s", err)
+		}
+
+		cBuf := protocol.NewConnBuf()
+		cBuf.Write(tc.clientHello)
+		rule, err := p.Identify(context.Background(), cBuf)
+		if err != nil {
+			t.Errorf("Error identifying rule for %v: %s", tc.rules, err)
+		}
+		if rule != tc.rule {
+			t.Errorf("Wrong rule identified for %v: %s", tc.rules, rule)
+		}
+	}
+}
+
+func TestClientHelloAttributeRules(t *testing.T) {
+	for _, tc := range []struct {
+		rules       []config.Rule
+		clientHello []byte
+		rule        config.Rule
+	}{
+		{[]config.Rule{"TLS_MIN_VERSION 1.3", "CATCHALL"}, CH_cloudflare_dns_com, "TLS_MIN_VERSION 1.3"},
+		{[]config.Rule{"TLS_MIN_VERSION 1.3", "CATCHALL"}, CH_tls12, "CATCHALL"},
+		{[]config.Rule{"NOT TLS_MIN_VERSION 1.3", "CATCHALL"}, CH_tls12, "NOT TLS_MIN_VERSION 1.3"},
+		{[]config.Rule{"TLS_MIN_VERSION 0x0303", "CATCHALL"}, CH_tls12, "TLS_MIN_VERSION 0x0303"},
+		{[]config.Rule{"CIPHER TLS_AES_128_GCM_SHA256", "CATCHALL"}, CH_cloudflare_dns_com, "CIPHER TLS_AES_128_GCM_SHA256"},
+		{[]config.Rule{"CIPHER 0x1301,0x1302", "CATCHALL"}, CH_tls12, "CATCHALL"},
+		{[]config.Rule{"EXTENSION key_share", "CATCHALL"}, CH_cloudflare_dns_com, "EXTENSION key_share"},
+		{[]config.Rule{"EXTENSION 51", "CATCHALL"}, CH_tls12, "CATCHALL"},
+		{[]config.Rule{"GROUP x25519", "CATCHALL"}, CH_cloudflare_dns_com, "GROUP x25519"},
+		{[]config.Rule{"GROUP ffdhe2048,0x0101", "CATCHALL"}, CH_cloudflare_dns_com, "CATCHALL"},
+	} {
+		p := tls.Protocol{}
+		err := p.ApplyRules(tc.rules)
+		if err != nil {
+			t.Fatalf("Error applying rules: %s", err)
+		}
+
+		cBuf := protocol.NewConnBuf()
+		cBuf.Write(tc.clientHello)
+		rule, err := p.Identify(context.Background(), cBuf)
+		if err != nil {
+			t.Errorf("Error identifying rule for %v: %s", tc.rules, err)
+		}
+		if rule != tc.rule {
+			t.Errorf("Wrong rule identified for %v: %s", tc.rules, rule)
+		}
+	}
+}
+
+func TestECHRules(t *testing.T) {
+	for _, tc := range []struct {
+		rules       []config.Rule
+		clientHello []byte
+		rule        config.Rule
+	}{
+		{[]config.Rule{"ECH yes", "CATCHALL"}, CH_ech, "ECH yes"},
+		{[]config.Rule{"ECH yes", "CATCHALL"}, CH_cloudflare_dns_com, "CATCHALL"},
+		{[]config.Rule{"ECH no", "CATCHALL"}, CH_cloudflare_dns_com, "ECH no"},
+		{[]config.Rule{"ECH_PUBLIC_NAME cover.example.com", "CATCHALL"}, CH_ech, "ECH_PUBLIC_NAME cover.example.com"},
+		{[]config.Rule{"ECH_PUBLIC_NAME other.example.com", "CATCHALL"}, CH_ech, "CATCHALL"},
+		{[]config.Rule{"SNI cover.example.com AND ECH no", "CATCHALL"}, CH_ech, "CATCHALL"},
+	} {
+		p := tls.Protocol{}
+		err := p.ApplyRules(tc.rules)
+		if err != nil {
+			t.Fatalf("Error applying rules: %s", err)
+		}
+
+		cBuf := protocol.NewConnBuf()
+		cBuf.Write(tc.clientHello)
+		rule, err := p.Identify(context.Background(), cBuf)
+		if err != nil {
+			t.Errorf("Error identifying rule for %v: %s", tc.rules, err)
+		}
+		if rule != tc.rule {
+			t.Errorf("Wrong rule identified for %v: %s", tc.rules, rule)
+		}
+	}
+}
+
+func TestMissingSNIRules(t *testing.T) {
+	p := tls.Protocol{}
+	err := p.ApplyRules([]config.Rule{
+		"NO_SNI",
+		"SNI_IP",
+		"CATCHALL",
+	})
+	if err != nil {
+		t.Fatalf("Error applying rules: %s", err)
+	}
+
+	for _, tc := range []struct {
+		clientHello []byte
+		rule        config.Rule
+	}{
+		{CH_no_sni, "NO_SNI"},
+		{sampleClientHello, "SNI_IP"}, // SNI is 107.182.26.119
+		{CH_cloudflare_dns_com, "CATCHALL"},
+	} {
+		cBuf := protocol.NewConnBuf()
+		cBuf.Write(tc.clientHello)
+		rule, err := p.Identify(context.Background(), cBuf)
+		if err != nil {
+			t.Errorf("Error identifying rule: %s", err)
+		}
+		if rule != tc.rule {
+			t.Errorf("Wrong rule identified: %s", rule)
+		}
+	}
+}
+
+func TestOverlappingRulesOrder(t *testing.T) {
+	rules := []config.Rule{
+		"SNI cloudflare-dns.com SRC 10.0.0.0/8",
+		"SNI cloudflare-dns.com AND ALPN h2",
+		"SNI cloudflare-dns.com AND ALPN h2 AND TLS_MIN_VERSION 1.3",
+		"ALPN h2",
+		"TLS_MIN_VERSION 1.3",
+		"SNI cloudflare-dns.com",
+	}
+	expected := []config.Rule{
+		"SNI cloudflare-dns.com AND ALPN h2 AND TLS_MIN_VERSION 1.3", // more terms first
+		"SNI cloudflare-dns.com AND ALPN h2",
+		"SNI cloudflare-dns.com SRC 10.0.0.0/8",
+		"SNI cloudflare-dns.com", // the server name before other attributes
+		"ALPN h2",
+		"TLS_MIN_VERSION 1.3",
+	}
+
+	// the same order whatever order the rules come in, as they come from a map
+	for _, order := range [][]int{{0, 1, 2, 3, 4, 5}, {5, 4, 3, 2, 1, 0}, {1, 4, 0, 5, 3, 2}} {
+		shuffled := []config.Rule{}
+		for _, i := range order {
+			shuffled = append(shuffled, rules[i])
+		}
+		parsed, err := tls.ParseRules(shuffled)
+		if err != nil {
+			t.Fatalf("Error parsing rules: %s", err)
+		}
+		for i, rule := range parsed {
+			if rule.RuleName != expected[i] {
+				t.Errorf("order %v: expected %q at %d, got %q", order, expected[i], i, rule.RuleName)
+			}
+		}
+	}
+}
@@ -248,4 +248,219 @@ var (
 		0x10, 0x4b, 0xbf, 0x6f, 0xf1, 0x47, 0x99, 0xac,
 		0x66, 0x2f, 0x8c, 0x31, 0xe6,
 	}
+
+	CH_alpn_h2_http11 = []byte{
+		0x16, 0x03, 0x01, 0x01, 0x37, 0x01, 0x00, 0x01,
+		0x33, 0x03, 0x03, 0x6b, 0xd0, 0x97, 0xeb, 0xa5,
+		0x21, 0x42, 0x7f, 0x8e, 0x42, 0xb9, 0xc1, 0xf1,
+		0x25, 0x97, 0xa0, 0x6c, 0x5d, 0x81, 0xc0, 0x6e,
+		0x2d, 0x35, 0xe9, 0xcf, 0x31, 0x4f, 0x66, 0xc2,
+		0xcd, 0x8f, 0x24, 0x20, 0x58, 0x29, 0x31, 0x7a,
+		0x34, 0xd3, 0xb4, 0xdd, 0x90, 0x62, 0xf2, 0x30,
+		0x6e, 0x80, 0xec, 0x73, 0x7d, 0x5c, 0x47, 0xcb,
+		0xb2, 0xe6, 0xd6, 0xba, 0xb7, 0xfa, 0x2c, 0x25,
+		0x06, 0xfa, 0x05, 0x74, 0x00, 0x1a, 0xc0, 0x2b,
+		0xc0, 0x2f, 0xc0, 0x2c, 0xc0, 0x30, 0xcc, 0xa9,
+		0xcc, 0xa8, 0xc0, 0x09, 0xc0, 0x13, 0xc0, 0x0a,
+		0xc0, 0x14, 0x13, 0x01, 0x13, 0x02, 0x13, 0x03,
+		0x01, 0x00, 0x00, 0xd0, 0x00, 0x00, 0x00, 0x15,
+		0x00, 0x13, 0x00, 0x00, 0x10, 0x61, 0x6c, 0x70,
+		0x6e, 0x2e, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c,
+		0x65, 0x2e, 0x63, 0x6f, 0x6d, 0x00, 0x0b, 0x00,
+		0x02, 0x01, 0x00, 0xff, 0x01, 0x00, 0x01, 0x00,
+		0x00, 0x17, 0x00, 0x00, 0x00, 0x12, 0x00, 0x00,
+		0x00, 0x05, 0x00, 0x05, 0x01, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x0a, 0x00, 0x0a, 0x00, 0x08, 0x00,
+		0x1d, 0x00, 0x17, 0x00, 0x18, 0x00, 0x19, 0x00,
+		0x0d, 0x00, 0x20, 0x00, 0x1e, 0x09, 0x04, 0x09,
+		0x05, 0x09, 0x06, 0x08, 0x04, 0x04, 0x03, 0x08,
+		0x07, 0x08, 0x05, 0x08, 0x06, 0x04, 0x01, 0x05,
+		0x01, 0x06, 0x01, 0x05, 0x03, 0x06, 0x03, 0x02,
+		0x01, 0x02, 0x03, 0x00, 0x32, 0x00, 0x20, 0x00,
+		0x1e, 0x09, 0x04, 0x09, 0x05, 0x09, 0x06, 0x08,
+		0x04, 0x04, 0x03, 0x08, 0x07, 0x08, 0x05, 0x08,
+		0x06, 0x04, 0x01, 0x05, 0x01, 0x06, 0x01, 0x05,
+		0x03, 0x06, 0x03, 0x02, 0x01, 0x02, 0x03, 0x00,
+		0x10, 0x00, 0x0e, 0x00, 0x0c, 0x02, 0x68, 0x32,
+		0x08, 0x68, 0x74, 0x74, 0x70, 0x2f, 0x31, 0x2e,
+		0x31, 0x00, 0x2b, 0x00, 0x05, 0x04, 0x03, 0x04,
+		0x03, 0x03, 0x00, 0x33, 0x00, 0x26, 0x00, 0x24,
+		0x00, 0x1d, 0x00, 0x20, 0xf5, 0x4b, 0x25, 0x94,
+		0x74, 0xb9, 0x8f, 0x4e, 0xaa, 0x9a, 0xe8, 0x62,
+		0x04, 0x43, 0xa6, 0x81, 0x39, 0xa1, 0xcd, 0xcb,
+		0x26, 0xb9, 0x0f, 0x90, 0x71, 0x95, 0xf7, 0x46,
+		0xb4, 0x1d, 0xae, 0x45,
+	}
+
+	CH_no_alpn = []byte{
+		0x16, 0x03, 0x01, 0x01, 0x27, 0x01, 0x00, 0x01,
+		0x23, 0x03, 0x03, 0x82, 0x10, 0x84, 0x2c, 0x7d,
+		0xb3, 0x77, 0xb8, 0xbb, 0xc0, 0x8f, 0x5b, 0x13,
+		0x58, 0xca, 0xfc, 0x87, 0xf0, 0x2c, 0x40, 0xbd,
+		0x5c, 0x45, 0xa0, 0x64, 0x9a, 0xcd, 0xa3, 0xcf,
+		0x0d, 0x19, 0xb2, 0x20, 0xc5, 0xf1, 0x1b, 0x12,
+		0x45, 0x46, 0xad, 0x7a, 0xf3, 0xd2, 0xdc, 0x5c,
+		0xd8, 0x48, 0xc8, 0x24, 0x0d, 0xc6, 0xbe, 0xa4,
+		0x36, 0x21, 0xe3, 0xda, 0xf5, 0xdc, 0x95, 0x1b,
+		0xb3, 0xe2, 0x89, 0x86, 0x00, 0x1a, 0xc0, 0x2b,
+		0xc0, 0x2f, 0xc0, 0x2c, 0xc0, 0x30, 0xcc, 0xa9,
+		0xcc, 0xa8, 0xc0, 0x09, 0xc0, 0x13, 0xc0, 0x0a,
+		0xc0, 0x14, 0x13, 0x01, 0x13, 0x02, 0x13, 0x03,
+		0x01, 0x00, 0x00, 0xc0, 0x00, 0x00, 0x00, 0x17,
+		0x00, 0x15, 0x00, 0x00, 0x12, 0x6e, 0x6f, 0x61,
+		0x6c, 0x70, 0x6e, 0x2e, 0x65, 0x78, 0x61, 0x6d,
+		0x70, 0x6c, 0x65, 0x2e, 0x63, 0x6f, 0x6d, 0x00,
+		0x0b, 0x00, 0x02, 0x01, 0x00, 0xff, 0x01, 0x00,
+		0x01, 0x00, 0x00, 0x17, 0x00, 0x00, 0x00, 0x12,
+		0x00, 0x00, 0x00, 0x05, 0x00, 0x05, 0x01, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x0a, 0x00, 0x0a, 0x00,
+		0x08, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x18, 0x00,
+		0x19, 0x00, 0x0d, 0x00, 0x20, 0x00, 0x1e, 0x09,
+		0x04, 0x09, 0x05, 0x09, 0x06, 0x08, 0x04, 0x04,
+		0x03, 0x08, 0x07, 0x08, 0x05, 0x08, 0x06, 0x04,
+		0x01, 0x05, 0x01, 0x06, 0x01, 0x05, 0x03, 0x06,
+		0x03, 0x02, 0x01, 0x02, 0x03, 0x00, 0x32, 0x00,
+		0x20, 0x00, 0x1e, 0x09, 0x04, 0x09, 0x05, 0x09,
+		0x06, 0x08, 0x04, 0x04, 0x03, 0x08, 0x07, 0x08,
+		0x05, 0x08, 0x06, 0x04, 0x01, 0x05, 0x01, 0x06,
+		0x01, 0x05, 0x03, 0x06, 0x03, 0x02, 0x01, 0x02,
+		0x03, 0x00, 0x2b, 0x00, 0x05, 0x04, 0x03, 0x04,
+		0x03, 0x03, 0x00, 0x33, 0x00, 0x26, 0x00, 0x24,
+		0x00, 0x1d, 0x00, 0x20, 0x36, 0x35, 0x56, 0x04,
+		0x01, 0x54, 0x23, 0x8d, 0x57, 0x87, 0x69, 0x3e,
+		0x15, 0x6a, 0xc5, 0xea, 0x2e, 0x11, 0x49, 0x12,
+		0x29, 0xa7, 0x0d, 0x29, 0xae, 0x41, 0xbd, 0xe0,
+		0x48, 0x07, 0xef, 0x0d,
+	}
+
+	CH_tls12 = []byte{
+		0x16, 0x03, 0x01, 0x00, 0xe9, 0x01, 0x00, 0x00,
+		0xe5, 0x03, 0x03, 0x1d, 0x2e, 0x32, 0x6d, 0x73,
+		0x59, 0xcf, 0xb3, 0x5e, 0xd6, 0x19, 0xe6, 0x3d,
+		0x6e, 0xcb, 0xcd, 0x75, 0x3e, 0xd5, 0x7a, 0xa0,
+		0xe2, 0x0c, 0xbd, 0x1d, 0x6f, 0x37, 0xbd, 0x77,
+		0x59, 0xe5, 0x0b, 0x20, 0x16, 0x6d, 0xfd, 0x47,
+		0x33, 0x6f, 0x22, 0x81, 0x03, 0x3d, 0x04, 0xd9,
+		0x51, 0x58, 0x03, 0xd3, 0x39, 0x75, 0x02, 0x31,
+		0x31, 0x45, 0x94, 0x8e, 0x9e, 0x9c, 0xba, 0xfe,
+		0x60, 0xb7, 0xbb, 0xd5, 0x00, 0x14, 0xc0, 0x2b,
+		0xc0, 0x2f, 0xc0, 0x2c, 0xc0, 0x30, 0xcc, 0xa9,
+		0xcc, 0xa8, 0xc0, 0x09, 0xc0, 0x13, 0xc0, 0x0a,
+		0xc0, 0x14, 0x01, 0x00, 0x00, 0x88, 0x00, 0x00,
+		0x00, 0x17, 0x00, 0x15, 0x00, 0x00, 0x12, 0x6c,
+		0x65, 0x67, 0x61, 0x63, 0x79, 0x2e, 0x65, 0x78,
+		0x61, 0x6d, 0x70, 0x6c, 0x65, 0x2e, 0x63, 0x6f,
+		0x6d, 0x00, 0x0b, 0x00, 0x02, 0x01, 0x00, 0xff,
+		0x01, 0x00, 0x01, 0x00, 0x00, 0x17, 0x00, 0x00,
+		0x00, 0x12, 0x00, 0x00, 0x00, 0x05, 0x00, 0x05,
+		0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0a, 0x00,
+		0x0a, 0x00, 0x08, 0x00, 0x1d, 0x00, 0x17, 0x00,
+		0x18, 0x00, 0x19, 0x00, 0x0d, 0x00, 0x1a, 0x00,
+		0x18, 0x08, 0x04, 0x04, 0x03, 0x08, 0x07, 0x08,
+		0x05, 0x08, 0x06, 0x04, 0x01, 0x05, 0x01, 0x06,
+		0x01, 0x05, 0x03, 0x06, 0x03, 0x02, 0x01, 0x02,
+		0x03, 0x00, 0x32, 0x00, 0x1a, 0x00, 0x18, 0x08,
+		0x04, 0x04, 0x03, 0x08, 0x07, 0x08, 0x05, 0x08,
+		0x06, 0x04, 0x01, 0x05, 0x01, 0x06, 0x01, 0x05,
+		0x03, 0x06, 0x03, 0x02, 0x01, 0x02, 0x03, 0x00,
+		0x2b, 0x00, 0x03, 0x02, 0x03, 0x03,
+	}
+
+	CH_ech = []byte{
+		0x16, 0x03, 0x01, 0x01, 0xbe, 0x01, 0x00, 0x01,
+		0xba, 0x03, 0x03, 0x83, 0x81, 0x97, 0xde, 0x19,
+		0x2a, 0xc7, 0xad, 0xbf, 0x1d, 0x82, 0x95, 0xd8,
+		0x54, 0x12, 0x5a, 0xf0, 0xa0, 0x8b, 0xaa, 0x0d,
+		0x77, 0xa2, 0x91, 0x44, 0x30, 0x3b, 0x36, 0xaa,
+		0x71, 0xf6, 0xb9, 0x20, 0xae, 0xef, 0x91, 0x29,
+		0x14, 0xe0, 0x53, 0xd9, 0x8d, 0xee, 0xd4, 0x20,
+		0x6a, 0xb3, 0xa4, 0xf0, 0x37, 0x30, 0xd5, 0xe3,
+		0xf4, 0x9a, 0xb7, 0x21, 0xab, 0xa1, 0x20, 0x6d,
+		0x44, 0xa3, 0x6e, 0x2a, 0x00, 0x06, 0x13, 0x01,
+		0x13, 0x02, 0x13, 0x03, 0x01, 0x00, 0x01, 0x6b,
+		0x00, 0x00, 0x00, 0x16, 0x00, 0x14, 0x00, 0x00,
+		0x11, 0x63, 0x6f, 0x76, 0x65, 0x72, 0x2e, 0x65,
+		0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x2e, 0x63,
+		0x6f, 0x6d, 0x00, 0x12, 0x00, 0x00, 0xfe, 0x0d,
+		0x00, 0xba, 0x00, 0x00, 0x01, 0x00, 0x01, 0x2a,
+		0x00, 0x20, 0xb4, 0x0b, 0xcb, 0x8d, 0xd8, 0x66,
+		0xd3, 0xf3, 0x26, 0x61, 0xe3, 0x5b, 0xa5, 0x70,
+		0x19, 0x97, 0x27, 0x1a, 0xb7, 0xbb, 0x69, 0xb5,
+		0xef, 0x56, 0x60, 0xcf, 0x17, 0xce, 0x09, 0x41,
+		0x71, 0x09, 0x00, 0x90, 0xfa, 0xa8, 0xa0, 0xa3,
+		0x57, 0x90, 0x35, 0xc1, 0xe2, 0x2f, 0xbf, 0xd6,
+		0x44, 0xb2, 0x5d, 0xa8, 0xa7, 0x8b, 0xca, 0x7e,
+		0xe9, 0x5c, 0xc1, 0xd0, 0xa4, 0x4e, 0x21, 0xc2,
+		0x65, 0x0a, 0xd8, 0xdc, 0xea, 0xb6, 0x58, 0x20,
+		0xe3, 0xe0, 0xc8, 0x84, 0xdb, 0x3b, 0xc4, 0x72,
+		0x69, 0xc6, 0xd5, 0x4c, 0xcc, 0xdf, 0x6c, 0x76,
+		0x0e, 0x12, 0xd3, 0x8a, 0x11, 0x96, 0xc3, 0x3d,
+		0x94, 0x54, 0xfa, 0x7f, 0x79, 0x4b, 0xde, 0x83,
+		0x7f, 0x0e, 0x08, 0x47, 0x6b, 0x7b, 0x41, 0x40,
+		0x9b, 0x3a, 0xa6, 0xeb, 0x70, 0x6d, 0xb2, 0xbb,
+		0xb9, 0x42, 0x2d, 0xeb, 0x56, 0x49, 0x57, 0x0c,
+		0x7e, 0xae, 0xec, 0x02, 0xb3, 0xf8, 0x7a, 0xa2,
+		0x2e, 0x55, 0x23, 0xe5, 0xb9, 0x29, 0x98, 0x1e,
+		0xc6, 0xdd, 0x77, 0xfc, 0xbd, 0x77, 0x01, 0x22,
+		0x63, 0x5b, 0x22, 0xb2, 0xdf, 0xc2, 0xe5, 0xfb,
+		0x9b, 0xee, 0xea, 0x92, 0xb2, 0x66, 0x2a, 0xb8,
+		0xd4, 0x86, 0xb4, 0xb1, 0x00, 0x20, 0x97, 0xeb,
+		0xbc, 0x0a, 0xd8, 0x71, 0x00, 0x05, 0x00, 0x05,
+		0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0a, 0x00,
+		0x0a, 0x00, 0x08, 0x00, 0x1d, 0x00, 0x17, 0x00,
+		0x18, 0x00, 0x19, 0x00, 0x0d, 0x00, 0x16, 0x00,
+		0x14, 0x09, 0x04, 0x09, 0x05, 0x09, 0x06, 0x08,
+		0x04, 0x04, 0x03, 0x08, 0x07, 0x08, 0x05, 0x08,
+		0x06, 0x05, 0x03, 0x06, 0x03, 0x00, 0x32, 0x00,
+		0x20, 0x00, 0x1e, 0x09, 0x04, 0x09, 0x05, 0x09,
+		0x06, 0x08, 0x04, 0x04, 0x03, 0x08, 0x07, 0x08,
+		0x05, 0x08, 0x06, 0x04, 0x01, 0x05, 0x01, 0x06,
+		0x01, 0x05, 0x03, 0x06, 0x03, 0x02, 0x01, 0x02,
+		0x03, 0x00, 0x10, 0x00, 0x05, 0x00, 0x03, 0x02,
+		0x68, 0x32, 0x00, 0x2b, 0x00, 0x03, 0x02, 0x03,
+		0x04, 0x00, 0x33, 0x00, 0x26, 0x00, 0x24, 0x00,
+		0x1d, 0x00, 0x20, 0xdb, 0xa2, 0xe8, 0x19, 0x26,
+		0x1c, 0x78, 0x5b, 0x38, 0xce, 0xd3, 0xa2, 0xd8,
+		0xfd, 0xa5, 0xc1, 0x96, 0xe0, 0x66, 0x66, 0xcc,
+		0xa9, 0x64, 0x0f, 0xe6, 0x98, 0x97, 0x34, 0x63,
+		0xb9, 0x23, 0x46,
+	}
+
+	CH_no_sni = []byte{
+		0x16, 0x03, 0x01, 0x01, 0x0c, 0x01, 0x00, 0x01,
+		0x08, 0x03, 0x03, 0x9b, 0x47, 0x42, 0x1e, 0xe6,
+		0x40, 0x66, 0xca, 0x1a, 0x20, 0xba, 0xe4, 0x32,
+		0x32, 0xb2, 0xb0, 0x05, 0x82, 0xef, 0xec, 0x61,
+		0x93, 0x95, 0x79, 0x87, 0x7e, 0xfd, 0x75, 0x8c,
+		0x33, 0x3a, 0xbd, 0x20, 0x17, 0xdc, 0xc8, 0x25,
+		0x3d, 0xfe, 0x37, 0x15, 0x3e, 0xca, 0xc6, 0x30,
+		0x97, 0x2c, 0x7a, 0xba, 0xc9, 0xe0, 0x2c, 0x14,
+		0x7c, 0xee, 0x67, 0xcd, 0x11, 0x3d, 0xb8, 0x94,
+		0xd4, 0x9a, 0x00, 0x01, 0x00, 0x1a, 0xc0, 0x2b,
+		0xc0, 0x2f, 0xc0, 0x2c, 0xc0, 0x30, 0xcc, 0xa9,
+		0xcc, 0xa8, 0xc0, 0x09, 0xc0, 0x13, 0xc0, 0x0a,
+		0xc0, 0x14, 0x13, 0x01, 0x13, 0x02, 0x13, 0x03,
+		0x01, 0x00, 0x00, 0xa5, 0x00, 0x0b, 0x00, 0x02,
+		0x01, 0x00, 0xff, 0x01, 0x00, 0x01, 0x00, 0x00,
+		0x17, 0x00, 0x00, 0x00, 0x12, 0x00, 0x00, 0x00,
+		0x05, 0x00, 0x05, 0x01, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x0a, 0x00, 0x0a, 0x00, 0x08, 0x00, 0x1d,
+		0x00, 0x17, 0x00, 0x18, 0x00, 0x19, 0x00, 0x0d,
+		0x00, 0x20, 0x00, 0x1e, 0x09, 0x04, 0x09, 0x05,
+		0x09, 0x06, 0x08, 0x04, 0x04, 0x03, 0x08, 0x07,
+		0x08, 0x05, 0x08, 0x06, 0x04, 0x01, 0x05, 0x01,
+		0x06, 0x01, 0x05, 0x03, 0x06, 0x03, 0x02, 0x01,
+		0x02, 0x03, 0x00, 0x32, 0x00, 0x20, 0x00, 0x1e,
+		0x09, 0x04, 0x09, 0x05, 0x09, 0x06, 0x08, 0x04,
+		0x04, 0x03, 0x08, 0x07, 0x08, 0x05, 0x08, 0x06,
+		0x04, 0x01, 0x05, 0x01, 0x06, 0x01, 0x05, 0x03,
+		0x06, 0x03, 0x02, 0x01, 0x02, 0x03, 0x00, 0x2b,
+		0x00, 0x05, 0x04, 0x03, 0x04, 0x03, 0x03, 0x00,
+		0x33, 0x00, 0x26, 0x00, 0x24, 0x00, 0x1d, 0x00,
+		0x20, 0x02, 0xcc, 0xc8, 0x73, 0x40, 0x73, 0xc7,
+		0x24, 0x10, 0xb6, 0x1e, 0x2f, 0x20, 0xa6, 0x49,
+		0x59, 0x92, 0x6e, 0x28, 0x9f, 0x0d, 0x6c, 0xaa,
+		0xf2, 0x2f, 0x53, 0x81, 0xb3, 0x65, 0x59, 0x03,
+		0x41,
+	}
 )